@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"file_manage/models"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// archiveEntry is a file and the path it gets inside a zip archive
+type archiveEntry struct {
+	Path string
+	File models.File
+}
+
+var zipNameReplacer = strings.NewReplacer("/", "_", "\\", "_")
+
+// zipName turns a file or folder name into a single path element, names
+// like ".." would otherwise climb out of their folder when extracted
+func zipName(name string) string {
+	name = zipNameReplacer.Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// uniquePath returns p, or p with a " (n)" suffix before its extension if
+// an earlier entry already took it. Zip tools compare names case
+// insensitively on some systems, so collisions are too.
+func uniquePath(taken map[string]bool, p string) string {
+	candidate := p
+	ext := path.Ext(p)
+	for n := 1; taken[strings.ToLower(candidate)]; n++ {
+		candidate = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(p, ext), n, ext)
+	}
+	taken[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// folderEntries lists the files in a folder and its subfolders with their
+// path relative to it
+func (h *FileHandler) folderEntries(ctx context.Context, folder models.Folder) ([]archiveEntry, error) {
+	ids, err := h.descendantFolders(folder.ID)
+	if err != nil {
+		return nil, err
+	}
+	var folders []models.Folder
+	if err := h.DB.WithContext(ctx).Where("id IN ?", ids).Find(&folders).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]models.Folder, len(folders))
+	for _, f := range folders {
+		byID[f.ID] = f
+	}
+
+	// Paths of the subfolders, the folder itself is the root of the archive
+	paths := map[uint]string{folder.ID: ""}
+	var folderPath func(id uint) string
+	folderPath = func(id uint) string {
+		if p, ok := paths[id]; ok {
+			return p
+		}
+		f := byID[id]
+		p := zipName(f.Name)
+		if f.ParentID != nil {
+			p = path.Join(folderPath(*f.ParentID), p)
+		}
+		paths[id] = p
+		return p
+	}
+
+	var files []models.File
+	if err := h.DB.WithContext(ctx).Where("folder_id IN ?", ids).Order("folder_id, name").Find(&files).Error; err != nil {
+		return nil, err
+	}
+	entries := make([]archiveEntry, 0, len(files))
+	for _, file := range files {
+		entries = append(entries, archiveEntry{Path: path.Join(folderPath(*file.FolderID), zipName(file.Name)), File: file})
+	}
+	return entries, nil
+}
+
+// archiveAllowed checks that entries fit in one archive, ARCHIVE_MAX_FILES
+func (h *FileHandler) archiveAllowed(c *gin.Context, entries []archiveEntry) bool {
+	if h.MaxArchiveFiles > 0 && int64(len(entries)) > h.MaxArchiveFiles {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Archives can hold at most %d files", h.MaxArchiveFiles)})
+		return false
+	}
+	return true
+}
+
+// writeArchive streams the entries as a zip archive. Files are read from
+// storage one at a time and nothing is buffered, so once the first byte is
+// out errors can only cut the archive short.
+func (h *FileHandler) writeArchive(c *gin.Context, name string, entries []archiveEntry) {
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", attachmentDisposition(name))
+	c.Header("Accept-Ranges", "none")
+	c.Status(http.StatusOK)
+
+	zw := zip.NewWriter(c.Writer)
+	taken := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if err := h.writeArchiveEntry(c.Request.Context(), zw, uniquePath(taken, entry.Path), entry.File); err != nil {
+			log.Printf("archive %s: stopped at file %d: %v", name, entry.File.ID, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("archive %s: %v", name, err)
+	}
+}
+
+func (h *FileHandler) writeArchiveEntry(ctx context.Context, zw *zip.Writer, name string, file models.File) error {
+	var blob models.Blob
+	if err := h.DB.First(&blob, file.BlobID).Error; err != nil {
+		return err
+	}
+	if err := blobHeld(blob); err != nil {
+		// Leave it out rather than failing the whole archive
+		log.Printf("archive: skipped file %d: %v", file.ID, err)
+		return nil
+	}
+	reader, err := h.openBlob(ctx, blob)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: file.UpdatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// DownloadArchive streams a zip of the files given by file_ids, a comma
+// separated list, or of everything in the folder given by folder_id
+func (h *FileHandler) DownloadArchive(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	if value := c.Query("folder_id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder ID"})
+			return
+		}
+		folder, err := h.findFolder(userID, uint(id), accessRead)
+		if err != nil {
+			folderError(c, err, "Folder not found")
+			return
+		}
+		entries, err := h.folderEntries(c.Request.Context(), folder)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list folder"})
+			return
+		}
+		if h.archiveAllowed(c, entries) {
+			h.writeArchive(c, folder.Name+".zip", entries)
+		}
+		return
+	}
+
+	var entries []archiveEntry
+	seen := make(map[uint]bool)
+	for _, value := range strings.Split(c.Query("file_ids"), ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+			return
+		}
+		if seen[uint(id)] {
+			continue
+		}
+		seen[uint(id)] = true
+
+		// Check every file before the first byte goes out
+		var file models.File
+		if err := h.db(c).First(&file, id).Error; err != nil || h.fileAccess(userID.(uint), file) == accessNone {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("File %d not found", id)})
+			return
+		}
+		entries = append(entries, archiveEntry{Path: zipName(file.Name), File: file})
+	}
+	if len(entries) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file_ids or folder_id is required"})
+		return
+	}
+	if !h.archiveAllowed(c, entries) {
+		return
+	}
+	h.writeArchive(c, fmt.Sprintf("files-%s.zip", time.Now().Format("20060102-150405")), entries)
+}
+
+// ShareFolder creates a share link that downloads a folder as a zip
+// archive. It takes the same options as ShareFile.
+func (h *FileHandler) ShareFolder(c *gin.Context) {
+	folder, ok := h.folderParam(c, accessOwner)
+	if !ok {
+		return
+	}
+	link, ok := h.parseShareOptions(c)
+	if !ok {
+		return
+	}
+
+	link.FolderID = folder.ID
+	link.FileName = folder.Name + ".zip"
+	if err := h.saveShareLink(c, link); err != nil {
+		fmt.Println("Error saving share link:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"shareURL":      fmt.Sprintf("http://%s/download/%s", c.Request.Host, link.Token),
+		"token":         link.Token,
+		"name":          link.Name,
+		"protected":     link.PasswordHash != "",
+		"max_downloads": link.MaxDownloads,
+		"expires_at":    link.Expires.Format(time.RFC3339),
+	})
+}
+
+// downloadFolderLink serves a folder share link as a zip archive, as long as
+// whoever created the link can still read the folder
+func (h *FileHandler) downloadFolderLink(c *gin.Context, token, ownerID string, folderID uint, limited bool) {
+	owner, _ := strconv.ParseUint(ownerID, 10, 64)
+	folder, err := h.findFolder(uint(owner), folderID, accessRead)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return
+	}
+	entries, err := h.folderEntries(c.Request.Context(), folder)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list folder"})
+		return
+	}
+	if !h.archiveAllowed(c, entries) {
+		return
+	}
+
+	// Archives are built on the fly, so there is nothing to seek in and HEAD
+	// only gets the headers
+	if c.Request.Method == http.MethodHead {
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", attachmentDisposition(folder.Name+".zip"))
+		c.Header("Accept-Ranges", "none")
+		c.Status(http.StatusOK)
+		return
+	}
+	if !h.countDownload(token, limited) {
+		c.JSON(http.StatusGone, gin.H{"error": "Link has reached its download limit"})
+		return
+	}
+	h.writeArchive(c, folder.Name+".zip", entries)
+}
@@ -1,10 +1,13 @@
 package handlers
 
 import (
+	"errors"
 	"file_manage/models"
+	"file_manage/tenant"
 	"file_manage/utils"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
@@ -19,12 +22,30 @@ func NewAuthHandler(db *gorm.DB) *AuthHandler {
 	return &AuthHandler{DB: db}
 }
 
+type registerRequest struct {
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	Organization string `json:"organization"` // slug, the default organization if empty
+}
+
+var errNotInvited = errors.New("not invited")
+
 func (h *AuthHandler) Register(c *gin.Context) {
-	var user models.User
-	if err := c.ShouldBindJSON(&user); err != nil {
+	var req registerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if req.Organization == "" {
+		req.Organization = models.DefaultOrganization
+	}
+
+	var org models.Organization
+	if err := h.DB.Where("slug = ?", req.Organization).First(&org).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown organization"})
+		return
+	}
+	user := models.User{Email: req.Email, Password: req.Password, OrganizationID: org.ID, Role: models.UserRoleMember}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -34,7 +55,26 @@ func (h *AuthHandler) Register(c *gin.Context) {
 
 	user.Password = string(hashedPassword)
 
-	if err := h.DB.Create(&user).Error; err != nil {
+	// Anyone can join the default organization, others need an invite, which
+	// the registration uses up. Admins are only made with grant-admin.
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if org.Slug != models.DefaultOrganization {
+			result := tx.Where("organization_id = ? AND LOWER(email) = LOWER(?) AND expires_at > ?", org.ID, req.Email, time.Now()).
+				Delete(&models.OrganizationInvite{})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errNotInvited
+			}
+		}
+		return tx.Create(&user).Error
+	})
+	if err != nil {
+		if errors.Is(err, errNotInvited) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "An invite is required to join this organization"})
+			return
+		}
 		// Check if email already exists
 		if strings.EqualFold(err.Error(),"UNIQUE constraint failed: users.email"){
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Email already registered"})
@@ -90,7 +130,31 @@ func (h *AuthHandler) AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// Everything the request does is scoped to the user's organization
+		var user models.User
+		if err := h.DB.Select("id", "organization_id", "role").First(&user, claims.UserID).Error; err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
+		}
+
 		c.Set("userID", claims.UserID)
+		c.Set("orgID", user.OrganizationID)
+		c.Set("userRole", user.Role)
+		c.Request = c.Request.WithContext(tenant.WithOrganization(c.Request.Context(), user.OrganizationID))
+		c.Next()
+	}
+}
+
+// AdminOnly lets only administrators of their organization through. It
+// runs after AuthMiddleware.
+func (h *AuthHandler) AdminOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if role, _ := c.Get("userRole"); role != models.UserRoleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
\ No newline at end of file
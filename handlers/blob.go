@@ -0,0 +1,426 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"file_manage/models"
+	"file_manage/storage"
+	"file_manage/tenant"
+	"file_manage/utils"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Content addressable blob store. Uploads are written to a staging key and
+// then either become a new blob under blobs/<organization>/<hash> or are
+// dropped in favour of an existing blob of the organization with the same
+// checksum.
+
+func blobKey(organizationID uint, checksum string) string {
+	if organizationID == 0 {
+		return fmt.Sprintf("blobs/%s/%s", checksum[:2], checksum)
+	}
+	return fmt.Sprintf("blobs/%d/%s/%s", organizationID, checksum[:2], checksum)
+}
+
+// storeBlob turns the staged upload into a blob, reusing an existing blob
+// with the same checksum when there is one. It reports whether it did.
+// Lookups and the new blob are scoped to the tenant of ctx.
+//
+// A new blob is inserted without references while its content is moved in
+// place, so identical uploads wait for it instead of referencing a blob
+// that has no content yet. It is published with the caller's reference once
+// the content is there.
+func (h *FileHandler) storeBlob(ctx context.Context, stagingKey string, blob models.Blob) (models.Blob, bool, error) {
+	db := h.DB.WithContext(ctx)
+	organizationID, _ := tenant.FromContext(ctx)
+	for attempt := 0; attempt < 5; attempt++ {
+		var existing models.Blob
+		err := db.Where("checksum = ?", blob.Checksum).First(&existing).Error
+		if err == nil {
+			// A blob at zero references is being stored or released, and can't
+			// be referenced until it is either published or gone
+			result := db.Model(&models.Blob{}).Where("id = ? AND ref_count > 0", existing.ID).
+				UpdateColumn("ref_count", gorm.Expr("ref_count + 1"))
+			if result.Error != nil {
+				return blob, false, result.Error
+			}
+			if result.RowsAffected == 1 {
+				h.Storage.Delete(context.Background(), stagingKey)
+				existing.RefCount++
+				return existing, true, nil
+			}
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return blob, false, err
+		}
+
+		blob.ID = 0
+		blob.StorageKey = blobKey(organizationID, blob.Checksum)
+		blob.RefCount = 0
+		if err := db.Create(&blob).Error; err != nil {
+			// Lost a race with an identical upload, reference its blob instead
+			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+				continue
+			}
+			return blob, false, err
+		}
+		if err := h.Storage.Rename(ctx, stagingKey, blob.StorageKey); err != nil {
+			// Nobody else can have referenced the blob yet
+			h.DB.Where("id = ? AND ref_count <= 0", blob.ID).Delete(&models.Blob{})
+			return blob, false, err
+		}
+		if err := db.Model(&models.Blob{}).Where("id = ?", blob.ID).UpdateColumn("ref_count", 1).Error; err != nil {
+			return blob, false, err
+		}
+		blob.RefCount = 1
+		return blob, false, nil
+	}
+	return blob, false, errors.New("too many concurrent changes to the same content")
+}
+
+// CollectUnreferencedBlobs deletes blobs left without references by
+// requests that never finished storing or releasing them
+func (h *FileHandler) CollectUnreferencedBlobs(ctx context.Context) error {
+	var ids []uint
+	if err := h.DB.Model(&models.Blob{}).Where("ref_count <= 0").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := h.collectBlob(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseBlob drops one reference to a blob and deletes it once nothing uses it
+func (h *FileHandler) releaseBlob(ctx context.Context, blobID uint) error {
+	if err := dropBlobRef(h.DB, blobID); err != nil {
+		return err
+	}
+	return h.collectBlob(ctx, blobID)
+}
+
+// dropBlobRef decrements the reference count of a blob within tx
+func dropBlobRef(tx *gorm.DB, blobID uint) error {
+	if blobID == 0 {
+		return nil
+	}
+	return tx.Model(&models.Blob{}).Where("id = ?", blobID).
+		UpdateColumn("ref_count", gorm.Expr("ref_count - 1")).Error
+}
+
+// collectBlob deletes a blob and its derived data once nothing references it
+func (h *FileHandler) collectBlob(ctx context.Context, blobID uint) error {
+	if blobID == 0 {
+		return nil
+	}
+
+	var blob models.Blob
+	if err := h.DB.First(&blob, blobID).Error; err != nil {
+		return err
+	}
+	if blob.RefCount > 0 {
+		return nil
+	}
+
+	if err := h.deleteThumbnails(ctx, blob.ID); err != nil {
+		return err
+	}
+	if err := h.deleteText(blob.ID); err != nil {
+		return err
+	}
+	if err := h.Storage.Delete(ctx, blob.StorageKey); err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return err
+	}
+	return h.DB.Where("id = ? AND ref_count <= 0", blobID).Delete(&models.Blob{}).Error
+}
+
+// openFile returns the plaintext content of a file
+func (h *FileHandler) openFile(ctx context.Context, file models.File) (io.ReadCloser, error) {
+	var blob models.Blob
+	if err := h.DB.First(&blob, file.BlobID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, storage.ErrNotExist
+		}
+		return nil, err
+	}
+	return h.openBlob(ctx, blob)
+}
+
+// openBlob returns the plaintext content of a blob, decrypting it if needed.
+// Content held for a malware scan or in quarantine is refused, see blobHeld.
+func (h *FileHandler) openBlob(ctx context.Context, blob models.Blob) (io.ReadCloser, error) {
+	if err := blobHeld(blob); err != nil {
+		return nil, err
+	}
+	return h.readBlob(ctx, blob)
+}
+
+// readBlob is openBlob for the server's own use of held content, like scanning it
+func (h *FileHandler) readBlob(ctx context.Context, blob models.Blob) (io.ReadCloser, error) {
+	reader, err := h.Storage.Get(ctx, blob.StorageKey)
+	if err != nil {
+		return nil, err
+	}
+	if blob.EncryptionScheme == "" {
+		return reader, nil
+	}
+
+	if blob.EncryptionScheme != utils.StreamScheme {
+		reader.Close()
+		return nil, fmt.Errorf("unsupported encryption scheme %q", blob.EncryptionScheme)
+	}
+	if h.MasterKey == nil {
+		reader.Close()
+		return nil, errors.New("file is encrypted but MASTER_KEY is not set")
+	}
+	dataKey, err := utils.UnwrapKey(blob.WrappedKey, h.MasterKey)
+	if err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	plain, err := utils.NewDecryptReader(reader, dataKey)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return readCloser{Reader: plain, Closer: reader}, nil
+}
+
+// openBlobRange returns length bytes of the plaintext of a blob starting at
+// offset, or the rest of it when length is negative. Encrypted blobs are read
+// from the chunk holding offset on, so seeking never decrypts the whole blob.
+func (h *FileHandler) openBlobRange(ctx context.Context, blob models.Blob, offset, length int64) (io.ReadCloser, error) {
+	if err := blobHeld(blob); err != nil {
+		return nil, err
+	}
+	if blob.EncryptionScheme == "" {
+		return h.Storage.GetRange(ctx, blob.StorageKey, offset, length)
+	}
+	if offset == 0 && length < 0 {
+		return h.openBlob(ctx, blob)
+	}
+
+	if blob.EncryptionScheme != utils.StreamScheme {
+		return nil, fmt.Errorf("unsupported encryption scheme %q", blob.EncryptionScheme)
+	}
+	if h.MasterKey == nil {
+		return nil, errors.New("file is encrypted but MASTER_KEY is not set")
+	}
+	dataKey, err := utils.UnwrapKey(blob.WrappedKey, h.MasterKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	headerReader, err := h.Storage.GetRange(ctx, blob.StorageKey, 0, int64(utils.StreamHeaderSize))
+	if err != nil {
+		return nil, err
+	}
+	header, err := utils.ReadStreamHeader(headerReader)
+	headerReader.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	start, size, first, skip := utils.EncryptedRange(header, offset, length)
+	reader, err := h.Storage.GetRange(ctx, blob.StorageKey, start, size)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := utils.NewChunkDecryptReader(reader, dataKey, header, first)
+	if err == nil {
+		_, err = io.CopyN(io.Discard, plain, skip)
+	}
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	if length >= 0 {
+		plain = io.LimitReader(plain, length)
+	}
+	return readCloser{Reader: plain, Closer: reader}, nil
+}
+
+// blobReader is a seekable view of the plaintext of a blob for
+// http.ServeContent. Seeking is free, the blob is only reopened at the new
+// position once it is read from there.
+type blobReader struct {
+	h    *FileHandler
+	ctx  context.Context
+	blob models.Blob
+	pos  int64
+	r    io.ReadCloser
+	rpos int64 // position of r, which may lag behind pos after a seek
+}
+
+// newBlobReader opens the blob right away so a missing or unreadable blob is
+// reported before any of the response is written
+func (h *FileHandler) newBlobReader(ctx context.Context, blob models.Blob) (*blobReader, error) {
+	r, err := h.openBlobRange(ctx, blob, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	return &blobReader{h: h, ctx: ctx, blob: blob, r: r}, nil
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	if b.pos >= b.blob.Size {
+		return 0, io.EOF
+	}
+	if b.r != nil && b.rpos != b.pos {
+		b.r.Close()
+		b.r = nil
+	}
+	if b.r == nil {
+		r, err := b.h.openBlobRange(b.ctx, b.blob, b.pos, -1)
+		if err != nil {
+			return 0, err
+		}
+		b.r, b.rpos = r, b.pos
+	}
+	n, err := b.r.Read(p)
+	b.pos += int64(n)
+	b.rpos = b.pos
+	return n, err
+}
+
+func (b *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		offset += b.blob.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the blob")
+	}
+	b.pos = offset
+	return offset, nil
+}
+
+func (b *blobReader) Close() error {
+	if b.r == nil {
+		return nil
+	}
+	return b.r.Close()
+}
+
+// readCloser pairs a wrapping reader with the Close of the underlying stream
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// legacyFile is a files row from before blobs, including the encryption
+// columns that have since moved to the blobs table
+type legacyFile struct {
+	ID               uint
+	URL              string
+	Size             int64
+	Checksum         string
+	EncryptionScheme string
+	WrappedKey       string
+	KeyID            string
+}
+
+// MigrateLegacyBlobs attaches files uploaded before deduplication to blobs,
+// merging files that turn out to have identical content
+func (h *FileHandler) MigrateLegacyBlobs() error {
+	var files []legacyFile
+	if err := h.DB.Table("files").Where("(blob_id = 0 OR blob_id IS NULL) AND deleted_at IS NULL").
+		Find(&files).Error; err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	for _, file := range files {
+		if file.Checksum == "" {
+			// Files without a checksum predate encryption, so they are plaintext
+			reader, err := h.Storage.Get(ctx, file.URL)
+			if err != nil {
+				fmt.Printf("Skipping file %d while migrating blobs: %v\n", file.ID, err)
+				continue
+			}
+			hasher := sha256.New()
+			_, err = io.Copy(hasher, reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+			file.Checksum = hex.EncodeToString(hasher.Sum(nil))
+		}
+
+		var blob models.Blob
+		err := h.DB.Where("checksum = ?", file.Checksum).First(&blob).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			blob = models.Blob{
+				Checksum:         file.Checksum,
+				StorageKey:       file.URL,
+				Size:             file.Size,
+				RefCount:         1,
+				EncryptionScheme: file.EncryptionScheme,
+				WrappedKey:       file.WrappedKey,
+				KeyID:            file.KeyID,
+			}
+			err = h.DB.Create(&blob).Error
+		} else if err == nil {
+			err = h.DB.Model(&blob).UpdateColumn("ref_count", gorm.Expr("ref_count + 1")).Error
+			if err == nil && blob.StorageKey != file.URL {
+				h.Storage.Delete(ctx, file.URL)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := h.DB.Table("files").Where("id = ?", file.ID).UpdateColumns(map[string]interface{}{
+			"blob_id":  blob.ID,
+			"url":      blob.StorageKey,
+			"checksum": file.Checksum,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	if len(files) > 0 {
+		fmt.Printf("Migrated %d files to deduplicated blobs\n", len(files))
+	}
+	return nil
+}
+
+// retainBlob adds a reference to a blob that is still in use
+func (h *FileHandler) retainBlob(blobID uint) error {
+	result := h.DB.Model(&models.Blob{}).Where("id = ? AND ref_count > 0", blobID).
+		UpdateColumn("ref_count", gorm.Expr("ref_count + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return storage.ErrNotExist
+	}
+	return nil
+}
+
+// recoverJob is deferred by background workers so a blob that crashes its
+// job doesn't take the worker down with it. onPanic marks the blob so it
+// isn't queued again.
+func recoverJob(job string, blobID uint, onPanic func() error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	fmt.Printf("Panic %s blob %d: %v\n%s", job, blobID, r, debug.Stack())
+	if err := onPanic(); err != nil {
+		fmt.Printf("Error marking blob %d after a panic: %v\n", blobID, err)
+	}
+}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"file_manage/models"
+	"file_manage/utils"
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+// Content search indexes the text of stored content in blob_texts, an FTS5
+// table whose rowid is the blob ID. Like thumbnails the text belongs to the
+// blob, so deduplicated files are indexed once. Text is extracted in the
+// background and only from content that passed its malware scan.
+
+// maxQueryTerms bounds the words and phrases of a content search
+const maxQueryTerms = 32
+
+// createContentIndex creates the FTS5 table, which needs the sqlite driver
+// built with -tags sqlite_fts5. Without it content search is off.
+func createContentIndex(db *gorm.DB) bool {
+	err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS blob_texts USING fts5(content, tokenize = 'unicode61 remove_diacritics 2')").Error
+	if err != nil {
+		fmt.Println("Content search is disabled, build with -tags sqlite_fts5 to enable it:", err)
+		return false
+	}
+	return true
+}
+
+// queueText asks the workers to index a blob's text. Like queueThumbnails
+// it is only a hint, QueueMissingTexts picks up what doesn't fit.
+func (h *FileHandler) queueText(blob models.Blob) {
+	if !h.ContentSearch || blob.TextStatus != "" || blobHeld(blob) != nil || !utils.TextSource(blob.MimeType) {
+		return
+	}
+	select {
+	case h.textJobs <- blob.ID:
+	default:
+	}
+}
+
+// StartTextWorkers starts TEXT_WORKERS goroutines that extract and index the
+// text of uploaded documents
+func (h *FileHandler) StartTextWorkers() {
+	if !h.ContentSearch {
+		return
+	}
+	workers := utils.EnvInt64("TEXT_WORKERS", 1)
+	for i := int64(0); i < workers; i++ {
+		go func() {
+			for blobID := range h.textJobs {
+				if _, busy := h.textBusy.LoadOrStore(blobID, true); busy {
+					continue
+				}
+				h.textJob(blobID)
+			}
+		}()
+	}
+}
+
+// textJob indexes the text of a blob for a worker. Documents that crash
+// their parser are treated as having no text.
+func (h *FileHandler) textJob(blobID uint) {
+	defer h.textBusy.Delete(blobID)
+	defer recoverJob("indexing text of", blobID, func() error {
+		return h.DB.Model(&models.Blob{}).Where("id = ? AND text_status = ''", blobID).UpdateColumn("text_status", "none").Error
+	})
+	if err := h.indexText(context.Background(), blobID); err != nil {
+		fmt.Printf("Error indexing text of blob %d: %v\n", blobID, err)
+	}
+}
+
+// QueueMissingTexts queues documents uploaded while the queue was full or
+// the server was down, including those from before content search existed
+func (h *FileHandler) QueueMissingTexts() {
+	if !h.ContentSearch {
+		return
+	}
+	var blobs []models.Blob
+	err := h.DB.Select("id", "mime_type").
+		Where("text_status = '' AND ref_count > 0 AND scan_status NOT IN ?", []string{scanPending, scanInfected, scanFailed}).
+		Where("(mime_type LIKE 'text/%' OR mime_type IN ?)", utils.TextDocumentTypes).
+		Limit(cap(h.textJobs)).Find(&blobs).Error
+	if err != nil {
+		fmt.Println("Error fetching documents without text:", err)
+		return
+	}
+	for _, blob := range blobs {
+		h.queueText(blob)
+	}
+}
+
+// indexText extracts the text of a blob into blob_texts and marks the blob
+// indexed, or "none" when it has no text. Storage errors leave the blob to
+// be tried again.
+func (h *FileHandler) indexText(ctx context.Context, blobID uint) error {
+	var blob models.Blob
+	if err := h.DB.First(&blob, blobID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if blob.TextStatus != "" || blobHeld(blob) != nil {
+		return nil
+	}
+
+	text, err := h.extractText(ctx, blob)
+	if errors.Is(err, utils.ErrNoText) {
+		return h.DB.Model(&blob).Where("text_status = ''").UpdateColumn("text_status", "none").Error
+	}
+	if err != nil {
+		return err
+	}
+
+	return h.DB.Transaction(func(tx *gorm.DB) error {
+		// The blob may have been released while its text was extracted
+		result := tx.Model(&blob).Where("text_status = ''").UpdateColumn("text_status", "indexed")
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		if err := tx.Exec("DELETE FROM blob_texts WHERE rowid = ?", blob.ID).Error; err != nil {
+			return err
+		}
+		return tx.Exec("INSERT INTO blob_texts (rowid, content) VALUES (?, ?)", blob.ID, text).Error
+	})
+}
+
+func (h *FileHandler) extractText(ctx context.Context, blob models.Blob) (string, error) {
+	if !utils.TextSource(blob.MimeType) {
+		return "", utils.ErrNoText
+	}
+	// PDF and DOCX files are read whole, text files only up to TEXT_MAX_LENGTH
+	if !strings.HasPrefix(blob.MimeType, "text/") && h.MaxTextSize > 0 && blob.Size > h.MaxTextSize {
+		return "", utils.ErrNoText
+	}
+	reader, err := h.openBlob(ctx, blob)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	return utils.ExtractText(blob.MimeType, reader, int(h.MaxTextLength))
+}
+
+// deleteText drops a blob's text from the index
+func (h *FileHandler) deleteText(blobID uint) error {
+	if !h.ContentSearch {
+		return nil
+	}
+	return h.DB.Exec("DELETE FROM blob_texts WHERE rowid = ?", blobID).Error
+}
+
+// contentMatch is a file found by content search
+type contentMatch struct {
+	models.File
+	Snippet string  `json:"snippet"` // HTML escaped, matches are wrapped in <mark>
+	Score   float64 `json:"score"`   // relevance, higher is better
+}
+
+// contentQuery turns what was typed into a search box into an FTS5 query.
+// Every word must appear, "quoted phrases" as written, and a trailing *
+// matches words starting with the rest. FTS5 operators are taken literally.
+func contentQuery(q string) string {
+	var terms []string
+	for len(terms) < maxQueryTerms {
+		q = strings.TrimLeftFunc(q, unicode.IsSpace)
+		if q == "" {
+			break
+		}
+		var term string
+		prefix := false
+		if q[0] == '"' {
+			end := strings.IndexByte(q[1:], '"')
+			if end < 0 {
+				end = len(q) - 1
+			}
+			term, q = q[1:end+1], q[min(end+2, len(q)):]
+		} else {
+			end := strings.IndexFunc(q, unicode.IsSpace)
+			if end < 0 {
+				end = len(q)
+			}
+			term, q = q[:end], q[end:]
+			prefix = strings.HasSuffix(term, "*")
+			term = strings.TrimRight(term, "*")
+		}
+		// Terms without a letter or digit would be empty phrases
+		if strings.IndexFunc(term, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) < 0 {
+			continue
+		}
+		term = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
+
+// snippetStart and snippetEnd mark matches in snippets. Extracted text has no
+// control characters, so they survive escaping and become <mark> tags.
+const (
+	snippetStart = "\x02"
+	snippetEnd   = "\x03"
+)
+
+var snippetMarks = strings.NewReplacer(snippetStart, "<mark>", snippetEnd, "</mark>")
+
+func highlightSnippet(snippet string) string {
+	return snippetMarks.Replace(html.EscapeString(snippet))
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"file_manage/models"
+	"testing"
+)
+
+func TestTextJobSurvivesPanics(t *testing.T) {
+	h := newTestHandler(t)
+	h.ContentSearch = true
+	user := createUser(t, h, "acme", "alice@example.com")
+	file := uploadFile(t, h, user, "notes.txt", "some text to index")
+	h.Storage = panickingStorage{h.Storage}
+
+	h.textBusy.Store(file.BlobID, true)
+	h.textJob(file.BlobID)
+
+	var blob models.Blob
+	h.DB.First(&blob, file.BlobID)
+	if blob.TextStatus != "none" {
+		t.Errorf("text status = %q, want none", blob.TextStatus)
+	}
+	if _, busy := h.textBusy.Load(file.BlobID); busy {
+		t.Error("blob is still marked busy")
+	}
+}
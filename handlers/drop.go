@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"errors"
+	"file_manage/models"
+	"file_manage/tenant"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var errDropLinkFull = errors.New("link accepts no more files")
+
+type dropLinkRequest struct {
+	Name         string   `json:"name"`
+	Expiry       string   `json:"expiry"`        // e.g. "72h", DROP_LINK_EXPIRY by default
+	MaxFileSize  int64    `json:"max_file_size"` // 0 for the instance limit
+	AllowedTypes []string `json:"allowed_types"` // extensions, empty for any
+	MaxFiles     int64    `json:"max_files"`     // 0 for no limit
+}
+
+type dropLinkInfo struct {
+	ID           uint      `json:"id,omitempty"`
+	Token        string    `json:"token,omitempty"`
+	URL          string    `json:"url,omitempty"`
+	Name         string    `json:"name"`
+	FolderID     *uint     `json:"folder_id,omitempty"`
+	GroupID      *uint     `json:"group_id,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Expired      bool      `json:"expired"`
+	MaxFileSize  int64     `json:"max_file_size"`
+	AllowedTypes []string  `json:"allowed_types"`
+	MaxFiles     int64     `json:"max_files"`
+	FileCount    int64     `json:"file_count"`
+}
+
+// publicInfo is what visitors of a drop link get to see
+func (i dropLinkInfo) publicInfo() dropLinkInfo {
+	i.ID, i.Token, i.URL, i.FolderID, i.GroupID = 0, "", "", nil, nil
+	return i
+}
+
+func newDropLinkInfo(c *gin.Context, link models.DropLink) dropLinkInfo {
+	return dropLinkInfo{
+		ID:           link.ID,
+		Token:        link.Token,
+		URL:          fmt.Sprintf("http://%s/drop/%s", c.Request.Host, link.Token),
+		Name:         link.Name,
+		FolderID:     link.FolderID,
+		GroupID:      link.GroupID,
+		ExpiresAt:    link.ExpiresAt,
+		Expired:      time.Now().After(link.ExpiresAt),
+		MaxFileSize:  link.MaxFileSize,
+		AllowedTypes: splitTypes(link.AllowedTypes),
+		MaxFiles:     link.MaxFiles,
+		FileCount:    link.FileCount,
+	}
+}
+
+// CreateDropLink creates a link anyone can upload files through. Files go
+// where an upload with the same group_id and folder_id query parameters would.
+func (h *FileHandler) CreateDropLink(c *gin.Context) {
+	target, ok := h.parseUploadTarget(c)
+	if !ok {
+		return
+	}
+
+	var req dropLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.MaxFileSize < 0 || req.MaxFiles < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Limits must be 0 or more"})
+		return
+	}
+
+	expiry := h.DropLinkExpiry
+	if req.Expiry != "" {
+		var err error
+		if expiry, err = time.ParseDuration(req.Expiry); err != nil || expiry <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expiry format"})
+			return
+		}
+	}
+	// Drop links are capped like share links
+	org, err := h.organization(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load organization settings"})
+		return
+	}
+	if org.MaxShareExpiry > 0 && expiry > org.MaxShareExpiry {
+		if req.Expiry != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Expiry exceeds the maximum of %s", org.MaxShareExpiry)})
+			return
+		}
+		expiry = org.MaxShareExpiry
+	}
+
+	link := models.DropLink{
+		Token:        uuid.New().String(),
+		UserID:       target.UserID,
+		Name:         req.Name,
+		GroupID:      target.GroupID,
+		FolderID:     target.FolderID,
+		ExpiresAt:    time.Now().Add(expiry),
+		MaxFileSize:  req.MaxFileSize,
+		AllowedTypes: strings.Join(req.AllowedTypes, ","),
+		MaxFiles:     req.MaxFiles,
+	}
+	if err := h.db(c).Create(&link).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create drop link"})
+		return
+	}
+	c.JSON(http.StatusCreated, newDropLinkInfo(c, link))
+}
+
+// ListDropLinks lists the drop links the caller created
+func (h *FileHandler) ListDropLinks(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var links []models.DropLink
+	if err := h.db(c).Where("user_id = ?", userID).Order("created_at DESC").Find(&links).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve drop links"})
+		return
+	}
+	infos := make([]dropLinkInfo, 0, len(links))
+	for _, link := range links {
+		infos = append(infos, newDropLinkInfo(c, link))
+	}
+	c.JSON(http.StatusOK, infos)
+}
+
+// DeleteDropLink revokes a drop link, files already dropped stay
+func (h *FileHandler) DeleteDropLink(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	result := h.db(c).Where("id = ? AND user_id = ?", c.Param("dropID"), userID).Delete(&models.DropLink{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke drop link"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Drop link not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Drop link revoked"})
+}
+
+// findDropLink loads the live drop link named by the token route parameter
+// and scopes the request to its organization
+func (h *FileHandler) findDropLink(c *gin.Context) (models.DropLink, bool) {
+	var link models.DropLink
+	if err := h.DB.Where("token = ?", c.Param("token")).First(&link).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Link not found"})
+		return link, false
+	}
+	if time.Now().After(link.ExpiresAt) {
+		c.JSON(http.StatusGone, gin.H{"error": "Link has expired"})
+		return link, false
+	}
+	c.Request = c.Request.WithContext(tenant.WithOrganization(c.Request.Context(), link.OrganizationID))
+	return link, true
+}
+
+// GetDropLink tells visitors of a drop link what they may upload
+func (h *FileHandler) GetDropLink(c *gin.Context) {
+	link, ok := h.findDropLink(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, newDropLinkInfo(c, link).publicInfo())
+}
+
+// DropFiles takes files from anyone with a drop link and stores them like
+// an upload by the link's creator, who is notified
+func (h *FileHandler) DropFiles(c *gin.Context) {
+	link, ok := h.findDropLink(c)
+	if !ok {
+		return
+	}
+
+	// The creator may have lost access to the destination since
+	if link.FolderID != nil {
+		if _, err := h.findFolder(link.UserID, *link.FolderID, accessOwner); err != nil {
+			c.JSON(http.StatusGone, gin.H{"error": "Link is no longer valid"})
+			return
+		}
+	} else if link.GroupID != nil && h.groupAccess(link.UserID, *link.GroupID) < accessOwner {
+		c.JSON(http.StatusGone, gin.H{"error": "Link is no longer valid"})
+		return
+	}
+
+	types := splitTypes(link.AllowedTypes)
+	gate := uploadGate{
+		MaxFileSize: link.MaxFileSize,
+		Admit: func(name string) error {
+			if !hasType(types, name) {
+				return fmt.Errorf("%w: %s", errTypeNotAllowed, name)
+			}
+			// Count the file up front so concurrent drops can't exceed max_files
+			result := h.DB.Model(&models.DropLink{}).
+				Where("id = ? AND (max_files = 0 OR file_count < max_files)", link.ID).
+				UpdateColumn("file_count", gorm.Expr("file_count + 1"))
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errDropLinkFull
+			}
+			return nil
+		},
+		Failed: func() {
+			h.DB.Model(&models.DropLink{}).Where("id = ?", link.ID).
+				UpdateColumn("file_count", gorm.Expr("file_count - 1"))
+		},
+	}
+
+	target := uploadTarget{
+		OrganizationID: link.OrganizationID,
+		UserID:         link.UserID,
+		GroupID:        link.GroupID,
+		FolderID:       link.FolderID,
+	}
+	files := h.receiveFiles(c, target, gate)
+	if len(files) == 0 {
+		return
+	}
+
+	name := link.Name
+	if name == "" {
+		name = link.Token
+	}
+	message := fmt.Sprintf("%d file(s) were uploaded through drop link %q", len(files), name)
+	h.notify(c.Request.Context(), link.UserID, models.NotificationFilesDropped, message, files)
+}
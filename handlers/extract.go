@@ -0,0 +1,445 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"file_manage/models"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Uploaded zip and tar archives can be browsed and unpacked on the server.
+// Archives come from users, so entry paths are never trusted (zip-slip) and
+// decompression is bounded by a ratio and a total size (zip bombs).
+
+var (
+	errNotArchive      = errors.New("file is not a supported archive")
+	errArchiveTooLarge = errors.New("archive is too large to inspect")
+	errArchiveBomb     = errors.New("archive expands beyond the allowed limits")
+	errUnsafeEntry     = errors.New("archive entry has an unsafe path")
+	errEntryNotFound   = errors.New("archive entry not found")
+	errStopWalk        = errors.New("stop")
+)
+
+// archiveKind tells the supported archive formats apart by name
+func archiveKind(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tgz"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	}
+	return ""
+}
+
+// entryPath cleans the path of an archive entry, rejecting absolute paths
+// and anything that could climb out of the extraction folder
+func entryPath(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", false
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", false
+		}
+	}
+	cleaned := path.Clean(name)
+	if cleaned == "." {
+		return "", false
+	}
+	return cleaned, true
+}
+
+// limitedReader fails with err once more than limit bytes were read
+type limitedReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+	err   error
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		return n, l.err
+	}
+	return n, err
+}
+
+// archiveItem is an entry of an archive. Its content can only be read with
+// open while the walk is at the entry.
+type archiveItem struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	Compressed int64     `json:"compressed_size,omitempty"`
+	Modified   time.Time `json:"modified"`
+	Dir        bool      `json:"dir"`
+	Unsafe     bool      `json:"unsafe,omitempty"` // refused for download and extraction
+	open       func() (io.Reader, error)
+}
+
+// walkArchive calls fn for every entry of an archive file. Content read
+// through the items counts towards ARCHIVE_MAX_EXTRACT_SIZE, and no entry
+// may expand more than ARCHIVE_MAX_RATIO times.
+func (h *FileHandler) walkArchive(ctx context.Context, file models.File, fn func(item archiveItem) error) error {
+	kind := archiveKind(file.Name)
+	if kind == "" {
+		return errNotArchive
+	}
+	if h.MaxInspectSize > 0 && file.Size > h.MaxInspectSize {
+		return errArchiveTooLarge
+	}
+
+	var blob models.Blob
+	if err := h.DB.First(&blob, file.BlobID).Error; err != nil {
+		return err
+	}
+	reader, err := h.openBlob(ctx, blob)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// Every entry opened takes its size out of the extraction budget, and
+	// reading more than an entry declared fails
+	remaining := h.MaxExtractSize
+	bound := func(r io.Reader, size int64) (io.Reader, error) {
+		if h.MaxExtractSize > 0 {
+			if size > remaining {
+				return nil, fmt.Errorf("%w: more than %d bytes", errArchiveBomb, h.MaxExtractSize)
+			}
+			remaining -= size
+		}
+		return &limitedReader{r: r, limit: size, err: errArchiveBomb}, nil
+	}
+	entries := int64(0)
+	count := func() error {
+		if entries++; h.MaxArchiveEntries > 0 && entries > h.MaxArchiveEntries {
+			return fmt.Errorf("%w: more than %d entries", errArchiveBomb, h.MaxArchiveEntries)
+		}
+		return nil
+	}
+
+	if kind == "zip" {
+		// Zip needs random access, spool the plaintext to a temporary file
+		tmp, err := os.CreateTemp("", "archive-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		size, err := io.Copy(tmp, reader)
+		if err != nil {
+			return err
+		}
+		zr, err := zip.NewReader(tmp, size)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errNotArchive, err)
+		}
+
+		for _, f := range zr.File {
+			if err := count(); err != nil {
+				return err
+			}
+			f := f
+			item := archiveItem{
+				Size:       int64(f.UncompressedSize64),
+				Compressed: int64(f.CompressedSize64),
+				Modified:   f.Modified,
+				Dir:        f.FileInfo().IsDir(),
+			}
+			var ok bool
+			if item.Path, ok = entryPath(f.Name); !ok {
+				item.Path, item.Unsafe = f.Name, true
+			}
+			item.open = func() (io.Reader, error) {
+				if h.MaxArchiveRatio > 0 && item.Size > h.MaxArchiveRatio*(item.Compressed+1) {
+					return nil, fmt.Errorf("%w: %s", errArchiveBomb, item.Path)
+				}
+				rc, err := f.Open()
+				if err != nil {
+					return nil, err
+				}
+				// Declared sizes can lie, never read more than they claim
+				return bound(rc, item.Size)
+			}
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var src io.Reader = reader
+	if kind == "tgz" {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errNotArchive, err)
+		}
+		defer gz.Close()
+		src = gz
+		if h.MaxArchiveRatio > 0 {
+			// The whole stream, headers and skipped entries included
+			src = &limitedReader{r: gz, limit: h.MaxArchiveRatio * (file.Size + 1), err: errArchiveBomb}
+		}
+	}
+	tr := tar.NewReader(src)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if errors.Is(err, errArchiveBomb) {
+				return err
+			}
+			return fmt.Errorf("%w: %v", errNotArchive, err)
+		}
+		if err := count(); err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeDir {
+			continue // links and devices are never extracted
+		}
+
+		item := archiveItem{Size: header.Size, Modified: header.ModTime, Dir: header.Typeflag == tar.TypeDir}
+		var ok bool
+		if item.Path, ok = entryPath(header.Name); !ok {
+			item.Path, item.Unsafe = header.Name, true
+		}
+		item.open = func() (io.Reader, error) {
+			return bound(tr, item.Size)
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveError writes the response for errors from walkArchive
+func archiveError(c *gin.Context, err error) {
+	if respondHeld(c, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, errNotArchive):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case errors.Is(err, errArchiveTooLarge), errors.Is(err, errArchiveBomb):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, errUnsafeEntry):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errEntryNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read archive"})
+	}
+}
+
+// ListArchiveEntries lists the entries of a zip or tar archive file
+func (h *FileHandler) ListArchiveEntries(c *gin.Context) {
+	file, ok := h.findFile(c, accessRead)
+	if !ok {
+		return
+	}
+
+	items := []archiveItem{}
+	err := h.walkArchive(c.Request.Context(), file, func(item archiveItem) error {
+		items = append(items, item)
+		return nil
+	})
+	if err != nil {
+		archiveError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, items)
+}
+
+// DownloadArchiveEntry streams a single file out of an archive
+func (h *FileHandler) DownloadArchiveEntry(c *gin.Context) {
+	file, ok := h.findFile(c, accessRead)
+	if !ok {
+		return
+	}
+	want, ok := entryPath(strings.TrimPrefix(c.Param("path"), "/"))
+	if !ok {
+		archiveError(c, errUnsafeEntry)
+		return
+	}
+
+	err := h.walkArchive(c.Request.Context(), file, func(item archiveItem) error {
+		if item.Unsafe || item.Dir || item.Path != want {
+			return nil
+		}
+		content, err := item.open()
+		if err != nil {
+			return err
+		}
+		c.DataFromReader(http.StatusOK, item.Size, "application/octet-stream", content, map[string]string{
+			"Content-Disposition": attachmentDisposition(path.Base(item.Path)),
+		})
+		return errStopWalk
+	})
+	if errors.Is(err, errStopWalk) {
+		return
+	}
+	if err == nil {
+		err = errEntryNotFound
+	}
+	archiveError(c, err)
+}
+
+type extractResult struct {
+	FolderID uint                `json:"folder_id"`
+	Files    int                 `json:"files"`
+	Skipped  []map[string]string `json:"skipped"`
+}
+
+// ExtractArchive unpacks an archive file into a new folder named after it,
+// created where an upload with the same group_id and folder_id would go.
+// Every entry becomes a regular file through the upload path, so quotas
+// and the organization's allowed types apply.
+func (h *FileHandler) ExtractArchive(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	file, ok := h.findFile(c, accessRead)
+	if !ok {
+		return
+	}
+	if archiveKind(file.Name) == "" {
+		archiveError(c, errNotArchive)
+		return
+	}
+	var blob models.Blob
+	if err := h.DB.First(&blob, file.BlobID).Error; err == nil && respondHeld(c, blobHeld(blob)) {
+		return
+	}
+	target, ok := h.parseUploadTarget(c)
+	if !ok {
+		return
+	}
+	ws := target.workspace()
+	ctx := c.Request.Context()
+
+	// mkdir creates a folder, suffixing its name if it is taken
+	mkdir := func(parentID *uint, name string) (models.Folder, error) {
+		candidate := name
+		for n := 1; h.folderNameTaken(ws, parentID, candidate, 0); n++ {
+			candidate = fmt.Sprintf("%s (%d)", name, n)
+		}
+		folder := models.Folder{Name: candidate, ParentID: parentID, UserID: userID.(uint), GroupID: ws.GroupID}
+		return folder, h.DB.WithContext(ctx).Create(&folder).Error
+	}
+
+	rootName := file.Name
+	for _, ext := range []string{".tar.gz", ".tgz", ".zip", ".tar"} {
+		if strings.HasSuffix(strings.ToLower(rootName), ext) {
+			rootName = rootName[:len(rootName)-len(ext)]
+			break
+		}
+	}
+	if !validName(rootName) {
+		rootName = "archive"
+	}
+	root, err := mkdir(target.FolderID, rootName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create folder"})
+		return
+	}
+
+	folders := map[string]uint{"": root.ID}
+	// folderFor returns the folder an entry directory maps to, creating it
+	var folderFor func(dir string) (uint, error)
+	folderFor = func(dir string) (uint, error) {
+		if dir == "." {
+			dir = ""
+		}
+		if id, ok := folders[dir]; ok {
+			return id, nil
+		}
+		parentID, err := folderFor(path.Dir(dir))
+		if err != nil {
+			return 0, err
+		}
+		folder, err := mkdir(&parentID, path.Base(dir))
+		if err != nil {
+			return 0, err
+		}
+		folders[dir] = folder.ID
+		return folder.ID, nil
+	}
+
+	result := extractResult{FolderID: root.ID, Skipped: []map[string]string{}}
+	skip := func(item archiveItem, reason string) {
+		result.Skipped = append(result.Skipped, map[string]string{"path": item.Path, "error": reason})
+	}
+	err = h.walkArchive(ctx, file, func(item archiveItem) error {
+		if item.Unsafe {
+			skip(item, errUnsafeEntry.Error())
+			return nil
+		}
+		if item.Dir {
+			_, err := folderFor(item.Path)
+			return err
+		}
+		folderID, err := folderFor(path.Dir(item.Path))
+		if err != nil {
+			return err
+		}
+		content, err := item.open()
+		if err != nil {
+			if errors.Is(err, errArchiveBomb) {
+				return err
+			}
+			skip(item, err.Error())
+			return nil
+		}
+
+		// Reserved like an upload, so concurrent uploads can't take the space meanwhile
+		res, err := h.reserve(target.UserID, target.OrganizationID, item.Size)
+		if err != nil {
+			return err
+		}
+		defer h.release(res)
+
+		entryTarget := target
+		entryTarget.FolderID = &folderID
+		if _, _, err := h.saveUpload(ctx, entryTarget, path.Base(item.Path), content, res); err != nil {
+			// Limits stop the whole extraction, a file the organization doesn't take is only skipped
+			if errors.Is(err, errArchiveBomb) || errors.Is(err, errQuotaExceeded) {
+				return err
+			}
+			skip(item, err.Error())
+			return nil
+		}
+		result.Files++
+		return nil
+	})
+	h.Redis.Del(context.Background(), ws.cacheKey())
+	if err != nil {
+		// Whatever was extracted before stays, the result says what that is
+		status := uploadErrorStatus(err)
+		switch {
+		case errors.Is(err, errArchiveBomb), errors.Is(err, errArchiveTooLarge):
+			status = http.StatusRequestEntityTooLarge
+		case errors.Is(err, errNotArchive):
+			status = http.StatusUnsupportedMediaType
+		}
+		c.JSON(status, gin.H{"error": err.Error(), "result": result})
+		return
+	}
+	c.JSON(http.StatusCreated, result)
+}
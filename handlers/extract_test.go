@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"file_manage/models"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// zipEntry is a file to put into a test archive
+type zipEntry struct {
+	name    string
+	content string
+	method  uint16
+}
+
+func makeZip(t *testing.T, entries ...zipEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Method: e.method})
+		if err != nil {
+			t.Fatalf("zip %s: %v", e.name, err)
+		}
+		w.Write([]byte(e.content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("close zip: %v", err)
+	}
+	return buf.String()
+}
+
+func makeTarGz(t *testing.T, entries ...zipEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("tar %s: %v", e.name, err)
+		}
+		tw.Write([]byte(e.content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.String()
+}
+
+// extract unpacks an archive file and decodes the result
+func extract(t *testing.T, h *FileHandler, user models.User, file models.File) (int, extractResult) {
+	t.Helper()
+	w := do(testRouter(h), user, http.MethodPost, fmt.Sprintf("/files/%d/extract", file.ID), nil, nil)
+	var body struct {
+		extractResult
+		Result *extractResult `json:"result"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode %s: %v", w.Body, err)
+	}
+	if body.Result != nil {
+		return w.Code, *body.Result
+	}
+	return w.Code, body.extractResult
+}
+
+// extractedFiles returns the names of the files of user, other than the archive
+func extractedFiles(h *FileHandler, user models.User, archive models.File) []string {
+	var names []string
+	h.DB.Model(&models.File{}).Where("user_id = ? AND id <> ?", user.ID, archive.ID).Order("name").Pluck("name", &names)
+	return names
+}
+
+func TestExtractSkipsUnsafePaths(t *testing.T) {
+	h := newTestHandler(t)
+	user := createUser(t, h, "acme", "alice@example.com")
+
+	for _, tc := range []struct {
+		archive models.File
+		skipped int
+	}{
+		{uploadFile(t, h, user, "slip.zip", makeZip(t,
+			zipEntry{name: "docs/readme.txt", content: "hello"},
+			zipEntry{name: "../evil.txt", content: "evil"},
+			zipEntry{name: "docs/../../evil.txt", content: "evil"},
+			zipEntry{name: "/etc/evil.txt", content: "evil"},
+			zipEntry{name: `C:\evil.txt`, content: "evil"},
+		)), 4},
+		{uploadFile(t, h, user, "slip.tar.gz", makeTarGz(t,
+			zipEntry{name: "docs/readme.txt", content: "hello"},
+			zipEntry{name: "../evil.txt", content: "evil"},
+			zipEntry{name: "/etc/evil.txt", content: "evil"},
+		)), 2},
+	} {
+		status, result := extract(t, h, user, tc.archive)
+		if status != http.StatusCreated {
+			t.Fatalf("extract %s: status %d", tc.archive.Name, status)
+		}
+		if result.Files != 1 {
+			t.Errorf("extract %s: %d files extracted, want 1", tc.archive.Name, result.Files)
+		}
+		if len(result.Skipped) != tc.skipped {
+			t.Errorf("extract %s: skipped %v, want %d entries", tc.archive.Name, result.Skipped, tc.skipped)
+		}
+		for _, skipped := range result.Skipped {
+			if skipped["error"] != errUnsafeEntry.Error() {
+				t.Errorf("extract %s: %s skipped with %q", tc.archive.Name, skipped["path"], skipped["error"])
+			}
+		}
+	}
+
+	var names []string
+	h.DB.Model(&models.File{}).Where("name = ?", "evil.txt").Pluck("name", &names)
+	if len(names) != 0 {
+		t.Errorf("%d unsafe entries were extracted", len(names))
+	}
+}
+
+func TestExtractRefusesHighRatio(t *testing.T) {
+	h := newTestHandler(t)
+	user := createUser(t, h, "acme", "alice@example.com")
+	archive := uploadFile(t, h, user, "bomb.zip", makeZip(t,
+		zipEntry{name: "small.txt", content: "fine", method: zip.Store},
+		zipEntry{name: "zeros.bin", content: strings.Repeat("\x00", 1<<20), method: zip.Deflate},
+	))
+
+	status, result := extract(t, h, user, archive)
+	if status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("extract: status %d, want 413", status)
+	}
+	// Entries before the bomb stay extracted
+	if result.Files != 1 {
+		t.Errorf("%d files extracted, want 1", result.Files)
+	}
+	if names := extractedFiles(h, user, archive); len(names) != 1 || names[0] != "small.txt" {
+		t.Errorf("extracted %v, want only small.txt", names)
+	}
+}
+
+func TestExtractRefusesMoreThanMaxExtractSize(t *testing.T) {
+	h := newTestHandler(t)
+	h.MaxExtractSize = 100
+	user := createUser(t, h, "acme", "alice@example.com")
+	archive := uploadFile(t, h, user, "big.zip", makeZip(t,
+		zipEntry{name: "a.txt", content: strings.Repeat("a", 60), method: zip.Store},
+		zipEntry{name: "b.txt", content: strings.Repeat("b", 60), method: zip.Store},
+	))
+
+	status, result := extract(t, h, user, archive)
+	if status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("extract: status %d, want 413", status)
+	}
+	if result.Files != 1 {
+		t.Errorf("%d files extracted, want 1", result.Files)
+	}
+}
+
+func TestExtractRefusesEntriesOverQuota(t *testing.T) {
+	h := newTestHandler(t)
+	user := createUser(t, h, "acme", "alice@example.com")
+	archive := uploadFile(t, h, user, "quota.zip", makeZip(t,
+		zipEntry{name: "big.txt", content: strings.Repeat("a", 500), method: zip.Store},
+	))
+	h.DB.Model(&user).Update("quota_bytes", archive.Size+100)
+
+	status, result := extract(t, h, user, archive)
+	if status != http.StatusInsufficientStorage {
+		t.Fatalf("extract: status %d, want 507", status)
+	}
+	if result.Files != 0 {
+		t.Errorf("%d files extracted, want 0", result.Files)
+	}
+	checkUsage(t, h, user, archive.Size)
+}
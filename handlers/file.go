@@ -3,23 +3,27 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"file_manage/models"
+	"file_manage/scanner"
+	"file_manage/storage"
+	"file_manage/tenant"
 	"file_manage/utils"
 	"fmt"
-	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -28,9 +32,58 @@ type FileHandler struct {
 	DB *gorm.DB
 	SDB *gorm.DB
 	Redis *redis.Client
+	Storage storage.Storage
+	MasterKey []byte // enables encryption at rest when set
+	Scanner scanner.Scanner // scans uploads for malware when set
+
+	// Limits for POST /upload, configured through the environment
+	MaxRequestSize int64
+	MaxFileSize int64
+	uploadSlots chan struct{}
+
+	// Version history settings
+	VersionRetentionCount int64
+	VersionRetentionAge time.Duration
+	DiffMaxSize int64
+
+	// How long deleted files stay in the trash before they are purged
+	TrashRetention time.Duration
+
+	// How long a share link stays unlocked after its password was entered
+	ShareUnlockTTL time.Duration
+
+	// How long group invites stay valid
+	GroupInviteExpiry time.Duration
+	// How long invites into an organization stay valid
+	OrganizationInviteExpiry time.Duration
+	// Default lifetime of file drop links
+	DropLinkExpiry time.Duration
+	// Most files a zip download may hold, 0 for no limit
+	MaxArchiveFiles int64
+	// Limits for looking into uploaded archives, 0 for no limit
+	MaxInspectSize int64
+	MaxExtractSize int64
+	MaxArchiveEntries int64
+	MaxArchiveRatio int64
+
+	// Thumbnails
+	MaxThumbnailPixels int64
+	thumbnailJobs chan uint
+	thumbnailBusy sync.Map // blobs being worked on
+
+	// Malware scanning
+	scanJobs chan uint
+	scanBusy sync.Map // blobs being scanned
+
+	// Content search, off when sqlite was built without FTS5
+	ContentSearch bool
+	MaxTextSize int64 // largest PDF or DOCX to extract text from
+	MaxTextLength int64 // most bytes of text indexed per file
+	textJobs chan uint
+	textBusy sync.Map // blobs being indexed
 }
 
-func NewFileHandler(db *gorm.DB) *FileHandler {
+func NewFileHandler(db *gorm.DB, store storage.Storage) *FileHandler {
 	sdb, err := gorm.Open(sqlite.Open("shared_files.db"), &gorm.Config{})
 	if err != nil {
 		fmt.Printf("failed to connect to database: %s", err)
@@ -40,6 +93,9 @@ func NewFileHandler(db *gorm.DB) *FileHandler {
 	if err := sdb.AutoMigrate(&SharedFile{}); err != nil {
 		fmt.Printf("failed to auto migrate: %s", err)
 	}
+	if err := tenant.Register(sdb); err != nil {
+		log.Fatal("Failed to register tenant scoping: ", err)
+	}
 
 	redisURL := os.Getenv("REDIS_URL")
 	// redisURL = "localhost:6379"
@@ -52,168 +108,69 @@ func NewFileHandler(db *gorm.DB) *FileHandler {
         DB:       0,                
     })
 	db.AutoMigrate(&SharedFile{})
-	return &FileHandler{
-		DB: db,
-		SDB: sdb,
-		Redis : rdb,
-	}
-}
-
-func (h *FileHandler) Upload(c *gin.Context) {
-	userID, _ := c.Get("userID")
 
-	// Extract all files from the request
-	form, err := c.MultipartForm()
+	masterKey, err := utils.LoadMasterKey("MASTER_KEY")
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse multipart form"})
-		return
+		log.Fatal("Invalid master key: ", err)
 	}
-
-	files := form.File["file"]
-
-	uploadDir := "uploads"
-	if _, err := os.Stat(uploadDir); os.IsNotExist(err) {
-		err = os.MkdirAll(uploadDir, 0755)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create uploads directory"})
-			return
-		}
+	malwareScanner, err := scanner.NewFromEnv()
+	if err != nil {
+		log.Fatal("Invalid malware scanner settings: ", err)
 	}
 
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	var uploadErrors []string 
-
-	for _, file := range files {
-		wg.Add(1)
-		go func(file *multipart.FileHeader) {
-			defer wg.Done()
-
-			src, err := file.Open()
-			if err != nil {
-				mu.Lock()
-				uploadErrors = append(uploadErrors, fmt.Sprintf("Failed to open file %s: %v", file.Filename, err))
-				mu.Unlock()
-				return
-			}
-			defer src.Close()
-
-			fileData, err := io.ReadAll(src)
-			if err != nil {
-				mu.Lock()
-				uploadErrors = append(uploadErrors, fmt.Sprintf("Failed to read file %s: %v", file.Filename, err))
-				mu.Unlock()
-				return
-			}
-
-			// Generate unique filename
-			filename := uuid.New().String() + filepath.Ext(file.Filename)
-			uploadPath := filepath.Join("uploads", filename)
-
-			// Save the file to the uploads folder
-			if err := os.WriteFile(uploadPath, fileData, 0644); err != nil {
-				mu.Lock()
-				uploadErrors = append(uploadErrors, fmt.Sprintf("Failed to save file %s: %v", file.Filename, err))
-				mu.Unlock()
-				return
-			}
-
-			// Save metadata in the database
-			fileRecord := models.File{
-				Name:   file.Filename,
-				Size:   file.Size,
-				URL:    uploadPath,
-				UserID: userID.(uint),
-				Type: utils.ExtractType(file.Filename),
-			}
-			if err := h.DB.Create(&fileRecord).Error; err != nil {
-				mu.Lock()
-				uploadErrors = append(uploadErrors, fmt.Sprintf("Failed to save metadata for file %s: %v", file.Filename, err))
-				mu.Unlock()
-				return
-			}
-		}(file)
+	concurrency := utils.EnvInt64("UPLOAD_CONCURRENCY", 4)
+	if concurrency < 1 {
+		concurrency = 1
 	}
-
-	wg.Wait()
-
-	// Check if there were any errors and return them
-	if len(uploadErrors) > 0 {
-		c.JSON(http.StatusInternalServerError, gin.H{"errors": uploadErrors})
-		return
+	return &FileHandler{
+		DB: db,
+		SDB: sdb,
+		Redis : rdb,
+		Storage: store,
+		MasterKey: masterKey,
+		Scanner: malwareScanner,
+		MaxRequestSize: utils.EnvInt64("MAX_UPLOAD_REQUEST_SIZE", 10<<30),
+		MaxFileSize: utils.EnvInt64("MAX_UPLOAD_FILE_SIZE", 5<<30),
+		uploadSlots: make(chan struct{}, concurrency),
+		VersionRetentionCount: utils.EnvInt64("VERSION_RETENTION_COUNT", 0),
+		VersionRetentionAge: utils.EnvDuration("VERSION_RETENTION_AGE", 0),
+		DiffMaxSize: utils.EnvInt64("DIFF_MAX_SIZE", 1<<20),
+		TrashRetention: utils.EnvDuration("TRASH_RETENTION", 30*24*time.Hour),
+		ShareUnlockTTL: utils.EnvDuration("SHARE_UNLOCK_TTL", 15*time.Minute),
+		GroupInviteExpiry: utils.EnvDuration("GROUP_INVITE_EXPIRY", 7*24*time.Hour),
+		OrganizationInviteExpiry: utils.EnvDuration("ORGANIZATION_INVITE_EXPIRY", 7*24*time.Hour),
+		DropLinkExpiry: utils.EnvDuration("DROP_LINK_EXPIRY", 7*24*time.Hour),
+		MaxArchiveFiles: utils.EnvInt64("ARCHIVE_MAX_FILES", 10000),
+		MaxInspectSize: utils.EnvInt64("ARCHIVE_INSPECT_MAX_SIZE", 2<<30),
+		MaxExtractSize: utils.EnvInt64("ARCHIVE_MAX_EXTRACT_SIZE", 1<<30),
+		MaxArchiveEntries: utils.EnvInt64("ARCHIVE_MAX_ENTRIES", 10000),
+		MaxArchiveRatio: utils.EnvInt64("ARCHIVE_MAX_RATIO", 100),
+		MaxThumbnailPixels: utils.EnvInt64("THUMBNAIL_MAX_PIXELS", 50_000_000),
+		thumbnailJobs: make(chan uint, 1000),
+		scanJobs: make(chan uint, 1000),
+		ContentSearch: createContentIndex(db),
+		MaxTextSize: utils.EnvInt64("TEXT_MAX_SIZE", 64<<20),
+		MaxTextLength: utils.EnvInt64("TEXT_MAX_LENGTH", 1<<20),
+		textJobs: make(chan uint, 1000),
 	}
-
-	cacheKey := fmt.Sprintf("files_user_%v", userID)
-    h.Redis.Del(context.Background(), cacheKey)
-
-	c.JSON(http.StatusOK, gin.H{"message": "Files uploaded successfully"})
 }
 
-
-func (h *FileHandler) Upload2(c *gin.Context) {
-	userID, _ := c.Get("userID")
-
-	file, err := c.FormFile("file")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to get file from request"})
-		return
-	}
-
-	filename := uuid.New().String() + filepath.Ext(file.Filename)
-	uploadPath := filepath.Join("uploads", filename)
-
-	fileSaveCh := make(chan error)
-	dbSaveCh := make(chan error)
-
-	go func() {
-		if err := c.SaveUploadedFile(file, uploadPath); err != nil {
-			fileSaveCh <- err
-		} else {
-			fileSaveCh <- nil
-		}
-	}()
-
-	// Goroutine to handle database record creation
-	go func() {
-		fileRecord := models.File{
-			Name:   file.Filename,
-			Size:   file.Size,
-			URL:    uploadPath,
-			UserID: userID.(uint),
-			Type: utils.ExtractType(file.Filename),
-		}
-		if err := h.DB.Create(&fileRecord).Error; err != nil {
-			dbSaveCh <- err
-		} else {
-			dbSaveCh <- nil
-		}
-	}()
-
-	
-	fileSaveErr := <-fileSaveCh
-	dbSaveErr := <-dbSaveCh
-
-	
-	if fileSaveErr != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
-		return
-	}
-	if dbSaveErr != nil {
-		os.Remove(uploadPath)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+func (h *FileHandler) Upload(c *gin.Context) {
+	target, ok := h.parseUploadTarget(c)
+	if !ok {
 		return
 	}
 
-	cacheKey := fmt.Sprintf("files_user_%v", userID)
-    h.Redis.Del(context.Background(), cacheKey)
-
-	c.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully"})
+	h.receiveFiles(c, target, uploadGate{})
 }
 
 
 func (h *FileHandler) GetFiles(c *gin.Context) {
-    userID, _ := c.Get("userID")
-    cacheKey := fmt.Sprintf("files_user_%v", userID)
+    ws, ok := h.parseWorkspace(c, accessRead)
+    if !ok {
+        return
+    }
+    cacheKey := ws.cacheKey()
     ctx := context.Background()
 
     var wg sync.WaitGroup
@@ -233,7 +190,7 @@ func (h *FileHandler) GetFiles(c *gin.Context) {
     // Fetch from DB concurrently
     go func() {
         defer wg.Done()
-        dbErr = h.DB.Where("user_id = ?", userID).Find(&dbFiles).Error
+        dbErr = h.db(c).Scopes(ws.scope).Find(&dbFiles).Error
     }()
 
     wg.Wait()
@@ -261,75 +218,89 @@ func (h *FileHandler) GetFiles(c *gin.Context) {
     }
 }
 
+type SharedFile struct{
+	Token string `gorm:"uniqueIndex"`
+	FilePath string // storage key of the shared blob
+	FileID uint `gorm:"index"`
+	FolderID uint `gorm:"index"` // set instead of FileID for links to a whole folder
+	FileName string
+	Expires time.Time
+	OrganizationID uint `gorm:"index"`
+
+	// Optional label so owners can tell a file's links apart
+	Name string
+	OwnerID uint `gorm:"index"`
+	PasswordHash string // bcrypt, empty for links without a password
+
+	// Downloads allowed through the link, 0 for unlimited
+	MaxDownloads int64
+	RemainingDownloads int64
+	DownloadCount int64
+	LastAccessedAt *time.Time
+	CreatedAt time.Time
+}
 
-func (h *FileHandler) GetFiles2(c *gin.Context) {
-    userID, _ := c.Get("userID")
-
-    // Check cache first
-    cacheKey := fmt.Sprintf("files_user_%v", userID)
-    ctx := context.Background()
-    cachedData, err := h.Redis.Get(ctx, cacheKey).Result()
-
-    if err == redis.Nil {
-        fmt.Println("Cache miss, fetch from database")
-        var files []models.File
-        if err := h.DB.Where("user_id = ?", userID).Find(&files).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve files"})
-            return
-        }
+func (h *FileHandler) ShareFile(c *gin.Context) {
+	link, ok := h.parseShareOptions(c)
+	if !ok {
+		return
+	}
 
-        // Serialize the files into JSON and cache the result
-        jsonData, err := json.Marshal(files)
-        if err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to serialize files"})
-            return
-        }
+	// Public links are the owner's call, write permission only covers content
+	file, ok := h.findFile(c, accessOwner)
+	if !ok {
+		return
+	}
+	// shareURL :=  wd + fmt.Sprintf("/download/%s", filepath.Base(file.URL))
 
-        h.Redis.Set(ctx, cacheKey, jsonData, 5*time.Minute) // Cache for 5 minutes
-        c.JSON(http.StatusOK, files)
-    } else if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Cache error"})
-    } else {
-        fmt.Println("Cache hit, return cached data")
-        var files []models.File
-        if err := json.Unmarshal([]byte(cachedData), &files); err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deserialize cached files"})
-            return
-        }
-        c.JSON(http.StatusOK, files)
-    }
-}
+	// Content waiting for a malware scan or in quarantine can't be shared
+	var blob models.Blob
+	if err := h.DB.First(&blob, file.BlobID).Error; err == nil && respondHeld(c, blobHeld(blob)) {
+		return
+	}
 
-func (h *FileHandler) GetFilesOnlySQL(c *gin.Context) {
-	userID, _ := c.Get("userID")
+	if _, err := h.Storage.Stat(c.Request.Context(), file.URL); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
 
-	var files []models.File
-	if err := h.DB.Where("user_id = ?", userID).Find(&files).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve files"})
+	link.FilePath = file.URL
+	link.FileName = file.Name
+	link.FileID = file.ID
+	if err := h.saveShareLink(c, link); err != nil {
+		fmt.Println("Error saving share link:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
 		return
 	}
 
-	c.JSON(http.StatusOK, files)
-}
+	shareURL := fmt.Sprintf("%s/download/%s",c.Request.Host,link.Token)
+	h.clearFileCache(file)
 
-type SharedFile struct{
-	Token string `gorm:"uniqueIndex"`
-	FilePath string
-	FileName string
-	Expires time.Time
-}
+	c.JSON(http.StatusOK, gin.H{
+		"shareURL": "http://" + shareURL,
+		"token": link.Token,
+		"name": link.Name,
+		"protected": link.PasswordHash != "",
+		"max_downloads": link.MaxDownloads,
+		"expires_at": link.Expires.Format(time.RFC3339),
+	})
 
-var sharedFiles = make(map[string]SharedFile) 
-var mu sync.Mutex
 
-func (h *FileHandler) ShareFile(c *gin.Context) {
+	// PublicUrl keeps pointing at the owner's newest link. The request and
+	// its context are done by the time this runs, so the tenant is set here.
+	db := h.DB.WithContext(tenant.WithOrganization(context.Background(), file.OrganizationID))
+	go func() {
+		updates := map[string]interface{}{"public_url": shareURL, "public_url_expiry": link.Expires}
+		if err := db.Model(&file).Updates(updates).Error; err != nil {
+			fmt.Printf("Error saving file share URL: %v", err)
+		}
+	}()
+}
+
+// parseShareOptions reads the expiry, name, download limit and password of
+// a new share link from the request
+func (h *FileHandler) parseShareOptions(c *gin.Context) (SharedFile, bool) {
 	userID, _ := c.Get("userID")
-	
-	fileID, err := strconv.Atoi(c.Param("fileID"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
-		return
-	}
 
 	expiry := c.Query("expiry")
     if expiry == "" {
@@ -339,42 +310,61 @@ func (h *FileHandler) ShareFile(c *gin.Context) {
     exp, err := time.ParseDuration(expiry)
 	if err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expiry format"})
-        return
+        return SharedFile{}, false
     }
 
-	var file models.File
-	if err := h.DB.Where("id = ? AND user_id = ?", fileID, userID).First(&file).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
-		return
+	// The organization may cap how long links live, the default is capped to it
+	org, err := h.organization(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load organization settings"})
+		return SharedFile{}, false
 	}
-	if file.PublicUrl != "" {
-		c.JSON(http.StatusOK, gin.H{
-			"shareURL": "http://" + file.PublicUrl,
-			"expires_at": file.PublicUrlExpiry,
-		})
-		return 
+	if org.MaxShareExpiry > 0 && exp > org.MaxShareExpiry {
+		if c.Query("expiry") != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Expiry exceeds the maximum of %s", org.MaxShareExpiry)})
+			return SharedFile{}, false
+		}
+		exp = org.MaxShareExpiry
 	}
 
-	// shareURL :=  wd + fmt.Sprintf("/download/%s", filepath.Base(file.URL))
-
-	token := uuid.New().String()
-	workingDir, err := os.Getwd() 
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
-		return
+	// max_downloads=1 or one_time=true makes a link that works only once
+	var maxDownloads int64
+	if value := c.DefaultQuery("max_downloads", c.PostForm("max_downloads")); value != "" {
+		maxDownloads, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || maxDownloads < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid max_downloads"})
+			return SharedFile{}, false
+		}
+	}
+	if oneTime, _ := strconv.ParseBool(c.DefaultQuery("one_time", c.PostForm("one_time"))); oneTime {
+		maxDownloads = 1
 	}
 
-	filePath := filepath.Join(workingDir, file.URL)
-	expiration:= time.Now().Add(exp)
-	// expiration := time.Now().Add(time.Duration(1) * time.Minute)
-
+	var passwordHash string
+	if password := c.PostForm("password"); password != "" {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+			return SharedFile{}, false
+		}
+		passwordHash = string(hashed)
+	}
+
+	return SharedFile{
+		Token:              uuid.New().String(),
+		Expires:            time.Now().Add(exp),
+		Name:               c.Query("name"),
+		OwnerID:            userID.(uint),
+		PasswordHash:       passwordHash,
+		MaxDownloads:       maxDownloads,
+		RemainingDownloads: maxDownloads,
+	}, true
+}
 
-	sharedFile := SharedFile{
-		Token:            token,
-		FilePath:         filePath,
-		FileName: 		  file.Name,
-		Expires:          expiration,
-	}
+// saveShareLink stores a new share link in the database and in Redis. If
+// either fails the link is removed from both, so it never half exists.
+func (h *FileHandler) saveShareLink(c *gin.Context, sharedFile SharedFile) error {
+	token := sharedFile.Token
 
 	// Save to database
 	var wg sync.WaitGroup
@@ -384,7 +374,7 @@ func (h *FileHandler) ShareFile(c *gin.Context) {
 	// Concurrent database save
 	go func() {
 		defer wg.Done()
-		if err := h.SDB.Create(&sharedFile).Error; err != nil {
+		if err := h.sdb(c).Create(&sharedFile).Error; err != nil {
 			errCh <- fmt.Errorf("failed to create shared file in DB: %w", err)
 		}
 	}()
@@ -395,11 +385,17 @@ func (h *FileHandler) ShareFile(c *gin.Context) {
 		ctx := context.Background()
 		pipe := h.Redis.Pipeline()
 		pipe.HSet(ctx, fmt.Sprintf("shared_file:%s", token),
-			"file_path", filePath,
-			"original_file_name", file.Name,
-			"expires", expiration.Unix(),
+			"file_path", sharedFile.FilePath,
+			"original_file_name", sharedFile.FileName,
+			"expires", sharedFile.Expires.Unix(),
+			"file_id", sharedFile.FileID,
+			"folder_id", sharedFile.FolderID,
+			"password_hash", sharedFile.PasswordHash,
+			"owner_id", sharedFile.OwnerID,
+			"max_downloads", sharedFile.MaxDownloads,
+			"remaining", sharedFile.MaxDownloads,
 		)
-		pipe.Expire(ctx, fmt.Sprintf("shared_file:%s", token), time.Until(expiration))
+		pipe.Expire(ctx, fmt.Sprintf("shared_file:%s", token), time.Until(sharedFile.Expires))
 		_, err := pipe.Exec(ctx)
 		if err != nil {
 			errCh <- fmt.Errorf("failed to save to Redis: %w", err)
@@ -409,42 +405,68 @@ func (h *FileHandler) ShareFile(c *gin.Context) {
 	wg.Wait()
 	close(errCh)
 
+	var errs []error
 	for err := range errCh {
-		fmt.Printf("Error in ShareFile: %v\n", err)
+		errs = append(errs, err)
 	}
+	if len(errs) == 0 {
+		return nil
+	}
+	h.Redis.Del(context.Background(), fmt.Sprintf("shared_file:%s", token))
+	h.sdb(c).Where("token = ?", token).Delete(&SharedFile{})
+	return errors.Join(errs...)
+}
 
+func (h *FileHandler) DownloadFile(c *gin.Context) {
+	token := c.Param("token")
+	sharedFile := h.lookupShareLink(c, token)
+	if status, message := h.checkShareLink(c, token, sharedFile); status != 0 {
+		if status == http.StatusUnauthorized {
+			c.JSON(status, gin.H{"error": message, "unlock_url": fmt.Sprintf("/download/%s/unlock", token)})
+		} else {
+			c.JSON(status, gin.H{"error": message})
+		}
+		return
+	}
+	limited := sharedFile["max_downloads"] != "" && sharedFile["max_downloads"] != "0"
 
-	// mu.Lock()
-	// sharedFiles[token] = SharedFile{
-	// 	FilePath: filePath,
-	// 	FileName: file.Name,
-	// 	Expires:  expiration,
-	// }
-	// mu.Unlock()
-
-	shareURL := fmt.Sprintf("%s/download/%s",c.Request.Host,token)
-	cacheKey := fmt.Sprintf("files_user_%v", userID)
-	h.Redis.Del(context.Background(), cacheKey)
-
-	c.JSON(http.StatusOK, gin.H{
-		"shareURL": "http://" + shareURL,
-		"expires_at": expiration.Format(time.RFC3339),
-	})
+	// Folder links download the folder as a zip archive
+	if folderID, _ := strconv.ParseUint(sharedFile["folder_id"], 10, 64); folderID != 0 {
+		h.downloadFolderLink(c, token, sharedFile["owner_id"], uint(folderID), limited)
+		return
+	}
 
+	blob, modified, ok := h.shareBlob(c, sharedFile)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if respondHeld(c, blobHeld(blob)) {
+		return
+	}
 
-	go func() {
-        file.PublicUrl = shareURL
-        file.PublicUrlExpiry = expiration
+	reader, ok := h.openBlobContent(c, blob)
+	if !ok {
+		return
+	}
+	defer reader.Close()
 
-        if err := h.DB.Save(&file).Error; err != nil {
-            fmt.Printf("Error saving file share URL: %v", err)
-        }
-    }()
+	// HEAD requests and revalidations of an unchanged file transfer no
+	// content and don't count as downloads, every range request does. The
+	// content is opened first so a failed read doesn't use up a download.
+	if c.Request.Method != http.MethodHead && !notModified(c.Request, blobETag(blob), modified) {
+		if !h.countDownload(token, limited) {
+			c.JSON(http.StatusGone, gin.H{"error": "Link has reached its download limit"})
+			return
+		}
+	}
+	name := sharedFile["original_file_name"]
+	writeBlob(c, reader, blob, name, modified, "application/octet-stream", attachmentDisposition(name))
 }
 
-func (h *FileHandler) DownloadFile(c *gin.Context) {
-	token := c.Param("token")
-
+// lookupShareLink returns the fields of a share link, from Redis or else from
+// the database, or nil if there is no such link
+func (h *FileHandler) lookupShareLink(c *gin.Context, token string) map[string]string {
 	ctx := context.Background()
 	var sharedFile map[string]string
 	var dbSharedFile SharedFile
@@ -467,7 +489,7 @@ func (h *FileHandler) DownloadFile(c *gin.Context) {
 	// Concurrent DB fetch
 	go func() {
 		defer wg.Done()
-		if err := h.SDB.Where("token = ?", token).First(&dbSharedFile).Error; err != nil {
+		if err := h.sdb(c).Where("token = ?", token).First(&dbSharedFile).Error; err != nil {
 			if err != gorm.ErrRecordNotFound {
 				fmt.Printf("DB error: %v\n", err)
 			}
@@ -482,205 +504,197 @@ func (h *FileHandler) DownloadFile(c *gin.Context) {
 			"file_path":          dbSharedFile.FilePath,
 			"original_file_name": dbSharedFile.FileName,
 			"expires":            fmt.Sprintf("%d", dbSharedFile.Expires.Unix()),
+			"file_id":            fmt.Sprintf("%d", dbSharedFile.FileID),
+			"folder_id":          fmt.Sprintf("%d", dbSharedFile.FolderID),
+			"password_hash":      dbSharedFile.PasswordHash,
+			"owner_id":           fmt.Sprintf("%d", dbSharedFile.OwnerID),
+			"max_downloads":      fmt.Sprintf("%d", dbSharedFile.MaxDownloads),
+			"remaining":          fmt.Sprintf("%d", dbSharedFile.RemainingDownloads),
 		}
 		
 		// Update Redis asynchronously
-		go func() {
-			h.Redis.HSet(ctx, fmt.Sprintf("shared_file:%s", token),
-				"file_path", dbSharedFile.FilePath,
-				"original_file_name", dbSharedFile.FileName,
-				"expires", dbSharedFile.Expires.Unix(),
-			)
-			h.Redis.Expire(ctx, fmt.Sprintf("shared_file:%s", token), time.Until(dbSharedFile.Expires))
-		}()
+		go h.cacheShareLink(token, dbSharedFile)
 	}
 
+	return sharedFile
+}
+
+// checkShareLink tells why a link can't be used right now, the status is 0
+// when it can. Password protected links answer 401 until they are unlocked.
+func (h *FileHandler) checkShareLink(c *gin.Context, token string, sharedFile map[string]string) (int, string) {
 	if len(sharedFile) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Link not found"})
-		return
+		return http.StatusNotFound, "Link not found"
 	}
 
 	expiresUnix, _ := strconv.ParseInt(sharedFile["expires"], 10, 64)
 	if time.Now().After(time.Unix(expiresUnix, 0)) {
-		c.JSON(http.StatusGone, gin.H{"error": "Link has expired"})
-		return
+		return http.StatusGone, "Link has expired"
 	}
 
-	c.FileAttachment(sharedFile["file_path"], sharedFile["original_file_name"])
-}
-
-func (h *FileHandler) DownloadFile2(c *gin.Context) {
-	token := c.Param("token")
-
-
-	mu.Lock()
-	sharedFile, exists := sharedFiles[token]
-	mu.Unlock()
-
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Link not found"})
-		return
+	limited := sharedFile["max_downloads"] != "" && sharedFile["max_downloads"] != "0"
+	if limited && sharedFile["remaining"] == "0" {
+		return http.StatusGone, "Link has reached its download limit"
 	}
 
-	// Check if the link has expired
-	if time.Now().After(sharedFile.Expires) {
-		c.JSON(http.StatusGone, gin.H{"error": "Link has expired"})
-		return
+	if hash := sharedFile["password_hash"]; hash != "" && !h.shareUnlocked(c, token, hash) {
+		return http.StatusUnauthorized, "This link is password protected"
 	}
-
-	c.FileAttachment(sharedFile.FilePath, sharedFile.FileName)
+	return 0, ""
 }
 
-func (h *FileHandler) DeleteFile(c *gin.Context) {
-	userID, _ := c.Get("userID")
-	fileID, err := strconv.Atoi(c.Param("fileID"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
-		return
+// shareBlob finds the current content of a file link and when it was stored.
+// Links from before file IDs were recorded point straight at a blob.
+func (h *FileHandler) shareBlob(c *gin.Context, sharedFile map[string]string) (models.Blob, time.Time, bool) {
+	var blob models.Blob
+	fileID, _ := strconv.ParseUint(sharedFile["file_id"], 10, 64)
+	if fileID == 0 {
+		if err := h.db(c).Where("storage_key = ?", sharedFile["file_path"]).First(&blob).Error; err != nil {
+			return blob, time.Time{}, false
+		}
+		return blob, blob.CreatedAt, true
 	}
 
+	// Files in the trash are not served
 	var file models.File
-	err = h.DB.Where("id = ? AND user_id = ?", fileID, userID).First(&file).Error
-	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "File not found or you don't have permission to delete it"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch file information"})
-		}
-		return
+	if err := h.db(c).First(&file, fileID).Error; err != nil || !h.linkOwnerCanRead(sharedFile["owner_id"], file) {
+		return blob, time.Time{}, false
 	}
+	if err := h.db(c).First(&blob, file.BlobID).Error; err != nil {
+		return blob, time.Time{}, false
+	}
+	return blob, h.contentModified(c, file), true
+}
 
-	// Channels to handle the results of deleting file and DB record
-	fileDeleteCh := make(chan error, 1)
-	dbDeleteCh := make(chan error, 1)
-
-	// Goroutine to delete the DB record
-	go func() {
-		dbDeleteCh <- h.DB.Delete(&file).Error
-	}()
-
-	// Goroutine to delete the actual file
-	go func() {
-		workingDir, err := os.Getwd()
-		if err != nil {
-			fileDeleteCh <- fmt.Errorf("failed to get working directory: %w", err)
-			return
-		}
-
-		fullPath := filepath.Join(workingDir, file.URL)
-		if err := os.Remove(fullPath); err != nil {
-			if os.IsNotExist(err) {
-				fileDeleteCh <- fmt.Errorf("file does not exist on filesystem: %w", err)
-			} else {
-				fileDeleteCh <- fmt.Errorf("failed to delete file from filesystem: %w", err)
-			}
-		} else {
-			fileDeleteCh <- nil
-		}
-	}()
+// countDownload records a download through a link. Limited links lose one of
+// their downloads and refuse once none are left.
+func (h *FileHandler) countDownload(token string, limited bool) bool {
+	if limited {
+		return h.consumeDownload(token)
+	}
+	go h.recordLinkUsage(token)
+	return true
+}
 
-	
-	dbErr := <-dbDeleteCh
-	fileErr := <-fileDeleteCh
+// serveBlob sends the plaintext of a blob to the client as an attachment.
+// Range, HEAD and conditional requests are answered by http.ServeContent, the
+// ETag is the checksum of the content and modified when it was stored.
+func (h *FileHandler) serveBlob(c *gin.Context, blob models.Blob, name string, modified time.Time) {
+	h.sendBlob(c, blob, name, modified, "application/octet-stream", attachmentDisposition(name))
+}
 
-	// Handle errors
-	if dbErr != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file metadata", "details": dbErr.Error()})
+func (h *FileHandler) sendBlob(c *gin.Context, blob models.Blob, name string, modified time.Time, contentType, disposition string) {
+	reader, ok := h.openBlobContent(c, blob)
+	if !ok {
 		return
 	}
+	defer reader.Close()
+	writeBlob(c, reader, blob, name, modified, contentType, disposition)
+}
 
-	if fileErr != nil {
-		
-		if strings.Contains(fileErr.Error(), "file does not exist on filesystem") {
-			log.Printf("Warning: %v", fileErr)
+// openBlobContent opens the content of a blob for writeBlob, responding
+// with the error if it can't be read
+func (h *FileHandler) openBlobContent(c *gin.Context, blob models.Blob) (*blobReader, bool) {
+	reader, err := h.newBlobReader(c.Request.Context(), blob)
+	if err != nil {
+		if respondHeld(c, err) {
+			return nil, false
+		} else if errors.Is(err, storage.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file from filesystem", "details": fileErr.Error()})
-			return
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
 		}
+		return nil, false
 	}
+	return reader, true
+}
 
-	// Clear the cache
-	cacheKey := fmt.Sprintf("files_user_%v", userID)
-	if err := h.Redis.Del(context.Background(), cacheKey).Err(); err != nil {
-		log.Printf("Failed to clear cache: %v", err)
+func writeBlob(c *gin.Context, reader *blobReader, blob models.Blob, name string, modified time.Time, contentType, disposition string) {
+	if blob.Checksum != "" {
+		c.Header("ETag", blobETag(blob))
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "File deleted successfully"})
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", disposition)
+	if c.Writer.Header().Get("Cache-Control") == "" {
+		c.Header("Cache-Control", "private, no-cache")
+	}
+	http.ServeContent(c.Writer, c.Request, name, modified, reader)
 }
 
+func blobETag(blob models.Blob) string {
+	return `"` + blob.Checksum + `"`
+}
 
-func (h *FileHandler) DeleteFile2(c *gin.Context) {
-	userID, _ := c.Get("userID")
-	fileID, err := strconv.Atoi(c.Param("fileID"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
-		return
+// notModified tells whether a GET or HEAD would be answered with 304 Not
+// Modified, following the precedence http.ServeContent uses
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || (etag != "" && tag == etag) {
+				return true
+			}
+		}
+		return false
 	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.IsZero() && !modified.Truncate(time.Second).After(since)
+}
 
-	// Channels to handle the results of deleting file and DB record
-	fileDeleteCh := make(chan error)
-	dbDeleteCh := make(chan error)
-
-	// Goroutine to fetch the file from the database
-	var file models.File
-	
-	go func() {
-		if err := h.DB.Where("id = ? AND user_id = ?", fileID, userID).First(&file).Error; err != nil {
-			dbDeleteCh <- err
-			return
-		}
+// contentModified is when the current content of a file was stored
+func (h *FileHandler) contentModified(c *gin.Context, file models.File) time.Time {
+	var version models.FileVersion
+	if err := h.db(c).Where("file_id = ? AND version = ?", file.ID, file.Version).First(&version).Error; err != nil {
+		return file.UpdatedAt
+	}
+	return version.CreatedAt
+}
 
-		// If file exists in DB, delete the record
-		if err := h.DB.Delete(&file).Error; err != nil {
-			dbDeleteCh <- err
-		} else {
-			dbDeleteCh <- nil
-		}
-	}()
-	
-	go func() {
-		
-		workingDir, err := os.Getwd()
-		if err != nil {
-			fileDeleteCh <- err
-			return
-		}
+// attachmentDisposition mirrors the header gin's FileAttachment builds
+func attachmentDisposition(name string) string {
+	return contentDisposition("attachment", name)
+}
 
-		fullPath := filepath.Join(workingDir, file.URL) // Construct the full file path
-		fmt.Printf("%s",fullPath)
-		if err := os.Remove(fullPath); err != nil {
-			fileDeleteCh <- err
-		} else {
-			fileDeleteCh <- nil
+func contentDisposition(disposition, name string) string {
+	for _, r := range name {
+		if r > unicode.MaxASCII {
+			return disposition + `; filename*=UTF-8''` + url.QueryEscape(name)
 		}
-	}()
-	
-	dbErr := <-dbDeleteCh
-	fileErr := <-fileDeleteCh
+	}
+	return disposition + `; filename="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
 
-	// Handle errors
-	if dbErr != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file metadata"})
+func (h *FileHandler) DeleteFile(c *gin.Context) {
+	file, ok := h.findFile(c, accessOwner)
+	if !ok {
 		return
 	}
 
-	if fileErr != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file from filesystem"})
+	// Soft delete moves the file to the trash, its blobs are kept until it is purged
+	if err := h.db(c).Delete(&file).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file metadata", "details": err.Error()})
 		return
 	}
 
-	cacheKey := fmt.Sprintf("files_user_%v", userID)
-    h.Redis.Del(context.Background(), cacheKey)
-
-	// Respond with success
-	c.JSON(http.StatusOK, gin.H{"message": "File deleted successfully"})
+	// Clear the cache
+	cacheKey := fileWorkspace(file).cacheKey()
+	if err := h.Redis.Del(context.Background(), cacheKey).Err(); err != nil {
+		log.Printf("Failed to clear cache: %v", err)
+	}
 
+	c.JSON(http.StatusOK, gin.H{"message": "File moved to trash"})
 }
 
+
 func (h *FileHandler) SearchFiles(c *gin.Context) {
 	userID, _ := c.Get("userID")
 	fileName := c.Query("name")               // e.g., ?name=report
 	fileType := c.Query("type")               // e.g., ?type=pdf
+	mimeType := c.Query("mime")               // e.g., ?mime=image/png or ?mime=image/*
+	category := c.Query("category")           // e.g., ?category=document
+	contentTerms := c.Query("q")              // e.g., ?q="quarterly report" budget
 	uploadedDate := c.Query("date")  		  // e.g., ?uploaded_date=2023-09-14
 	limitStr := c.Query("limit")              // Limit the number of results
 	offsetStr := c.Query("offset")            // Offset for pagination
@@ -702,14 +716,34 @@ func (h *FileHandler) SearchFiles(c *gin.Context) {
 	}
 
 	
-	query := h.DB.Model(&models.File{})
+	// Search one workspace when group_id is given, otherwise everything the
+	// caller can read
+	query := h.db(c).Model(&models.File{}).Scopes(h.accessibleFiles(userID))
+	if c.Query("group_id") != "" {
+		ws, ok := h.parseWorkspace(c, accessRead)
+		if !ok {
+			return
+		}
+		query = h.db(c).Model(&models.File{}).Scopes(ws.scope)
+	}
 
 	// Add filters to the query based on the parameters provided
 	if fileName != "" {
-		query = query.Where("name LIKE ? AND user_id = ?", "%"+fileName+"%",userID)
+		query = query.Where("name LIKE ?", "%"+fileName+"%")
 	}
 	if fileType != "" {
-		query = query.Where("type = ? AND user_id = ?", fileType,userID)
+		query = query.Where("type = ?", strings.ToLower(strings.TrimPrefix(fileType, ".")))
+	}
+	if mimeType != "" {
+		mimeType = strings.ToLower(mimeType)
+		if prefix, ok := strings.CutSuffix(mimeType, "/*"); ok {
+			query = query.Where("mime_type LIKE ?", prefix+"/%")
+		} else {
+			query = query.Where("mime_type = ?", mimeType)
+		}
+	}
+	if category != "" {
+		query = query.Where("category = ?", strings.ToLower(category))
 	}
 	if uploadedDate != "" {
         // Check for a valid date format
@@ -719,12 +753,41 @@ func (h *FileHandler) SearchFiles(c *gin.Context) {
             return
         }
 
-        query = query.Where("DATE(created_at) = ? AND user_id = ?", parsedDate.Format("2006-01-02"), userID)
+        query = query.Where("DATE(created_at) = ?", parsedDate.Format("2006-01-02"))
     }
 
 	// Apply pagination
 	query = query.Limit(limit).Offset(offset)
 
+	// Content search ranks the matching files and shows where they matched
+	if strings.TrimSpace(contentTerms) != "" {
+		if !h.ContentSearch {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Content search is not available on this server"})
+			return
+		}
+		match := contentQuery(contentTerms)
+		if match == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Search terms need a letter or digit"})
+			return
+		}
+		var matches []contentMatch
+		err := query.Joins("JOIN blob_texts ON blob_texts.rowid = files.blob_id").
+			Where("blob_texts MATCH ?", match).
+			Select("files.*, snippet(blob_texts, 0, ?, ?, '…', 24) AS snippet, -bm25(blob_texts) AS score", snippetStart, snippetEnd).
+			Order("score DESC").
+			Find(&matches).Error
+		if err != nil {
+			fmt.Println(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search files"})
+			return
+		}
+		for i := range matches {
+			matches[i].Snippet = highlightSnippet(matches[i].Snippet)
+		}
+		c.JSON(http.StatusOK, matches)
+		return
+	}
+
 	// Execute the query and fetch the results
 	var files []models.File
 	if err := query.Find(&files).Error; err != nil {
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"file_manage/models"
+	"net/http"
+	"testing"
+)
+
+func remainingDownloads(t *testing.T, h *FileHandler, token string) int64 {
+	t.Helper()
+	var link SharedFile
+	if err := h.SDB.Where("token = ?", token).First(&link).Error; err != nil {
+		t.Fatalf("load link: %v", err)
+	}
+	return link.RemainingDownloads
+}
+
+func TestDownloadCountsLimitedLinks(t *testing.T) {
+	h := newTestHandler(t)
+	user := createUser(t, h, "acme", "alice@example.com")
+	file := uploadFile(t, h, user, "report.txt", "quarterly numbers")
+	token := createShareLink(t, h, user, file, "", 2)
+	r := testRouter(h)
+
+	// Neither HEAD nor a revalidation transfers the content
+	if w := do(r, models.User{}, http.MethodHead, "/download/"+token, nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("HEAD: status %d, want 200", w.Code)
+	}
+	w := do(r, models.User{}, http.MethodGet, "/download/"+token, nil, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "quarterly numbers" {
+		t.Fatalf("first download: status %d, body %q", w.Code, w.Body)
+	}
+	etag := w.Header().Get("ETag")
+	if w := do(r, models.User{}, http.MethodGet, "/download/"+token, nil, map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified {
+		t.Fatalf("revalidation: status %d, want 304", w.Code)
+	}
+	if got := remainingDownloads(t, h, token); got != 1 {
+		t.Fatalf("remaining downloads = %d, want 1", got)
+	}
+
+	if w := do(r, models.User{}, http.MethodGet, "/download/"+token, nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("second download: status %d, want 200", w.Code)
+	}
+	if w := do(r, models.User{}, http.MethodGet, "/download/"+token, nil, nil); w.Code != http.StatusGone {
+		t.Errorf("download over the limit: status %d, want 410", w.Code)
+	}
+	if got := remainingDownloads(t, h, token); got != 0 {
+		t.Errorf("remaining downloads = %d, want 0", got)
+	}
+}
+
+func TestDownloadOfMissingContentIsNotCounted(t *testing.T) {
+	h := newTestHandler(t)
+	user := createUser(t, h, "acme", "alice@example.com")
+	file := uploadFile(t, h, user, "report.txt", "quarterly numbers")
+	token := createShareLink(t, h, user, file, "", 1)
+
+	// The blob went missing from storage
+	if err := h.Storage.Delete(context.Background(), file.URL); err != nil {
+		t.Fatalf("delete content: %v", err)
+	}
+	if w := do(testRouter(h), models.User{}, http.MethodGet, "/download/"+token, nil, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("download: status %d, want 404", w.Code)
+	}
+	if got := remainingDownloads(t, h, token); got != 1 {
+		t.Errorf("remaining downloads = %d, want 1", got)
+	}
+}
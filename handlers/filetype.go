@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"context"
+	"file_manage/models"
+	"file_manage/utils"
+	"fmt"
+	"io"
+
+	"gorm.io/gorm"
+)
+
+// File types are detected from content. The MIME type sniffed from the first
+// bytes belongs to the blob, the file's name can only narrow it down, so
+// renaming a program to report.pdf doesn't make it a document.
+
+// setFileType sets the type, MIME type and category of a file holding blob
+func setFileType(file *models.File, blob models.Blob) {
+	t := utils.DetectType(file.Name, blob.MimeType)
+	file.Type = t.Extension
+	file.MimeType = t.MimeType
+	file.Category = t.Category
+}
+
+// refreshFileType detects the type of a file again after its name changed
+func (h *FileHandler) refreshFileType(db *gorm.DB, file *models.File) {
+	var blob models.Blob
+	if err := db.Select("id", "mime_type").First(&blob, file.BlobID).Error; err != nil {
+		fmt.Printf("Error fetching blob %d for file type: %v\n", file.BlobID, err)
+	}
+	setFileType(file, blob)
+}
+
+// sniffBlob reads the start of a blob and detects its MIME type
+func (h *FileHandler) sniffBlob(ctx context.Context, blob models.Blob) (string, error) {
+	reader, err := h.readBlob(ctx, blob)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	head := make([]byte, utils.SniffLen)
+	n, err := io.ReadFull(reader, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return utils.SniffType(head[:n]), nil
+}
+
+// DetectFileTypes sniffs the content of every blob again and updates the
+// type, MIME type and category of all files, including those in the trash.
+// Used by the detect-types command for files stored before types were
+// detected from content, or after detection learned new formats.
+func (h *FileHandler) DetectFileTypes(ctx context.Context) error {
+	var blobs []models.Blob
+	var failed int
+	err := h.DB.WithContext(ctx).FindInBatches(&blobs, 100, func(tx *gorm.DB, batch int) error {
+		for _, blob := range blobs {
+			mimeType, err := h.sniffBlob(ctx, blob)
+			if err != nil {
+				// Its files keep the type they have, the next run tries again
+				fmt.Printf("Error reading blob %d: %v\n", blob.ID, err)
+				failed++
+				continue
+			}
+			if err := h.DB.Model(&blob).UpdateColumn("mime_type", mimeType).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	var files []models.File
+	var updated int
+	err = h.DB.WithContext(ctx).Unscoped().Select("id", "name", "blob_id").FindInBatches(&files, 100, func(tx *gorm.DB, batch int) error {
+		for _, file := range files {
+			var blob models.Blob
+			if err := h.DB.Select("id", "mime_type").First(&blob, file.BlobID).Error; err != nil || blob.MimeType == "" {
+				continue
+			}
+			setFileType(&file, blob)
+			if err := h.DB.Unscoped().Model(&models.File{}).Where("id = ?", file.ID).UpdateColumns(map[string]interface{}{
+				"type":      file.Type,
+				"mime_type": file.MimeType,
+				"category":  file.Category,
+			}).Error; err != nil {
+				return err
+			}
+			updated++
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Detected the types of %d files", updated)
+	if failed > 0 {
+		fmt.Printf(", %d blobs could not be read", failed)
+	}
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,566 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"file_manage/models"
+	"file_manage/utils"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type folderRequest struct {
+	Name     *string `json:"name"`
+	ParentID *uint   `json:"parent_id"` // 0 means the top level
+}
+
+type fileUpdateRequest struct {
+	Name     *string `json:"name"`
+	FolderID *uint   `json:"folder_id"` // 0 means the top level
+}
+
+var errFolderForbidden = errors.New("folder access denied")
+
+// topLevel turns the 0 used in requests into the nil stored for the top level
+func topLevel(id *uint) *uint {
+	if id == nil || *id == 0 {
+		return nil
+	}
+	return id
+}
+
+// whereParent filters column on a folder ID that may be nil
+func whereParent(query *gorm.DB, column string, id *uint) *gorm.DB {
+	if id == nil {
+		return query.Where(column + " IS NULL")
+	}
+	return query.Where(column+" = ?", *id)
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// folderAccess works out what a user may do with a folder
+func (h *FileHandler) folderAccess(userID uint, folder models.Folder) access {
+	if folder.GroupID != nil {
+		return h.groupAccess(userID, *folder.GroupID)
+	}
+	if folder.UserID == userID {
+		return accessOwner
+	}
+	return accessNone
+}
+
+// findFolder loads a folder the user has at least the needed access to.
+// Folders the user can't see at all are reported as not found.
+func (h *FileHandler) findFolder(userID interface{}, folderID uint, need access) (models.Folder, error) {
+	var folder models.Folder
+	if err := h.DB.First(&folder, folderID).Error; err != nil {
+		return folder, err
+	}
+	granted := h.folderAccess(userID.(uint), folder)
+	if granted == accessNone {
+		return folder, gorm.ErrRecordNotFound
+	}
+	if granted < need {
+		return folder, errFolderForbidden
+	}
+	return folder, nil
+}
+
+// folderError writes the response for an error from findFolder
+func folderError(c *gin.Context, err error, notFound string) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": notFound})
+	case errors.Is(err, errFolderForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to do this"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch folder"})
+	}
+}
+
+// parseUploadTarget works out where uploaded files go from the optional
+// group_id and folder_id query parameters. A folder implies its workspace.
+func (h *FileHandler) parseUploadTarget(c *gin.Context) (uploadTarget, bool) {
+	ws, ok := h.parseWorkspace(c, accessOwner)
+	if !ok {
+		return uploadTarget{}, false
+	}
+	target := uploadTarget{OrganizationID: ws.OrganizationID, UserID: ws.UserID, GroupID: ws.GroupID}
+
+	value := c.Query("folder_id")
+	if value == "" || value == "0" {
+		return target, true
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder ID"})
+		return target, false
+	}
+	folder, err := h.findFolder(ws.UserID, uint(id), accessOwner)
+	if err != nil {
+		folderError(c, err, "Folder not found")
+		return target, false
+	}
+	if c.Query("group_id") != "" && !ws.contains(folderWorkspace(folder)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Folder is not in this group"})
+		return target, false
+	}
+
+	target.GroupID = folder.GroupID
+	target.FolderID = &folder.ID
+	return target, true
+}
+
+// folderParam loads the folder named by the folderID route parameter
+func (h *FileHandler) folderParam(c *gin.Context, need access) (models.Folder, bool) {
+	userID, _ := c.Get("userID")
+	id, err := strconv.ParseUint(c.Param("folderID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder ID"})
+		return models.Folder{}, false
+	}
+
+	folder, err := h.findFolder(userID, uint(id), need)
+	if err != nil {
+		folderError(c, err, "Folder not found")
+		return folder, false
+	}
+	return folder, true
+}
+
+// checkDestination validates the folder something is moved into, which
+// has to be in the same workspace
+func (h *FileHandler) checkDestination(c *gin.Context, ws workspace, folderID *uint) bool {
+	if folderID == nil {
+		return true
+	}
+	userID, _ := c.Get("userID")
+	folder, err := h.findFolder(userID, *folderID, accessOwner)
+	if err != nil {
+		folderError(c, err, "Destination folder not found")
+		return false
+	}
+	if !ws.contains(folderWorkspace(folder)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Destination folder is in another workspace"})
+		return false
+	}
+	return true
+}
+
+// folderNameTaken reports whether parentID already has a subfolder called name
+func (h *FileHandler) folderNameTaken(ws workspace, parentID *uint, name string, exclude uint) bool {
+	var count int64
+	query := h.DB.Model(&models.Folder{}).Scopes(ws.scope).Where("name = ? AND id <> ?", name, exclude)
+	whereParent(query, "parent_id", parentID).Count(&count)
+	return count > 0
+}
+
+// CreateFolder creates a folder under parent_id, or at the top level of the
+// workspace picked by the group_id query parameter
+func (h *FileHandler) CreateFolder(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var req folderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == nil || !validName(*req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder name"})
+		return
+	}
+
+	ws, ok := h.parseWorkspace(c, accessOwner)
+	if !ok {
+		return
+	}
+	parentID := topLevel(req.ParentID)
+	if parentID != nil {
+		parent, err := h.findFolder(userID, *parentID, accessOwner)
+		if err != nil {
+			folderError(c, err, "Parent folder not found")
+			return
+		}
+		ws = folderWorkspace(parent)
+	}
+	if h.folderNameTaken(ws, parentID, *req.Name, 0) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A folder with this name already exists"})
+		return
+	}
+
+	folder := models.Folder{Name: *req.Name, ParentID: parentID, UserID: userID.(uint), GroupID: ws.GroupID}
+	if err := h.db(c).Create(&folder).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create folder"})
+		return
+	}
+	c.JSON(http.StatusCreated, folder)
+}
+
+// UpdateFolder renames a folder and/or moves it under another parent
+func (h *FileHandler) UpdateFolder(c *gin.Context) {
+	folder, ok := h.folderParam(c, accessOwner)
+	if !ok {
+		return
+	}
+	ws := folderWorkspace(folder)
+
+	var req folderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Name != nil {
+		if !validName(*req.Name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder name"})
+			return
+		}
+		folder.Name = *req.Name
+	}
+	if req.ParentID != nil {
+		parentID := topLevel(req.ParentID)
+		if !h.checkDestination(c, ws, parentID) {
+			return
+		}
+		if parentID != nil && h.isWithin(*parentID, folder.ID) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A folder can't be moved into itself"})
+			return
+		}
+		folder.ParentID = parentID
+	}
+
+	if h.folderNameTaken(ws, folder.ParentID, folder.Name, folder.ID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A folder with this name already exists"})
+		return
+	}
+	if err := h.db(c).Save(&folder).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update folder"})
+		return
+	}
+	c.JSON(http.StatusOK, folder)
+}
+
+// isWithin reports whether folderID is ancestor or folderID itself
+func (h *FileHandler) isWithin(folderID uint, ancestor uint) bool {
+	current := &folderID
+	for depth := 0; current != nil && depth < 1000; depth++ {
+		if *current == ancestor {
+			return true
+		}
+		var folder models.Folder
+		if err := h.DB.Select("parent_id").First(&folder, *current).Error; err != nil {
+			return false
+		}
+		current = folder.ParentID
+	}
+	return false
+}
+
+// descendantFolders returns the IDs of a folder and everything below it
+func (h *FileHandler) descendantFolders(folderID uint) ([]uint, error) {
+	ids := []uint{folderID}
+	frontier := []uint{folderID}
+	for len(frontier) > 0 {
+		var children []uint
+		if err := h.DB.Model(&models.Folder{}).Where("parent_id IN ?", frontier).Pluck("id", &children).Error; err != nil {
+			return nil, err
+		}
+		ids = append(ids, children...)
+		frontier = children
+	}
+	return ids, nil
+}
+
+// DeleteFolder moves a folder's files, including those in subfolders, to the trash
+func (h *FileHandler) DeleteFolder(c *gin.Context) {
+	folder, ok := h.folderParam(c, accessOwner)
+	if !ok {
+		return
+	}
+
+	ids, err := h.descendantFolders(folder.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete folder"})
+		return
+	}
+
+	err = h.db(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("folder_id IN ?", ids).Delete(&models.File{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id IN ?", ids).Delete(&models.Folder{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete folder"})
+		return
+	}
+
+	cacheKey := folderWorkspace(folder).cacheKey()
+	h.Redis.Del(context.Background(), cacheKey)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Folder deleted, its files were moved to trash"})
+}
+
+// ListFolder lists the subfolders and files of a folder, or of the top level
+// for "root". Folders come first and limit/offset page through both.
+func (h *FileHandler) ListFolder(c *gin.Context) {
+	var ws workspace
+	var parentID *uint
+	var current *models.Folder
+	if c.Param("folderID") == "root" {
+		var ok bool
+		if ws, ok = h.parseWorkspace(c, accessRead); !ok {
+			return
+		}
+	} else {
+		folder, ok := h.folderParam(c, accessRead)
+		if !ok {
+			return
+		}
+		ws = folderWorkspace(folder)
+		parentID = &folder.ID
+		current = &folder
+	}
+
+	limit, offset := 50, 0
+	if parsed, err := strconv.Atoi(c.Query("limit")); err == nil && parsed > 0 {
+		limit = parsed
+	}
+	if parsed, err := strconv.Atoi(c.Query("offset")); err == nil && parsed >= 0 {
+		offset = parsed
+	}
+
+	var folderCount, fileCount int64
+	folderQuery := whereParent(h.db(c).Model(&models.Folder{}).Scopes(ws.scope), "parent_id", parentID)
+	fileQuery := whereParent(h.db(c).Model(&models.File{}).Scopes(ws.scope), "folder_id", parentID)
+	folderQuery.Session(&gorm.Session{}).Count(&folderCount)
+	fileQuery.Session(&gorm.Session{}).Count(&fileCount)
+
+	folders := []models.Folder{}
+	files := []models.File{}
+	if int64(offset) < folderCount {
+		if err := folderQuery.Order("name").Limit(limit).Offset(offset).Find(&folders).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve folder"})
+			return
+		}
+	}
+	fileOffset := max(int64(offset)-folderCount, 0)
+	if remaining := limit - len(folders); remaining > 0 {
+		if err := fileQuery.Order("name").Limit(remaining).Offset(int(fileOffset)).Find(&files).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve folder"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"folder":  current,
+		"folders": folders,
+		"files":   files,
+		"total":   folderCount + fileCount,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+// UpdateFile renames a file and/or moves it to another folder of its workspace
+func (h *FileHandler) UpdateFile(c *gin.Context) {
+	file, ok := h.findFile(c, accessOwner)
+	if !ok {
+		return
+	}
+
+	var req fileUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Name != nil {
+		if !validName(*req.Name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file name"})
+			return
+		}
+		file.Name = *req.Name
+		h.refreshFileType(h.db(c), &file)
+		t := utils.FileType{MimeType: file.MimeType, Category: file.Category, Extension: file.Type}
+		if err := h.checkFileType(file.OrganizationID, c.GetUint("userID"), file.Name, &t); err != nil {
+			rejectFile(c, err)
+			return
+		}
+	}
+	if req.FolderID != nil {
+		folderID := topLevel(req.FolderID)
+		if !h.checkDestination(c, fileWorkspace(file), folderID) {
+			return
+		}
+		file.FolderID = folderID
+	}
+
+	if err := h.db(c).Save(&file).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update file"})
+		return
+	}
+
+	h.clearFileCache(file)
+
+	c.JSON(http.StatusOK, file)
+}
+
+// CopyFile creates a new file with the current content of a file the caller
+// can read. Without a folder_id the copy goes next to the original if the
+// caller has full access to it, otherwise to the top level of the workspace
+// picked by group_id. The copy references the same blob, so no bytes are
+// duplicated.
+func (h *FileHandler) CopyFile(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	file, ok := h.findFile(c, accessRead)
+	if !ok {
+		return
+	}
+
+	var req fileUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := file.Name
+	if req.Name != nil {
+		if !validName(*req.Name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file name"})
+			return
+		}
+		name = *req.Name
+	}
+	// The copy is checked like an upload of the same content under its new name
+	probe := models.File{Name: name, BlobID: file.BlobID}
+	h.refreshFileType(h.db(c), &probe)
+	t := utils.FileType{MimeType: probe.MimeType, Category: probe.Category, Extension: probe.Type}
+	if err := h.checkFileType(c.GetUint("orgID"), userID.(uint), name, &t); err != nil {
+		rejectFile(c, err)
+		return
+	}
+
+	var folderID, groupID *uint
+	switch {
+	case req.FolderID == nil && h.ownsFile(userID, file):
+		folderID, groupID = file.FolderID, file.GroupID
+	case topLevel(req.FolderID) != nil:
+		folder, err := h.findFolder(userID, *req.FolderID, accessOwner)
+		if err != nil {
+			folderError(c, err, "Destination folder not found")
+			return
+		}
+		folderID, groupID = &folder.ID, folder.GroupID
+	default:
+		ws, ok := h.parseWorkspace(c, accessOwner)
+		if !ok {
+			return
+		}
+		groupID = ws.GroupID
+	}
+
+	if err := h.retainBlob(file.BlobID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy file"})
+		return
+	}
+
+	copied := models.File{
+		Name:     name,
+		Size:     file.Size,
+		URL:      file.URL,
+		UserID:   userID.(uint),
+		GroupID:  groupID,
+		FolderID: folderID,
+		Checksum: file.Checksum,
+		BlobID:   file.BlobID,
+		Version:  1,
+	}
+	h.refreshFileType(h.db(c), &copied)
+	err := h.db(c).Transaction(func(tx *gorm.DB) error {
+		// The copy counts towards the quota of whoever made it
+		if _, err := chargeUsage(tx, copied.UserID, c.GetUint("orgID"), copied.Size, nil); err != nil {
+			return err
+		}
+		if err := tx.Create(&copied).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.FileVersion{
+			FileID:     copied.ID,
+			Version:    1,
+			BlobID:     copied.BlobID,
+			Size:       copied.Size,
+			Checksum:   copied.Checksum,
+			UploaderID: userID.(uint),
+		}).Error
+	})
+	if err != nil {
+		h.releaseBlob(context.Background(), file.BlobID)
+		if errors.Is(err, errQuotaExceeded) {
+			c.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy file"})
+		return
+	}
+
+	h.clearFileCache(copied)
+
+	c.JSON(http.StatusCreated, copied)
+}
+
+// GetFileByPath resolves a path such as reports/2026/q3.pdf to a file, or
+// to a folder when the last segment names one. group_id picks the workspace.
+func (h *FileHandler) GetFileByPath(c *gin.Context) {
+	ws, ok := h.parseWorkspace(c, accessRead)
+	if !ok {
+		return
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(c.Param("path"), "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	if len(segments) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Path is required"})
+		return
+	}
+
+	var parentID *uint
+	for _, segment := range segments[:len(segments)-1] {
+		var folder models.Folder
+		query := h.db(c).Scopes(ws.scope).Where("name = ?", segment)
+		if err := whereParent(query, "parent_id", parentID).First(&folder).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Path not found"})
+			return
+		}
+		parentID = &folder.ID
+	}
+
+	name := segments[len(segments)-1]
+	var file models.File
+	query := h.db(c).Scopes(ws.scope).Where("name = ?", name)
+	if err := whereParent(query, "folder_id", parentID).Order("updated_at DESC").First(&file).Error; err == nil {
+		c.JSON(http.StatusOK, file)
+		return
+	}
+
+	var folder models.Folder
+	query = h.db(c).Scopes(ws.scope).Where("name = ?", name)
+	if err := whereParent(query, "parent_id", parentID).First(&folder).Error; err == nil {
+		c.JSON(http.StatusOK, gin.H{"folder": folder})
+		return
+	}
+
+	c.JSON(http.StatusNotFound, gin.H{"error": "Path not found"})
+}
@@ -0,0 +1,489 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"file_manage/models"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// workspace is where files and folders live, either a user's personal space
+// or the shared space of a group
+type workspace struct {
+	OrganizationID uint
+	UserID         uint
+	GroupID        *uint
+}
+
+// scope filters a files or folders query to the workspace
+func (w workspace) scope(db *gorm.DB) *gorm.DB {
+	if w.GroupID != nil {
+		return db.Where("group_id = ?", *w.GroupID)
+	}
+	return db.Where("user_id = ? AND group_id IS NULL", w.UserID)
+}
+
+func (w workspace) cacheKey() string {
+	return FileCacheKey(w.OrganizationID, w.UserID, w.GroupID)
+}
+
+func (w workspace) contains(other workspace) bool {
+	if w.GroupID != nil || other.GroupID != nil {
+		return w.GroupID != nil && other.GroupID != nil && *w.GroupID == *other.GroupID
+	}
+	return w.UserID == other.UserID
+}
+
+func fileWorkspace(file models.File) workspace {
+	return workspace{OrganizationID: file.OrganizationID, UserID: file.UserID, GroupID: file.GroupID}
+}
+
+func folderWorkspace(folder models.Folder) workspace {
+	return workspace{OrganizationID: folder.OrganizationID, UserID: folder.UserID, GroupID: folder.GroupID}
+}
+
+// FileCacheKey is the Redis key of the cached file listing of a workspace,
+// namespaced by organization
+func FileCacheKey(organizationID, userID uint, groupID *uint) string {
+	if groupID != nil {
+		return fmt.Sprintf("org_%d:files_group_%d", organizationID, *groupID)
+	}
+	return fmt.Sprintf("org_%d:files_user_%d", organizationID, userID)
+}
+
+// clearFileCache drops the cached listing a file appears in
+func (h *FileHandler) clearFileCache(file models.File) {
+	if err := h.Redis.Del(context.Background(), fileWorkspace(file).cacheKey()).Err(); err != nil {
+		fmt.Println("Failed to clear cache:", err)
+	}
+}
+
+// groupAccess maps a user's role in a group to what they may do with the
+// group's files and folders
+func (h *FileHandler) groupAccess(userID uint, groupID uint) access {
+	var member models.GroupMember
+	if err := h.DB.Where("group_id = ? AND user_id = ?", groupID, userID).First(&member).Error; err != nil {
+		return accessNone
+	}
+	switch member.Role {
+	case models.RoleOwner, models.RoleEditor:
+		return accessOwner
+	case models.RoleViewer:
+		return accessRead
+	}
+	return accessNone
+}
+
+// parseWorkspace picks the workspace named by the optional group_id query
+// parameter, the caller's personal workspace by default
+func (h *FileHandler) parseWorkspace(c *gin.Context, need access) (workspace, bool) {
+	userID, _ := c.Get("userID")
+	ws := workspace{OrganizationID: c.GetUint("orgID"), UserID: userID.(uint)}
+
+	value := c.Query("group_id")
+	if value == "" {
+		return ws, true
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return ws, false
+	}
+
+	granted := h.groupAccess(ws.UserID, uint(id))
+	if granted == accessNone {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return ws, false
+	}
+	if granted < need {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to do this"})
+		return ws, false
+	}
+	groupID := uint(id)
+	ws.GroupID = &groupID
+	return ws, true
+}
+
+// findGroup loads the group named by the groupID route parameter if the
+// caller is a member, and, when roles are given, has one of them
+func (h *FileHandler) findGroup(c *gin.Context, roles ...string) (models.Group, models.GroupMember, bool) {
+	userID, _ := c.Get("userID")
+
+	var group models.Group
+	var member models.GroupMember
+	groupID, err := strconv.Atoi(c.Param("groupID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return group, member, false
+	}
+
+	if err := h.db(c).Where("group_id = ? AND user_id = ?", groupID, userID).First(&member).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return group, member, false
+	}
+	if err := h.db(c).First(&group, groupID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return group, member, false
+	}
+
+	if len(roles) > 0 {
+		allowed := false
+		for _, role := range roles {
+			allowed = allowed || member.Role == role
+		}
+		if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to do this"})
+			return group, member, false
+		}
+	}
+	return group, member, true
+}
+
+func validRole(role string) bool {
+	return role == models.RoleOwner || role == models.RoleEditor || role == models.RoleViewer
+}
+
+type groupInfo struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type memberInfo struct {
+	UserID   uint      `json:"user_id"`
+	Email    string    `json:"email"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+type inviteInfo struct {
+	ID        uint      `json:"id"`
+	GroupID   uint      `json:"group_id"`
+	GroupName string    `json:"group_name"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateGroup creates a group with the caller as its owner
+func (h *FileHandler) CreateGroup(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var req struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	group := models.Group{Name: strings.TrimSpace(req.Name), CreatedBy: userID.(uint)}
+	err := h.db(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&group).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.GroupMember{GroupID: group.ID, UserID: group.CreatedBy, Role: models.RoleOwner}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, groupInfo{ID: group.ID, Name: group.Name, Role: models.RoleOwner, CreatedAt: group.CreatedAt})
+}
+
+// ListGroups lists the groups the caller belongs to
+func (h *FileHandler) ListGroups(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	groups := []groupInfo{}
+	err := h.db(c).Model(&models.Group{}).
+		Select("groups.id, groups.name, group_members.role, groups.created_at").
+		Joins("JOIN group_members ON group_members.group_id = groups.id").
+		Where("group_members.user_id = ?", userID).
+		Order("groups.name").
+		Scan(&groups).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve groups"})
+		return
+	}
+
+	c.JSON(http.StatusOK, groups)
+}
+
+func (h *FileHandler) ListMembers(c *gin.Context) {
+	group, _, ok := h.findGroup(c)
+	if !ok {
+		return
+	}
+
+	members := []memberInfo{}
+	err := h.db(c).Table("group_members").
+		Select("group_members.user_id, users.email, group_members.role, group_members.created_at AS joined_at").
+		Joins("JOIN users ON users.id = group_members.user_id").
+		Where("group_members.group_id = ?", group.ID).
+		Order("users.email").
+		Scan(&members).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve members"})
+		return
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+// InviteMember invites an email address to the group. Inviting the same
+// address again updates the role and renews the invite.
+func (h *FileHandler) InviteMember(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	group, _, ok := h.findGroup(c, models.RoleOwner)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Email string `json:"email" binding:"required"`
+		Role  string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Role == "" {
+		req.Role = models.RoleViewer
+	}
+	if !validRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be owner, editor or viewer"})
+		return
+	}
+
+	var count int64
+	h.db(c).Table("group_members").
+		Joins("JOIN users ON users.id = group_members.user_id").
+		Where("group_members.group_id = ? AND users.email = ?", group.ID, req.Email).
+		Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "User is already a member"})
+		return
+	}
+
+	invite := models.GroupInvite{
+		GroupID:   group.ID,
+		Email:     req.Email,
+		Role:      req.Role,
+		InvitedBy: userID.(uint),
+		ExpiresAt: time.Now().Add(h.GroupInviteExpiry),
+	}
+	err := h.db(c).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "group_id"}, {Name: "email"}},
+		DoUpdates: clause.AssignmentColumns([]string{"role", "invited_by", "expires_at"}),
+	}).Create(&invite).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to invite user"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Invite sent", "email": invite.Email, "role": invite.Role, "expires_at": invite.ExpiresAt})
+}
+
+// ListGroupInvites lists the pending invites of a group
+func (h *FileHandler) ListGroupInvites(c *gin.Context) {
+	group, _, ok := h.findGroup(c, models.RoleOwner)
+	if !ok {
+		return
+	}
+	h.listInvites(c, h.db(c).Where("group_invites.group_id = ?", group.ID))
+}
+
+// ListInvites lists the pending invites addressed to the caller
+func (h *FileHandler) ListInvites(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var user models.User
+	if err := h.db(c).First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	h.listInvites(c, h.db(c).Where("group_invites.email = ?", user.Email))
+}
+
+func (h *FileHandler) listInvites(c *gin.Context, query *gorm.DB) {
+	invites := []inviteInfo{}
+	err := query.Model(&models.GroupInvite{}).
+		Select("group_invites.id, group_invites.group_id, groups.name AS group_name, group_invites.email, group_invites.role, group_invites.expires_at").
+		Joins("JOIN groups ON groups.id = group_invites.group_id AND groups.deleted_at IS NULL").
+		Where("group_invites.expires_at > ?", time.Now()).
+		Order("group_invites.created_at DESC").
+		Scan(&invites).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve invites"})
+		return
+	}
+
+	c.JSON(http.StatusOK, invites)
+}
+
+// findInvite loads the invite named by the inviteID route parameter
+func (h *FileHandler) findInvite(c *gin.Context) (models.GroupInvite, models.User, bool) {
+	userID, _ := c.Get("userID")
+
+	var invite models.GroupInvite
+	var user models.User
+	if err := h.db(c).First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return invite, user, false
+	}
+	if err := h.db(c).First(&invite, c.Param("inviteID")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+		return invite, user, false
+	}
+	return invite, user, true
+}
+
+func (h *FileHandler) AcceptInvite(c *gin.Context) {
+	invite, user, ok := h.findInvite(c)
+	if !ok {
+		return
+	}
+	if !strings.EqualFold(invite.Email, user.Email) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+		return
+	}
+	if time.Now().After(invite.ExpiresAt) {
+		c.JSON(http.StatusGone, gin.H{"error": "Invite has expired"})
+		return
+	}
+
+	err := h.db(c).Transaction(func(tx *gorm.DB) error {
+		member := models.GroupMember{GroupID: invite.GroupID, UserID: user.ID, Role: invite.Role}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&member).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&invite).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept invite"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invite accepted", "group_id": invite.GroupID, "role": invite.Role})
+}
+
+// DeleteInvite declines an invite, or cancels it when called by a group owner
+func (h *FileHandler) DeleteInvite(c *gin.Context) {
+	invite, user, ok := h.findInvite(c)
+	if !ok {
+		return
+	}
+	if !strings.EqualFold(invite.Email, user.Email) {
+		var member models.GroupMember
+		err := h.db(c).Where("group_id = ? AND user_id = ? AND role = ?", invite.GroupID, user.ID, models.RoleOwner).First(&member).Error
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+			return
+		}
+	}
+
+	if err := h.db(c).Delete(&invite).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete invite"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Invite deleted"})
+}
+
+// findMember loads the member named by the userID route parameter
+func (h *FileHandler) findMember(c *gin.Context, group models.Group) (models.GroupMember, bool) {
+	var member models.GroupMember
+	err := h.db(c).Where("group_id = ? AND user_id = ?", group.ID, c.Param("userID")).First(&member).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch member"})
+		}
+		return member, false
+	}
+	return member, true
+}
+
+// lastOwner reports whether member is the only owner left in the group
+func (h *FileHandler) lastOwner(member models.GroupMember) bool {
+	if member.Role != models.RoleOwner {
+		return false
+	}
+	var owners int64
+	h.DB.Model(&models.GroupMember{}).Where("group_id = ? AND role = ?", member.GroupID, models.RoleOwner).Count(&owners)
+	return owners <= 1
+}
+
+// UpdateMember changes the role of a member
+func (h *FileHandler) UpdateMember(c *gin.Context) {
+	group, _, ok := h.findGroup(c, models.RoleOwner)
+	if !ok {
+		return
+	}
+	member, ok := h.findMember(c, group)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be owner, editor or viewer"})
+		return
+	}
+	if req.Role != models.RoleOwner && h.lastOwner(member) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A group needs at least one owner"})
+		return
+	}
+
+	if err := h.db(c).Model(&member).Update("role", req.Role).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Member updated", "user_id": member.UserID, "role": req.Role})
+}
+
+// RemoveMember removes a member from the group. Owners can remove anyone,
+// other members can only leave.
+func (h *FileHandler) RemoveMember(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	group, caller, ok := h.findGroup(c)
+	if !ok {
+		return
+	}
+	member, ok := h.findMember(c, group)
+	if !ok {
+		return
+	}
+
+	if caller.Role != models.RoleOwner && member.UserID != userID.(uint) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to do this"})
+		return
+	}
+	if h.lastOwner(member) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A group needs at least one owner"})
+		return
+	}
+
+	if err := h.db(c).Delete(&member).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"file_manage/models"
+	"file_manage/storage"
+	"file_manage/tenant"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestHandler returns a FileHandler on a temporary database, a local
+// storage directory and an in-memory Redis, with the limits NewFileHandler
+// uses by default
+func newTestHandler(t *testing.T) *FileHandler {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	t.Setenv("TUS_DIR", filepath.Join(dir, "tus"))
+
+	db := openTestDB(t, filepath.Join(dir, "file_sharing.db"))
+	if err := db.AutoMigrate(&models.User{}, &models.File{}, &models.TusUpload{}, &models.Blob{}, &models.FileVersion{}, &models.Folder{}, &models.FilePermission{}, &models.Group{}, &models.GroupMember{}, &models.GroupInvite{}, &models.Organization{}, &models.OrganizationInvite{}, &models.DropLink{}, &models.Notification{}, &models.Thumbnail{}, &models.UploadRule{}); err != nil {
+		t.Fatalf("AutoMigrate: %v", err)
+	}
+	sdb := openTestDB(t, filepath.Join(dir, "shared_files.db"))
+	if err := sdb.AutoMigrate(&SharedFile{}); err != nil {
+		t.Fatalf("AutoMigrate: %v", err)
+	}
+
+	store, err := storage.NewLocalStorage(filepath.Join(dir, "uploads"))
+	if err != nil {
+		t.Fatalf("NewLocalStorage: %v", err)
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	return &FileHandler{
+		DB:                       db,
+		SDB:                      sdb,
+		Redis:                    rdb,
+		Storage:                  store,
+		MaxRequestSize:           10 << 30,
+		MaxFileSize:              5 << 30,
+		uploadSlots:              make(chan struct{}, 4),
+		DiffMaxSize:              1 << 20,
+		TrashRetention:           30 * 24 * time.Hour,
+		ShareUnlockTTL:           15 * time.Minute,
+		GroupInviteExpiry:        7 * 24 * time.Hour,
+		OrganizationInviteExpiry: 7 * 24 * time.Hour,
+		DropLinkExpiry:           7 * 24 * time.Hour,
+		MaxArchiveFiles:          10000,
+		MaxInspectSize:           2 << 30,
+		MaxExtractSize:           1 << 30,
+		MaxArchiveEntries:        10000,
+		MaxArchiveRatio:          100,
+		MaxThumbnailPixels:       50_000_000,
+		thumbnailJobs:            make(chan uint, 1000),
+		scanJobs:                 make(chan uint, 1000),
+		MaxTextSize:              64 << 20,
+		MaxTextLength:            1 << 20,
+		textJobs:                 make(chan uint, 1000),
+	}
+}
+
+func openTestDB(t *testing.T, path string) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(path+"?_busy_timeout=5000"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	if err := tenant.Register(db); err != nil {
+		t.Fatalf("tenant.Register: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// createUser adds a user to the organization with the given slug, creating
+// the organization on first use
+func createUser(t *testing.T, h *FileHandler, slug, email string) models.User {
+	t.Helper()
+	var org models.Organization
+	if err := h.DB.Where(models.Organization{Slug: slug}).Attrs(models.Organization{Name: slug}).FirstOrCreate(&org).Error; err != nil {
+		t.Fatalf("create organization %s: %v", slug, err)
+	}
+	user := models.User{Email: email, OrganizationID: org.ID}
+	if err := h.DB.Create(&user).Error; err != nil {
+		t.Fatalf("create user %s: %v", email, err)
+	}
+	return user
+}
+
+// userContext is a context scoped to the organization of user, the way
+// AuthMiddleware scopes requests
+func userContext(user models.User) context.Context {
+	return tenant.WithOrganization(context.Background(), user.OrganizationID)
+}
+
+// uploadFile stores content as a new file of user through saveUpload
+func uploadFile(t *testing.T, h *FileHandler, user models.User, name, content string) models.File {
+	t.Helper()
+	target := uploadTarget{OrganizationID: user.OrganizationID, UserID: user.ID}
+	file, _, err := h.saveUpload(userContext(user), target, name, bytes.NewReader([]byte(content)), nil)
+	if err != nil {
+		t.Fatalf("upload %s: %v", name, err)
+	}
+	return *file
+}
+
+// testAuth stands in for AuthMiddleware, taking the caller from the
+// X-User-ID header. Requests without it stay anonymous.
+func testAuth(h *FileHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.GetHeader("X-User-ID"), 10, 64)
+		if id == 0 {
+			c.Next()
+			return
+		}
+		var user models.User
+		if err := h.DB.First(&user, id).Error; err != nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Set("userID", user.ID)
+		c.Set("orgID", user.OrganizationID)
+		c.Set("userRole", user.Role)
+		c.Request = c.Request.WithContext(tenant.WithOrganization(c.Request.Context(), user.OrganizationID))
+		c.Next()
+	}
+}
+
+// testRouter routes the handlers under test like main.go does
+func testRouter(h *FileHandler) *gin.Engine {
+	r := gin.New()
+	r.GET("/download/:token", h.DownloadFile)
+	r.HEAD("/download/:token", h.DownloadFile)
+	r.POST("/download/:token/unlock", h.UnlockShareLink)
+
+	authorized := r.Group("/", testAuth(h))
+	authorized.POST("/share/:fileID", h.ShareFile)
+	authorized.POST("/files/:fileID/versions", h.UploadVersion)
+	authorized.GET("/files/:fileID/diff", h.DiffVersions)
+	authorized.POST("/files/:fileID/extract", h.ExtractArchive)
+	authorized.GET("/delete/:fileID", h.DeleteFile)
+	authorized.DELETE("/trash/:fileID", h.DeleteFilePermanently)
+
+	tus := authorized.Group("/uploads", h.TusMiddleware())
+	tus.POST("", h.TusCreate)
+	tus.HEAD("/:uploadID", h.TusHead)
+	tus.PATCH("/:uploadID", h.TusPatch)
+	tus.DELETE("/:uploadID", h.TusDelete)
+	return r
+}
+
+// do sends a request as user, or anonymously with a zero user
+func do(r http.Handler, user models.User, method, target string, body io.Reader, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	if user.ID != 0 {
+		req.Header.Set("X-User-ID", fmt.Sprint(user.ID))
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
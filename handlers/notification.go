@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"file_manage/models"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type notificationInfo struct {
+	ID        uint       `json:"id"`
+	Kind      string     `json:"kind"`
+	Message   string     `json:"message"`
+	FileIDs   []uint     `json:"file_ids"`
+	ReadAt    *time.Time `json:"read_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// notify records a notification for a user about files
+func (h *FileHandler) notify(ctx context.Context, userID uint, kind, message string, files []models.File) {
+	ids := make([]string, 0, len(files))
+	for _, file := range files {
+		ids = append(ids, strconv.FormatUint(uint64(file.ID), 10))
+	}
+	notification := models.Notification{
+		UserID:  userID,
+		Kind:    kind,
+		Message: message,
+		FileIDs: strings.Join(ids, ","),
+	}
+	if err := h.DB.WithContext(ctx).Create(&notification).Error; err != nil {
+		fmt.Println("Error creating notification:", err)
+	}
+}
+
+// ListNotifications returns the caller's latest notifications, only the
+// unread ones with unread=true
+func (h *FileHandler) ListNotifications(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	query := h.db(c).Where("user_id = ?", userID)
+	if c.Query("unread") == "true" {
+		query = query.Where("read_at IS NULL")
+	}
+	var notifications []models.Notification
+	if err := query.Order("created_at DESC").Limit(100).Find(&notifications).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve notifications"})
+		return
+	}
+
+	infos := make([]notificationInfo, 0, len(notifications))
+	for _, n := range notifications {
+		info := notificationInfo{ID: n.ID, Kind: n.Kind, Message: n.Message, FileIDs: []uint{}, ReadAt: n.ReadAt, CreatedAt: n.CreatedAt}
+		for _, id := range strings.Split(n.FileIDs, ",") {
+			if fileID, err := strconv.ParseUint(id, 10, 64); err == nil {
+				info.FileIDs = append(info.FileIDs, uint(fileID))
+			}
+		}
+		infos = append(infos, info)
+	}
+	c.JSON(http.StatusOK, infos)
+}
+
+// MarkNotificationRead marks one of the caller's notifications as read
+func (h *FileHandler) MarkNotificationRead(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	result := h.db(c).Model(&models.Notification{}).
+		Where("id = ? AND user_id = ? AND read_at IS NULL", c.Param("notificationID"), userID).
+		Update("read_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notification"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Notification marked as read"})
+}
@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"file_manage/models"
+	"file_manage/tenant"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errTypeNotAllowed = errors.New("file type is not allowed")
+	errQuotaExceeded  = errors.New("storage quota exceeded")
+)
+
+// db is the database scoped to the tenant of the request, see package tenant
+func (h *FileHandler) db(c *gin.Context) *gorm.DB {
+	return h.DB.WithContext(c.Request.Context())
+}
+
+// sdb is the share link database scoped to the tenant of the request
+func (h *FileHandler) sdb(c *gin.Context) *gorm.DB {
+	return h.SDB.WithContext(c.Request.Context())
+}
+
+// organization loads the organization ctx is scoped to. Without a tenant
+// it returns an organization without limits.
+func (h *FileHandler) organization(ctx context.Context) (models.Organization, error) {
+	var org models.Organization
+	id, ok := tenant.FromContext(ctx)
+	if !ok {
+		return org, nil
+	}
+	err := h.DB.First(&org, id).Error
+	return org, err
+}
+
+// splitTypes parses a comma separated list of file extensions, nil for any
+func splitTypes(list string) []string {
+	var types []string
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(t), ".")); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// hasType reports whether name has one of the extensions, any if there are none
+func hasType(types []string, name string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	extension := ""
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		extension = strings.ToLower(name[i+1:])
+	}
+	for _, t := range types {
+		if t == extension {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadErrorStatus maps errors from the upload path to a response status
+func uploadErrorStatus(err error) int {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errFileTooLarge) || errors.As(err, &maxErr):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errTypeNotAllowed):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, errQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, errDropLinkFull):
+		return http.StatusGone
+	}
+	return http.StatusInternalServerError
+}
+
+type organizationInfo struct {
+	ID             uint     `json:"id"`
+	Name           string   `json:"name"`
+	Slug           string   `json:"slug"`
+	MaxShareExpiry string   `json:"max_share_expiry"`
+	AllowedTypes   []string `json:"allowed_types"`
+	QuotaBytes     int64    `json:"quota_bytes"`
+	UsedBytes      int64    `json:"used_bytes"`
+}
+
+// GetOrganization returns the caller's organization and its settings
+func (h *FileHandler) GetOrganization(c *gin.Context) {
+	org, err := h.organization(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return
+	}
+	info := organizationInfo{
+		ID:           org.ID,
+		Name:         org.Name,
+		Slug:         org.Slug,
+		AllowedTypes: splitTypes(org.AllowedTypes),
+		QuotaBytes:   org.QuotaBytes,
+		UsedBytes:    org.UsedBytes,
+	}
+	if org.MaxShareExpiry > 0 {
+		info.MaxShareExpiry = org.MaxShareExpiry.String()
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// organizationSettings are the settings admins manage themselves. Limits
+// like the quota and the share link expiry are set by the operator with the
+// set-organization-limits maintenance command.
+type organizationSettings struct {
+	AllowedTypes *[]string `json:"allowed_types"` // empty allows every type
+}
+
+// UpdateOrganization changes the settings of the caller's organization
+func (h *FileHandler) UpdateOrganization(c *gin.Context) {
+	org, err := h.organization(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return
+	}
+
+	var req organizationSettings
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if req.AllowedTypes != nil {
+		updates["allowed_types"] = strings.Join(*req.AllowedTypes, ",")
+	}
+
+	if len(updates) > 0 {
+		if err := h.DB.Model(&org).Updates(updates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update organization"})
+			return
+		}
+	}
+	h.GetOrganization(c)
+}
+
+// InviteToOrganization lets an email address register into the caller's
+// organization. Inviting the same address again renews the invite.
+func (h *FileHandler) InviteToOrganization(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var req struct {
+		Email string `json:"email" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var count int64
+	h.db(c).Model(&models.User{}).Where("LOWER(email) = LOWER(?)", req.Email).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "User is already a member"})
+		return
+	}
+
+	invite := models.OrganizationInvite{
+		Email:     req.Email,
+		InvitedBy: userID.(uint),
+		ExpiresAt: time.Now().Add(h.OrganizationInviteExpiry),
+	}
+	err := h.db(c).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "email"}, {Name: "organization_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"invited_by", "expires_at"}),
+	}).Create(&invite).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to invite user"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Invite sent", "email": invite.Email, "expires_at": invite.ExpiresAt})
+}
+
+// ListOrganizationInvites lists the pending invites into the caller's organization
+func (h *FileHandler) ListOrganizationInvites(c *gin.Context) {
+	var invites []models.OrganizationInvite
+	if err := h.db(c).Where("expires_at > ?", time.Now()).Order("created_at DESC").Find(&invites).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve invites"})
+		return
+	}
+	c.JSON(http.StatusOK, invites)
+}
+
+// DeleteOrganizationInvite cancels an invite into the caller's organization
+func (h *FileHandler) DeleteOrganizationInvite(c *gin.Context) {
+	result := h.db(c).Delete(&models.OrganizationInvite{}, c.Param("inviteID"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete invite"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Invite deleted"})
+}
+
+// MigrateOrganizations moves everything created before organizations
+// existed into the default organization, creating it if needed
+func (h *FileHandler) MigrateOrganizations() error {
+	org := models.Organization{Name: "Default", Slug: models.DefaultOrganization}
+	if err := h.DB.Where("slug = ?", org.Slug).FirstOrCreate(&org).Error; err != nil {
+		return err
+	}
+
+	tables := []interface{}{
+		&models.User{}, &models.Group{}, &models.GroupInvite{}, &models.Folder{},
+		&models.File{}, &models.Blob{}, &models.TusUpload{},
+	}
+	for _, table := range tables {
+		err := h.DB.Unscoped().Model(table).Where("organization_id = 0 OR organization_id IS NULL").
+			UpdateColumn("organization_id", org.ID).Error
+		if err != nil {
+			return err
+		}
+	}
+	err := h.SDB.Model(&SharedFile{}).Where("organization_id = 0 OR organization_id IS NULL").
+		UpdateColumn("organization_id", org.ID).Error
+	if err != nil {
+		return err
+	}
+
+	// Users from before roles existed are members
+	return h.DB.Model(&models.User{}).Where("role = '' OR role IS NULL").
+		UpdateColumn("role", models.UserRoleMember).Error
+}
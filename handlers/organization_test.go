@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"file_manage/models"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestOtherOrganizationsFilesAreHidden(t *testing.T) {
+	h := newTestHandler(t)
+	alice := createUser(t, h, "acme", "alice@example.com")
+	mallory := createUser(t, h, "initech", "mallory@example.com")
+	file := uploadFile(t, h, alice, "plans.txt", "world domination")
+	r := testRouter(h)
+
+	for _, req := range []struct{ method, target string }{
+		{http.MethodPost, fmt.Sprintf("/share/%d", file.ID)},
+		{http.MethodGet, fmt.Sprintf("/files/%d/diff?from=1&to=1", file.ID)},
+		{http.MethodGet, fmt.Sprintf("/delete/%d", file.ID)},
+	} {
+		if w := do(r, mallory, req.method, req.target, nil, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s from another organization: status %d, want 404", req.method, req.target, w.Code)
+		}
+	}
+
+	var current models.File
+	if err := h.DB.First(&current, file.ID).Error; err != nil {
+		t.Fatalf("file of acme is gone: %v", err)
+	}
+}
+
+func TestDeduplicationStaysWithinOrganization(t *testing.T) {
+	h := newTestHandler(t)
+	alice := createUser(t, h, "acme", "alice@example.com")
+	anna := createUser(t, h, "acme", "anna@example.com")
+	mallory := createUser(t, h, "initech", "mallory@example.com")
+
+	first := uploadFile(t, h, alice, "a.txt", "same content")
+	second := uploadFile(t, h, anna, "b.txt", "same content")
+	other := uploadFile(t, h, mallory, "c.txt", "same content")
+
+	if first.BlobID != second.BlobID {
+		t.Errorf("identical files within acme use blobs %d and %d, want one", first.BlobID, second.BlobID)
+	}
+	if other.BlobID == first.BlobID {
+		t.Error("identical files of different organizations share a blob")
+	}
+}
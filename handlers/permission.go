@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"file_manage/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// access is what a user may do with a file, each level includes the ones
+// below it
+type access int
+
+const (
+	accessNone access = iota
+	accessRead
+	accessWrite
+	accessOwner
+)
+
+// fileAccess works out what a user may do with a file. Every handler that
+// acts on a file for a user goes through here or accessibleFiles.
+func (h *FileHandler) fileAccess(userID uint, file models.File) access {
+	granted := accessNone
+	if file.GroupID != nil {
+		// The group decides, not who uploaded the file
+		granted = h.groupAccess(userID, *file.GroupID)
+	} else if file.UserID == userID {
+		granted = accessOwner
+	}
+	if granted == accessOwner {
+		return granted
+	}
+
+	var permission models.FilePermission
+	if err := h.DB.Where("file_id = ? AND user_id = ?", file.ID, userID).First(&permission).Error; err != nil {
+		return granted
+	}
+	if permission.Permission == models.PermissionWrite {
+		return accessWrite
+	}
+	return max(granted, accessRead)
+}
+
+// ownsFile reports whether a user has full control over a file
+func (h *FileHandler) ownsFile(userID interface{}, file models.File) bool {
+	return h.fileAccess(userID.(uint), file) == accessOwner
+}
+
+// accessibleFiles scopes a files query to the files a user can read
+func (h *FileHandler) accessibleFiles(userID interface{}) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		shared := h.DB.Model(&models.FilePermission{}).Select("file_id").Where("user_id = ?", userID)
+		groups := h.DB.Model(&models.GroupMember{}).Select("group_id").Where("user_id = ?", userID)
+		return db.Where("(files.user_id = ? AND files.group_id IS NULL) OR files.id IN (?) OR files.group_id IN (?)", userID, shared, groups)
+	}
+}
+
+// findFile loads the file named by the fileID route parameter if the user
+// has at least the needed access to it. Users who can't see the file at all
+// get a 404 so file IDs don't leak.
+func (h *FileHandler) findFile(c *gin.Context, need access) (models.File, bool) {
+	userID, _ := c.Get("userID")
+
+	var file models.File
+	fileID, err := strconv.Atoi(c.Param("fileID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return file, false
+	}
+
+	if err := h.db(c).First(&file, fileID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch file information"})
+		}
+		return file, false
+	}
+
+	granted := h.fileAccess(userID.(uint), file)
+	if granted == accessNone {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return file, false
+	}
+	if granted < need {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to do this"})
+		return file, false
+	}
+	return file, true
+}
+
+type permissionRequest struct {
+	Email      string `json:"email" binding:"required"`
+	Permission string `json:"permission"`
+}
+
+type permissionInfo struct {
+	UserID     uint      `json:"user_id"`
+	Email      string    `json:"email"`
+	Permission string    `json:"permission"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// GrantPermission shares a file with another registered user, or changes
+// the permission they already have
+func (h *FileHandler) GrantPermission(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	file, ok := h.findFile(c, accessOwner)
+	if !ok {
+		return
+	}
+
+	var req permissionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Permission == "" {
+		req.Permission = models.PermissionRead
+	}
+	if req.Permission != models.PermissionRead && req.Permission != models.PermissionWrite {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Permission must be read or write"})
+		return
+	}
+
+	var recipient models.User
+	if err := h.db(c).Where("email = ?", req.Email).First(&recipient).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if h.ownsFile(recipient.ID, file) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User already has full access to this file"})
+		return
+	}
+
+	permission := models.FilePermission{
+		FileID:     file.ID,
+		UserID:     recipient.ID,
+		Permission: req.Permission,
+		GrantedBy:  userID.(uint),
+	}
+	err := h.db(c).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "file_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"permission", "granted_by", "updated_at"}),
+	}).Create(&permission).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to share file"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "File shared successfully", "user_id": recipient.ID, "permission": req.Permission})
+}
+
+// ListPermissions lists the users a file is shared with
+func (h *FileHandler) ListPermissions(c *gin.Context) {
+	file, ok := h.findFile(c, accessOwner)
+	if !ok {
+		return
+	}
+
+	permissions := []permissionInfo{}
+	err := h.db(c).Table("file_permissions").
+		Select("file_permissions.user_id, users.email, file_permissions.permission, file_permissions.created_at").
+		Joins("JOIN users ON users.id = file_permissions.user_id").
+		Where("file_permissions.file_id = ?", file.ID).
+		Order("users.email").
+		Scan(&permissions).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve permissions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, permissions)
+}
+
+// RevokePermission stops sharing a file with a user. Recipients may also
+// remove files shared with them.
+func (h *FileHandler) RevokePermission(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	file, ok := h.findFile(c, accessRead)
+	if !ok {
+		return
+	}
+
+	recipientID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	if !h.ownsFile(userID, file) && uint(recipientID) != userID.(uint) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to do this"})
+		return
+	}
+
+	result := h.db(c).Where("file_id = ? AND user_id = ?", file.ID, recipientID).Delete(&models.FilePermission{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke permission"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File is not shared with this user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Permission revoked"})
+}
+
+type sharedFileInfo struct {
+	models.File
+	Permission string `json:"permission"`
+	OwnerEmail string `json:"owner_email"`
+}
+
+// GetSharedFiles lists the files other users have shared with the caller
+func (h *FileHandler) GetSharedFiles(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	files := []sharedFileInfo{}
+	err := h.db(c).Model(&models.File{}).
+		Select("files.*, file_permissions.permission, users.email AS owner_email").
+		Joins("JOIN file_permissions ON file_permissions.file_id = files.id").
+		Joins("JOIN users ON users.id = files.user_id").
+		Where("file_permissions.user_id = ?", userID).
+		Order("files.name").
+		Scan(&files).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve shared files"})
+		return
+	}
+
+	c.JSON(http.StatusOK, files)
+}
+
+// DownloadSharedFile downloads the current content of a file the caller
+// owns or that was shared with them, using their own token
+func (h *FileHandler) DownloadSharedFile(c *gin.Context) {
+	file, ok := h.findFile(c, accessRead)
+	if !ok {
+		return
+	}
+
+	var blob models.Blob
+	if err := h.db(c).First(&blob, file.BlobID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	h.serveBlob(c, blob, file.Name, h.contentModified(c, file))
+}
+
+// revokePermissions removes every grant on a file that is deleted for good
+func (h *FileHandler) revokePermissions(ctx context.Context, fileID uint) error {
+	return h.DB.WithContext(ctx).Where("file_id = ?", fileID).Delete(&models.FilePermission{}).Error
+}
+
+// linkOwnerCanRead reports whether the user who created a share link can
+// still read the file, links die with the creator's access
+func (h *FileHandler) linkOwnerCanRead(ownerID string, file models.File) bool {
+	id, err := strconv.ParseUint(ownerID, 10, 64)
+	if err != nil || id == 0 {
+		// Links from before owners were recorded
+		return true
+	}
+	return h.fileAccess(uint(id), file) != accessNone
+}
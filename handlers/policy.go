@@ -0,0 +1,472 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"file_manage/models"
+	"file_manage/utils"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// The upload policy of an organization is a set of UploadRules. Names are
+// checked before anything is read, the type once the first bytes are sniffed
+// and sizes while the content is streamed, so rejected files never reach
+// storage. Rules of a user only restrict them further.
+
+// Codes of a policyViolation
+const (
+	policyDenied     = "denied"      // a deny rule matched
+	policyNotAllowed = "not_allowed" // no allow rule matched
+	policyTooLarge   = "too_large"   // larger than a limit rule allows
+)
+
+// policyViolation is why the upload policy rejected a file
+type policyViolation struct {
+	File   string `json:"file"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+	RuleID uint   `json:"rule_id,omitempty"` // 0 for the organization's allowed_types
+}
+
+func (v *policyViolation) Error() string {
+	return fmt.Sprintf("%s: %s", v.File, v.Reason)
+}
+
+// Is lets uploadErrorStatus and the callers of saveUpload treat violations
+// like the type and size errors they already know
+func (v *policyViolation) Is(target error) bool {
+	if v.Code == policyTooLarge {
+		return target == errFileTooLarge
+	}
+	return target == errTypeNotAllowed
+}
+
+// uploadPolicy is everything that decides which files a user may upload
+type uploadPolicy struct {
+	allowedTypes []string // the organization's allowed_types setting
+	rules        []models.UploadRule
+}
+
+// uploadPolicy loads the policy for uploads by a user of an organization
+func (h *FileHandler) uploadPolicy(organizationID, userID uint) (uploadPolicy, error) {
+	var policy uploadPolicy
+	var org models.Organization
+	if err := h.DB.Select("id", "allowed_types").First(&org, organizationID).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return policy, err
+	}
+	policy.allowedTypes = splitTypes(org.AllowedTypes)
+	err := h.DB.Where("organization_id = ? AND (user_id IS NULL OR user_id = ?)", organizationID, userID).
+		Order("id").Find(&policy.rules).Error
+	return policy, err
+}
+
+// matchRule tells whether a file matches the conditions of a rule. Without
+// its type, known is false for rules with conditions on the type.
+func matchRule(rule models.UploadRule, name string, t *utils.FileType) (matched, known bool) {
+	if rule.Extensions != "" && !hasType(splitTypes(rule.Extensions), name) {
+		return false, true
+	}
+	if rule.NamePattern != "" {
+		if ok, _ := path.Match(strings.ToLower(rule.NamePattern), strings.ToLower(name)); !ok {
+			return false, true
+		}
+	}
+	if rule.MimeTypes == "" && rule.Categories == "" {
+		return true, true
+	}
+	if t == nil {
+		return false, false
+	}
+	if rule.MimeTypes != "" && !matchMimeType(splitTypes(rule.MimeTypes), t.MimeType) {
+		return false, true
+	}
+	if rule.Categories != "" && !hasEntry(splitTypes(rule.Categories), t.Category) {
+		return false, true
+	}
+	return true, true
+}
+
+// matchMimeType matches a MIME type against a list that may hold wildcards
+// like "image/*"
+func matchMimeType(patterns []string, mimeType string) bool {
+	for _, pattern := range patterns {
+		if pattern == mimeType || pattern == "*/*" ||
+			(strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasEntry(list []string, value string) bool {
+	for _, entry := range list {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleReason(rule models.UploadRule, fallback string) string {
+	if rule.Reason != "" {
+		return rule.Reason
+	}
+	return fallback
+}
+
+// check returns why the policy rejects a file, nil if it doesn't. Without
+// the file's type only what can be decided from its name is checked.
+func (p uploadPolicy) check(name string, t *utils.FileType) *policyViolation {
+	if !hasType(p.allowedTypes, name) {
+		return &policyViolation{File: name, Code: policyNotAllowed, Reason: "Files of this type are not allowed in this organization"}
+	}
+
+	for _, rule := range p.rules {
+		if rule.Action != models.UploadRuleDeny {
+			continue
+		}
+		if matched, known := matchRule(rule, name, t); matched && known {
+			return &policyViolation{File: name, Code: policyDenied, RuleID: rule.ID, Reason: ruleReason(rule, "Files like this are blocked")}
+		}
+	}
+
+	// The organization's allow rules and the user's are separate lists,
+	// a file must be on both when both exist
+	for _, forUser := range []bool{false, true} {
+		var last *models.UploadRule
+		allowed := false
+		for i, rule := range p.rules {
+			if rule.Action != models.UploadRuleAllow || (rule.UserID != nil) != forUser {
+				continue
+			}
+			last = &p.rules[i]
+			if matched, known := matchRule(rule, name, t); matched || !known {
+				allowed = true
+				break
+			}
+		}
+		if last != nil && !allowed {
+			return &policyViolation{File: name, Code: policyNotAllowed, RuleID: last.ID, Reason: ruleReason(*last, "Files of this type are not allowed")}
+		}
+	}
+	return nil
+}
+
+// limit returns the smallest limit rule matching a file, nil for none
+func (p uploadPolicy) limit(name string, t *utils.FileType) *models.UploadRule {
+	var smallest *models.UploadRule
+	for i, rule := range p.rules {
+		if rule.Action != models.UploadRuleLimit {
+			continue
+		}
+		if matched, _ := matchRule(rule, name, t); matched && (smallest == nil || rule.MaxBytes < smallest.MaxBytes) {
+			smallest = &p.rules[i]
+		}
+	}
+	return smallest
+}
+
+func tooLarge(name string, rule models.UploadRule) *policyViolation {
+	return &policyViolation{
+		File:   name,
+		Code:   policyTooLarge,
+		RuleID: rule.ID,
+		Reason: ruleReason(rule, fmt.Sprintf("Files like this may be at most %d bytes", rule.MaxBytes)),
+	}
+}
+
+// policyLimitReader fails with a violation once a file grows past a limit rule
+type policyLimitReader struct {
+	r    io.Reader
+	n    int64
+	name string
+	rule models.UploadRule
+}
+
+func (l *policyLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.rule.MaxBytes {
+		return n, tooLarge(l.name, l.rule)
+	}
+	return n, err
+}
+
+// admitUpload applies the upload policy to a file uploaded by a user. It
+// sniffs the first bytes of r and returns a reader that yields all of it
+// again and stops the upload once the file exceeds a limit rule.
+func (h *FileHandler) admitUpload(organizationID, userID uint, name string, r io.Reader) (io.Reader, error) {
+	policy, err := h.uploadPolicy(organizationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if violation := policy.check(name, nil); violation != nil {
+		return nil, violation
+	}
+
+	head := make([]byte, utils.SniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	t := utils.DetectType(name, utils.SniffType(head))
+	if violation := policy.check(name, &t); violation != nil {
+		return nil, violation
+	}
+
+	r = io.MultiReader(bytes.NewReader(head), r)
+	if rule := policy.limit(name, &t); rule != nil {
+		r = &policyLimitReader{r: r, name: name, rule: *rule}
+	}
+	return r, nil
+}
+
+// checkFileType applies the upload policy to a file that is renamed or
+// copied, or whose content is still to come. t is nil when the type isn't
+// known yet.
+func (h *FileHandler) checkFileType(organizationID, userID uint, name string, t *utils.FileType) error {
+	policy, err := h.uploadPolicy(organizationID, userID)
+	if err != nil {
+		return err
+	}
+	if violation := policy.check(name, t); violation != nil {
+		return violation
+	}
+	return nil
+}
+
+// checkFileSize applies the limit rules to a file whose size is known up front
+func (h *FileHandler) checkFileSize(organizationID, userID uint, name string, size int64) error {
+	policy, err := h.uploadPolicy(organizationID, userID)
+	if err != nil {
+		return err
+	}
+	if rule := policy.limit(name, nil); rule != nil && size > rule.MaxBytes {
+		return tooLarge(name, *rule)
+	}
+	return nil
+}
+
+// rejectFile responds to a request for a single file that failed, with the
+// structured rejection when the upload policy is why
+func rejectFile(c *gin.Context, err error) {
+	var violation *policyViolation
+	if errors.As(err, &violation) {
+		c.JSON(uploadErrorStatus(err), gin.H{"error": violation.Error(), "rejection": violation})
+		return
+	}
+	c.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
+}
+
+type uploadRuleInfo struct {
+	ID          uint      `json:"id"`
+	UserID      *uint     `json:"user_id"`
+	Action      string    `json:"action"`
+	MimeTypes   []string  `json:"mime_types"`
+	Extensions  []string  `json:"extensions"`
+	Categories  []string  `json:"categories"`
+	NamePattern string    `json:"name_pattern"`
+	MaxBytes    int64     `json:"max_bytes,omitempty"`
+	Reason      string    `json:"reason"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func newUploadRuleInfo(rule models.UploadRule) uploadRuleInfo {
+	return uploadRuleInfo{
+		ID:          rule.ID,
+		UserID:      rule.UserID,
+		Action:      rule.Action,
+		MimeTypes:   splitTypes(rule.MimeTypes),
+		Extensions:  splitTypes(rule.Extensions),
+		Categories:  splitTypes(rule.Categories),
+		NamePattern: rule.NamePattern,
+		MaxBytes:    rule.MaxBytes,
+		Reason:      rule.Reason,
+		CreatedAt:   rule.CreatedAt,
+		UpdatedAt:   rule.UpdatedAt,
+	}
+}
+
+var uploadCategories = []string{
+	utils.CategoryImage, utils.CategoryVideo, utils.CategoryAudio, utils.CategoryDocument, utils.CategoryArchive,
+	utils.CategoryText, utils.CategoryFont, utils.CategoryExecutable, utils.CategoryOther,
+}
+
+type uploadRuleRequest struct {
+	UserID      *uint    `json:"user_id"` // empty for everyone in the organization
+	Action      string   `json:"action"`
+	MimeTypes   []string `json:"mime_types"`
+	Extensions  []string `json:"extensions"`
+	Categories  []string `json:"categories"`
+	NamePattern string   `json:"name_pattern"`
+	MaxBytes    int64    `json:"max_bytes"`
+	Reason      string   `json:"reason"`
+}
+
+// bindUploadRule reads and validates a rule from the request body
+func (h *FileHandler) bindUploadRule(c *gin.Context, rule *models.UploadRule) bool {
+	var req uploadRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+
+	switch req.Action {
+	case models.UploadRuleAllow, models.UploadRuleDeny:
+		if req.MaxBytes != 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "max_bytes is only used by limit rules"})
+			return false
+		}
+	case models.UploadRuleLimit:
+		if req.MaxBytes <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Limit rules need a max_bytes of 1 or more"})
+			return false
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "action must be allow, deny or limit"})
+		return false
+	}
+
+	mimeTypes := splitTypes(strings.Join(req.MimeTypes, ","))
+	for _, mimeType := range mimeTypes {
+		if strings.Count(mimeType, "/") != 1 || strings.HasPrefix(mimeType, "/") || strings.HasSuffix(mimeType, "/") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid MIME type %q", mimeType)})
+			return false
+		}
+	}
+	categories := splitTypes(strings.Join(req.Categories, ","))
+	for _, category := range categories {
+		if !hasEntry(uploadCategories, category) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown category %q, use one of %s", category, strings.Join(uploadCategories, ", "))})
+			return false
+		}
+	}
+	if _, err := path.Match(req.NamePattern, ""); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name_pattern"})
+		return false
+	}
+	if req.UserID != nil {
+		if err := h.db(c).First(&models.User{}, *req.UserID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+			return false
+		}
+	}
+
+	rule.UserID = req.UserID
+	rule.Action = req.Action
+	rule.MimeTypes = strings.Join(mimeTypes, ",")
+	rule.Extensions = strings.Join(splitTypes(strings.Join(req.Extensions, ",")), ",")
+	rule.Categories = strings.Join(categories, ",")
+	rule.NamePattern = req.NamePattern
+	rule.MaxBytes = req.MaxBytes
+	rule.Reason = req.Reason
+	return true
+}
+
+func (h *FileHandler) findUploadRule(c *gin.Context) (models.UploadRule, bool) {
+	var rule models.UploadRule
+	ruleID, err := strconv.ParseUint(c.Param("ruleID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule ID"})
+		return rule, false
+	}
+	if err := h.db(c).First(&rule, ruleID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch rule"})
+		}
+		return rule, false
+	}
+	return rule, true
+}
+
+// ListUploadRules lists the upload policy of the organization, only the
+// rules of one user and those of everyone with ?user_id=
+func (h *FileHandler) ListUploadRules(c *gin.Context) {
+	query := h.db(c).Order("id")
+	if c.Query("user_id") != "" {
+		userID, err := strconv.ParseUint(c.Query("user_id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+		query = query.Where("user_id IS NULL OR user_id = ?", userID)
+	}
+
+	var rules []models.UploadRule
+	if err := query.Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch rules"})
+		return
+	}
+	infos := make([]uploadRuleInfo, 0, len(rules))
+	for _, rule := range rules {
+		infos = append(infos, newUploadRuleInfo(rule))
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": infos})
+}
+
+// GetUploadPolicy lists the upload rules that apply to the caller, so
+// clients can tell which files will be rejected before sending them
+func (h *FileHandler) GetUploadPolicy(c *gin.Context) {
+	policy, err := h.uploadPolicy(c.GetUint("orgID"), c.GetUint("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch upload policy"})
+		return
+	}
+	infos := make([]uploadRuleInfo, 0, len(policy.rules))
+	for _, rule := range policy.rules {
+		infos = append(infos, newUploadRuleInfo(rule))
+	}
+	c.JSON(http.StatusOK, gin.H{"allowed_types": policy.allowedTypes, "rules": infos})
+}
+
+// CreateUploadRule adds a rule to the upload policy of the organization
+func (h *FileHandler) CreateUploadRule(c *gin.Context) {
+	var rule models.UploadRule
+	if !h.bindUploadRule(c, &rule) {
+		return
+	}
+	if err := h.db(c).Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create rule"})
+		return
+	}
+	c.JSON(http.StatusCreated, newUploadRuleInfo(rule))
+}
+
+// UpdateUploadRule replaces a rule of the upload policy
+func (h *FileHandler) UpdateUploadRule(c *gin.Context) {
+	rule, ok := h.findUploadRule(c)
+	if !ok || !h.bindUploadRule(c, &rule) {
+		return
+	}
+	if err := h.db(c).Save(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update rule"})
+		return
+	}
+	c.JSON(http.StatusOK, newUploadRuleInfo(rule))
+}
+
+// DeleteUploadRule removes a rule from the upload policy
+func (h *FileHandler) DeleteUploadRule(c *gin.Context) {
+	rule, ok := h.findUploadRule(c)
+	if !ok {
+		return
+	}
+	if err := h.db(c).Delete(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete rule"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Rule deleted"})
+}
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"errors"
+	"file_manage/models"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Storage usage is the size of every retained version of the files a user
+// owns, trash included, plus space reserved for uploads still being written. It is kept
+// in used_bytes counters on users and organizations, which change in the
+// same transaction as the files they account for. Growing a counter is a
+// conditional update, so concurrent uploads can't take a user or an
+// organization past its quota.
+
+// reservation is space set aside before the bytes of an upload are written.
+// Files created with it take their size from it first, whatever is left is
+// given back by release.
+type reservation struct {
+	UserID         uint
+	OrganizationID uint
+	Bytes          int64
+}
+
+// adjustUsage changes the usage of a user and their organization by delta,
+// failing with errQuotaExceeded if either would go over its quota
+func adjustUsage(tx *gorm.DB, userID, organizationID uint, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	if delta < 0 {
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).
+			UpdateColumn("used_bytes", gorm.Expr("used_bytes + ?", delta)).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Organization{}).Where("id = ?", organizationID).
+			UpdateColumn("used_bytes", gorm.Expr("used_bytes + ?", delta)).Error
+	}
+
+	result := tx.Model(&models.User{}).
+		Where("id = ? AND (quota_bytes = 0 OR used_bytes + ? <= quota_bytes)", userID, delta).
+		UpdateColumn("used_bytes", gorm.Expr("used_bytes + ?", delta))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errQuotaExceeded
+	}
+	if organizationID == 0 {
+		return nil
+	}
+	result = tx.Model(&models.Organization{}).
+		Where("id = ? AND (quota_bytes = 0 OR used_bytes + ? <= quota_bytes)", organizationID, delta).
+		UpdateColumn("used_bytes", gorm.Expr("used_bytes + ?", delta))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// chargeUsage accounts for delta bytes of file content inside tx, taking
+// them from res first. It returns how much came from res, which the caller
+// deducts from it once tx has committed.
+func chargeUsage(tx *gorm.DB, userID, organizationID uint, delta int64, res *reservation) (int64, error) {
+	var covered int64
+	if res != nil && delta > 0 {
+		covered = delta
+		if covered > res.Bytes {
+			covered = res.Bytes
+		}
+	}
+	return covered, adjustUsage(tx, userID, organizationID, delta-covered)
+}
+
+// reserve sets space aside for an upload of up to size bytes
+func (h *FileHandler) reserve(userID, organizationID uint, size int64) (*reservation, error) {
+	res := &reservation{UserID: userID, OrganizationID: organizationID}
+	if size <= 0 {
+		return res, nil
+	}
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		return adjustUsage(tx, userID, organizationID, size)
+	})
+	if err != nil {
+		return nil, err
+	}
+	res.Bytes = size
+	return res, nil
+}
+
+// release gives back what is left of a reservation
+func (h *FileHandler) release(res *reservation) {
+	if res == nil || res.Bytes <= 0 {
+		return
+	}
+	if err := adjustUsage(h.DB, res.UserID, res.OrganizationID, -res.Bytes); err != nil {
+		fmt.Println("Error releasing reserved space:", err)
+		return
+	}
+	res.Bytes = 0
+}
+
+// RecalculateUsage rebuilds the usage counters from the file versions and
+// the tus uploads still in progress, correcting any drift
+func (h *FileHandler) RecalculateUsage() error {
+	usage := `COALESCE((SELECT SUM(file_versions.size) FROM file_versions
+		JOIN files ON files.id = file_versions.file_id WHERE files.user_id = users.id), 0) +
+		COALESCE((SELECT SUM(length) FROM tus_uploads WHERE tus_uploads.user_id = users.id AND tus_uploads.file_id = 0), 0)`
+	if err := h.DB.Exec("UPDATE users SET used_bytes = " + usage).Error; err != nil {
+		return err
+	}
+	return h.DB.Exec(`UPDATE organizations SET used_bytes = COALESCE((SELECT SUM(used_bytes) FROM users
+		WHERE users.organization_id = organizations.id), 0)`).Error
+}
+
+type quotaInfo struct {
+	UsedBytes      int64  `json:"used_bytes"`
+	QuotaBytes     int64  `json:"quota_bytes"`
+	RemainingBytes *int64 `json:"remaining_bytes"` // null without a quota
+}
+
+func newQuotaInfo(used, quota int64) quotaInfo {
+	info := quotaInfo{UsedBytes: used, QuotaBytes: quota}
+	if quota > 0 {
+		remaining := quota - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		info.RemainingBytes = &remaining
+	}
+	return info
+}
+
+type typeUsage struct {
+	Type  string `json:"type"`
+	Count int64  `json:"count"`
+	Bytes int64  `json:"bytes"`
+}
+
+type usageInfo struct {
+	UserID uint `json:"user_id"`
+	quotaInfo
+	Organization quotaInfo   `json:"organization"`
+	Files        int64       `json:"files"`
+	TrashFiles   int64       `json:"trash_files"`
+	ByType       []typeUsage `json:"by_type"`
+}
+
+// userUsage reports the usage of a user of the caller's organization
+func (h *FileHandler) userUsage(c *gin.Context, userID uint) (usageInfo, error) {
+	info := usageInfo{UserID: userID}
+
+	var user models.User
+	if err := h.db(c).First(&user, userID).Error; err != nil {
+		return info, err
+	}
+	var org models.Organization
+	if err := h.DB.First(&org, user.OrganizationID).Error; err != nil {
+		return info, err
+	}
+	info.quotaInfo = newQuotaInfo(user.UsedBytes, user.QuotaBytes)
+	info.Organization = newQuotaInfo(org.UsedBytes, org.QuotaBytes)
+
+	files := h.db(c).Unscoped().Model(&models.File{}).Where("user_id = ?", userID)
+	if err := files.Session(&gorm.Session{}).Where("deleted_at IS NULL").Count(&info.Files).Error; err != nil {
+		return info, err
+	}
+	if err := files.Session(&gorm.Session{}).Where("deleted_at IS NOT NULL").Count(&info.TrashFiles).Error; err != nil {
+		return info, err
+	}
+	info.ByType = []typeUsage{}
+	err := files.Session(&gorm.Session{}).Select("type, COUNT(*) AS count, COALESCE(SUM(size), 0) AS bytes").
+		Group("type").Order("bytes DESC").Scan(&info.ByType).Error
+	return info, err
+}
+
+// GetUsage returns the caller's storage usage and quotas, with file counts
+// and bytes per file type. Trashed files count until they are purged.
+func (h *FileHandler) GetUsage(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	info, err := h.userUsage(c, userID.(uint))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve usage"})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// ListUsage returns the usage and quota of every user of the organization
+func (h *FileHandler) ListUsage(c *gin.Context) {
+	var users []models.User
+	if err := h.db(c).Order("used_bytes DESC").Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve usage"})
+		return
+	}
+
+	type userQuota struct {
+		UserID uint   `json:"user_id"`
+		Email  string `json:"email"`
+		quotaInfo
+	}
+	infos := make([]userQuota, 0, len(users))
+	for _, user := range users {
+		infos = append(infos, userQuota{UserID: user.ID, Email: user.Email, quotaInfo: newQuotaInfo(user.UsedBytes, user.QuotaBytes)})
+	}
+	c.JSON(http.StatusOK, infos)
+}
+
+// GetUserUsage returns the usage of a user of the organization
+func (h *FileHandler) GetUserUsage(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("userID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	info, err := h.userUsage(c, uint(userID))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve usage"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// SetUserQuota changes the quota of a user of the organization. Lowering it
+// below what the user already stores only blocks further uploads.
+func (h *FileHandler) SetUserQuota(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("userID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req struct {
+		QuotaBytes *int64 `json:"quota_bytes"` // 0 removes the quota
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.QuotaBytes == nil || *req.QuotaBytes < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "quota_bytes must be 0 or more"})
+		return
+	}
+
+	result := h.db(c).Model(&models.User{}).Where("id = ?", userID).Update("quota_bytes", *req.QuotaBytes)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quota"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	h.GetUserUsage(c)
+}
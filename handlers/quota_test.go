@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"bytes"
+	"file_manage/models"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// uploadVersion posts content as a new version of a file
+func uploadVersion(t *testing.T, r http.Handler, user models.User, fileID uint, content string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", "ignored.txt")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	part.Write([]byte(content))
+	mw.Close()
+	return do(r, user, http.MethodPost, fmt.Sprintf("/files/%d/versions", fileID), &body,
+		map[string]string{"Content-Type": mw.FormDataContentType()})
+}
+
+// checkUsage compares the usage counters of user and their organization
+func checkUsage(t *testing.T, h *FileHandler, user models.User, want int64) {
+	t.Helper()
+	var u models.User
+	var org models.Organization
+	h.DB.First(&u, user.ID)
+	h.DB.First(&org, user.OrganizationID)
+	if u.UsedBytes != want || org.UsedBytes != want {
+		t.Errorf("usage = %d for the user and %d for the organization, want %d", u.UsedBytes, org.UsedBytes, want)
+	}
+}
+
+func TestQuotaCountsEveryVersion(t *testing.T) {
+	h := newTestHandler(t)
+	user := createUser(t, h, "acme", "alice@example.com")
+	r := testRouter(h)
+
+	file := uploadFile(t, h, user, "notes.txt", strings.Repeat("a", 10))
+	checkUsage(t, h, user, 10)
+
+	if w := uploadVersion(t, r, user, file.ID, strings.Repeat("b", 20)); w.Code != http.StatusOK {
+		t.Fatalf("new version: status %d, body %s", w.Code, w.Body)
+	}
+	checkUsage(t, h, user, 30)
+
+	// Every version counts, also one with content the file had before
+	if w := uploadVersion(t, r, user, file.ID, strings.Repeat("a", 10)); w.Code != http.StatusOK {
+		t.Fatalf("new version: status %d, body %s", w.Code, w.Body)
+	}
+	checkUsage(t, h, user, 40)
+
+	// The trash still takes up space, deleting for good frees all versions
+	if w := do(r, user, http.MethodGet, fmt.Sprintf("/delete/%d", file.ID), nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d, body %s", w.Code, w.Body)
+	}
+	checkUsage(t, h, user, 40)
+	if w := do(r, user, http.MethodDelete, fmt.Sprintf("/trash/%d", file.ID), nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("delete permanently: status %d, body %s", w.Code, w.Body)
+	}
+	checkUsage(t, h, user, 0)
+
+	var blobs int64
+	h.DB.Model(&models.Blob{}).Count(&blobs)
+	if blobs != 0 {
+		t.Errorf("%d blobs left after deleting every file", blobs)
+	}
+}
+
+func TestQuotaReleasesPrunedVersions(t *testing.T) {
+	h := newTestHandler(t)
+	h.VersionRetentionCount = 2
+	user := createUser(t, h, "acme", "alice@example.com")
+	r := testRouter(h)
+
+	file := uploadFile(t, h, user, "notes.txt", strings.Repeat("a", 10))
+	for i, size := range []int{20, 30, 40} {
+		if w := uploadVersion(t, r, user, file.ID, strings.Repeat(string(rune('b'+i)), size)); w.Code != http.StatusOK {
+			t.Fatalf("version %d: status %d, body %s", i+2, w.Code, w.Body)
+		}
+	}
+	// Only the newest two versions are kept
+	checkUsage(t, h, user, 70)
+}
+
+func TestQuotaRefusesVersionsOverQuota(t *testing.T) {
+	h := newTestHandler(t)
+	user := createUser(t, h, "acme", "alice@example.com")
+	file := uploadFile(t, h, user, "notes.txt", strings.Repeat("a", 10))
+	h.DB.Model(&user).Update("quota_bytes", 100)
+
+	// The whole request is reserved up front, so a small version with the
+	// multipart framing around it is already too much
+	w := uploadVersion(t, testRouter(h), user, file.ID, strings.Repeat("b", 50))
+	if w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("version over quota: status %d, want 507", w.Code)
+	}
+	checkUsage(t, h, user, 10)
+
+	var versions int64
+	h.DB.Model(&models.FileVersion{}).Where("file_id = ?", file.ID).Count(&versions)
+	if versions != 1 {
+		t.Errorf("file has %d versions, want 1", versions)
+	}
+}
+
+func TestRecalculateUsage(t *testing.T) {
+	h := newTestHandler(t)
+	alice := createUser(t, h, "acme", "alice@example.com")
+	anna := createUser(t, h, "acme", "anna@example.com")
+	r := testRouter(h)
+
+	file := uploadFile(t, h, alice, "notes.txt", strings.Repeat("a", 10))
+	if w := uploadVersion(t, r, alice, file.ID, strings.Repeat("b", 20)); w.Code != http.StatusOK {
+		t.Fatalf("new version: status %d, body %s", w.Code, w.Body)
+	}
+	uploadFile(t, h, anna, "other.txt", strings.Repeat("c", 5))
+
+	h.DB.Model(&models.User{}).Where("1 = 1").Update("used_bytes", 999)
+	h.DB.Model(&models.Organization{}).Where("1 = 1").Update("used_bytes", 999)
+	if err := h.RecalculateUsage(); err != nil {
+		t.Fatalf("RecalculateUsage: %v", err)
+	}
+
+	var users []models.User
+	h.DB.Order("id").Find(&users)
+	if users[0].UsedBytes != 30 || users[1].UsedBytes != 5 {
+		t.Errorf("usage of alice and anna = %d and %d, want 30 and 5", users[0].UsedBytes, users[1].UsedBytes)
+	}
+	var org models.Organization
+	h.DB.First(&org, alice.OrganizationID)
+	if org.UsedBytes != 35 {
+		t.Errorf("usage of the organization = %d, want 35", org.UsedBytes)
+	}
+}
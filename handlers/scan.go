@@ -0,0 +1,413 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"file_manage/models"
+	"file_manage/scanner"
+	"file_manage/storage"
+	"file_manage/tenant"
+	"file_manage/utils"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// With CLAMD_ADDRESS set every new blob is scanned for malware in the
+// background. Until the scan is done its files are pending and can't be
+// downloaded, shared, previewed or extracted. Infected blobs are moved to
+// quarantine/<organization>/<hash> and stay held until an admin releases them.
+
+const (
+	scanPending  = "pending"
+	scanClean    = "clean"
+	scanInfected = "infected"
+	scanFailed   = "failed"   // the scanner refused the content, e.g. as too large
+	scanReleased = "released" // an admin released infected or unscannable content
+)
+
+var (
+	errScanPending = errors.New("file is waiting for a malware scan")
+	errQuarantined = errors.New("file is quarantined")
+)
+
+// blobHeld tells why a blob's content must not be handed out, nil if it may
+func blobHeld(blob models.Blob) error {
+	switch blob.ScanStatus {
+	case scanPending:
+		return errScanPending
+	case scanInfected, scanFailed:
+		return errQuarantined
+	}
+	return nil
+}
+
+// respondHeld answers for content that is held by blobHeld and tells whether it did
+func respondHeld(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, errScanPending):
+		c.Header("Retry-After", "30")
+		c.JSON(http.StatusLocked, gin.H{"error": "The file is being scanned for malware, try again shortly"})
+	case errors.Is(err, errQuarantined):
+		c.JSON(http.StatusForbidden, gin.H{"error": "The file is quarantined"})
+	default:
+		return false
+	}
+	return true
+}
+
+func quarantineKey(blob models.Blob) string {
+	return "quarantine/" + strings.TrimPrefix(blobKey(blob.OrganizationID, blob.Checksum), "blobs/")
+}
+
+// scanNewBlob marks a blob stored by an upload for scanning. Content that was
+// stored while scanning was off is scanned the first time it is uploaded again.
+func (h *FileHandler) scanNewBlob(ctx context.Context, blob *models.Blob) {
+	if h.Scanner == nil || blob.ScanStatus != "" {
+		return
+	}
+	result := h.DB.WithContext(ctx).Model(&models.Blob{}).Where("id = ? AND scan_status = ''", blob.ID).
+		UpdateColumn("scan_status", scanPending)
+	if result.Error != nil {
+		fmt.Printf("Error marking blob %d for scanning: %v\n", blob.ID, result.Error)
+		return
+	}
+	blob.ScanStatus = scanPending
+	h.queueScan(blob.ID)
+}
+
+// queueScan asks the workers to scan a blob. Like queueThumbnails it is only
+// a hint, QueuePendingScans picks up what doesn't fit.
+func (h *FileHandler) queueScan(blobID uint) {
+	select {
+	case h.scanJobs <- blobID:
+	default:
+	}
+}
+
+// StartScanWorkers starts SCAN_WORKERS goroutines that scan uploaded content
+func (h *FileHandler) StartScanWorkers() {
+	if h.Scanner == nil {
+		return
+	}
+	if pinger, ok := h.Scanner.(interface{ Ping(context.Context) error }); ok {
+		if err := pinger.Ping(context.Background()); err != nil {
+			fmt.Println("Malware scanner is not reachable, uploads stay pending until it is:", err)
+		}
+	}
+	workers := utils.EnvInt64("SCAN_WORKERS", 2)
+	for i := int64(0); i < workers; i++ {
+		go func() {
+			for blobID := range h.scanJobs {
+				if _, busy := h.scanBusy.LoadOrStore(blobID, true); busy {
+					continue
+				}
+				h.scanJob(blobID)
+			}
+		}()
+	}
+}
+
+// scanJob scans a blob for a worker. A scan that crashes counts as failed,
+// so the content stays held until an admin looks at it.
+func (h *FileHandler) scanJob(blobID uint) {
+	defer h.scanBusy.Delete(blobID)
+	defer recoverJob("scanning", blobID, func() error {
+		return h.DB.Model(&models.Blob{}).Where("id = ? AND scan_status = ?", blobID, scanPending).UpdateColumns(map[string]interface{}{
+			"scan_status": scanFailed,
+			"scan_result": "scan crashed",
+			"scanned_at":  time.Now(),
+		}).Error
+	})
+	if err := h.scanBlob(context.Background(), blobID); err != nil {
+		fmt.Printf("Error scanning blob %d: %v\n", blobID, err)
+	}
+}
+
+// QueuePendingScans queues blobs whose scan was dropped from a full queue,
+// interrupted by a restart or failed because the scanner was unreachable
+func (h *FileHandler) QueuePendingScans() {
+	if h.Scanner == nil {
+		return
+	}
+	var ids []uint
+	err := h.DB.Model(&models.Blob{}).Where("scan_status = ? AND ref_count > 0", scanPending).
+		Limit(cap(h.scanJobs)).Pluck("id", &ids).Error
+	if err != nil {
+		fmt.Println("Error fetching blobs waiting for a scan:", err)
+		return
+	}
+	for _, id := range ids {
+		h.queueScan(id)
+	}
+}
+
+// scanBlob scans a pending blob and records the verdict. Errors reaching the
+// scanner leave the blob pending to be tried again.
+func (h *FileHandler) scanBlob(ctx context.Context, blobID uint) error {
+	var blob models.Blob
+	if err := h.DB.First(&blob, blobID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if blob.ScanStatus != scanPending {
+		return nil
+	}
+
+	reader, err := h.readBlob(ctx, blob)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	result, err := h.Scanner.Scan(ctx, reader)
+	reader.Close()
+
+	now := time.Now()
+	switch {
+	case errors.Is(err, scanner.ErrRejected):
+		fmt.Printf("Blob %d could not be scanned: %v\n", blob.ID, err)
+		return h.DB.Model(&blob).Where("scan_status = ?", scanPending).UpdateColumns(map[string]interface{}{
+			"scan_status": scanFailed,
+			"scan_result": strings.TrimPrefix(err.Error(), scanner.ErrRejected.Error()+": "),
+			"scanned_at":  now,
+		}).Error
+	case err != nil:
+		return err
+	case result.Infected:
+		return h.quarantineBlob(ctx, blob, result.Signature)
+	}
+
+	err = h.DB.Model(&blob).Where("scan_status = ?", scanPending).UpdateColumns(map[string]interface{}{
+		"scan_status": scanClean,
+		"scanned_at":  now,
+	}).Error
+	if err != nil {
+		return err
+	}
+	// Thumbnails and text wait for the scan
+	blob.ScanStatus = scanClean
+	h.queueThumbnails(blob)
+	h.queueText(blob)
+	return nil
+}
+
+// quarantineBlob moves infected content out of blobs/ and tells the owners
+// of the files holding it
+func (h *FileHandler) quarantineBlob(ctx context.Context, blob models.Blob, signature string) error {
+	fmt.Printf("Blob %d is infected with %s, moving it to quarantine\n", blob.ID, signature)
+	key := quarantineKey(blob)
+	if err := h.Storage.Rename(ctx, blob.StorageKey, key); err != nil {
+		return err
+	}
+
+	var result *gorm.DB
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		result = tx.Model(&blob).Where("storage_key = ?", blob.StorageKey).UpdateColumns(map[string]interface{}{
+			"storage_key": key,
+			"scan_status": scanInfected,
+			"scan_result": signature,
+			"scanned_at":  time.Now(),
+		})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return tx.Unscoped().Model(&models.File{}).Where("blob_id = ?", blob.ID).UpdateColumn("url", key).Error
+	})
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		// The blob was deleted meanwhile, take the quarantined copy with it
+		return h.Storage.Delete(ctx, key)
+	}
+
+	var files []models.File
+	if err := h.DB.Where("blob_id = ?", blob.ID).Find(&files).Error; err != nil {
+		return err
+	}
+	owners := make(map[uint][]models.File)
+	for _, file := range files {
+		owners[file.UserID] = append(owners[file.UserID], file)
+	}
+	orgCtx := tenant.WithOrganization(ctx, blob.OrganizationID)
+	for userID, owned := range owners {
+		h.notify(orgCtx, userID, "file_quarantined", fmt.Sprintf("Malware (%s) was found in a file you uploaded, it was quarantined", signature), owned)
+	}
+	return nil
+}
+
+type quarantineFile struct {
+	ID      uint   `json:"id"`
+	Name    string `json:"name"`
+	UserID  uint   `json:"user_id"`
+	GroupID *uint  `json:"group_id"`
+	Trashed bool   `json:"trashed"`
+}
+
+type quarantineEntry struct {
+	BlobID    uint             `json:"blob_id"`
+	Status    string           `json:"status"`
+	Result    string           `json:"result"`
+	Size      int64            `json:"size"`
+	Checksum  string           `json:"checksum"`
+	ScannedAt *time.Time       `json:"scanned_at"`
+	Files     []quarantineFile `json:"files"` // files with the content as any of their versions
+}
+
+func (h *FileHandler) quarantineEntry(c *gin.Context, blob models.Blob) (quarantineEntry, error) {
+	entry := quarantineEntry{
+		BlobID:    blob.ID,
+		Status:    blob.ScanStatus,
+		Result:    blob.ScanResult,
+		Size:      blob.Size,
+		Checksum:  blob.Checksum,
+		ScannedAt: blob.ScannedAt,
+		Files:     []quarantineFile{},
+	}
+	var files []models.File
+	err := h.db(c).Unscoped().
+		Where("id IN (?)", h.db(c).Model(&models.FileVersion{}).Select("file_id").Where("blob_id = ?", blob.ID)).
+		Order("id").Find(&files).Error
+	for _, file := range files {
+		entry.Files = append(entry.Files, quarantineFile{
+			ID:      file.ID,
+			Name:    file.Name,
+			UserID:  file.UserID,
+			GroupID: file.GroupID,
+			Trashed: file.DeletedAt.Valid,
+		})
+	}
+	return entry, err
+}
+
+// ListQuarantine lists the organization's held content, infected blobs and
+// those the scanner couldn't scan, with the files holding them
+func (h *FileHandler) ListQuarantine(c *gin.Context) {
+	var blobs []models.Blob
+	if err := h.db(c).Where("scan_status IN ?", []string{scanInfected, scanFailed}).Order("scanned_at DESC").Find(&blobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve quarantine"})
+		return
+	}
+	entries := make([]quarantineEntry, 0, len(blobs))
+	for _, blob := range blobs {
+		entry, err := h.quarantineEntry(c, blob)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve quarantine"})
+			return
+		}
+		entries = append(entries, entry)
+	}
+	c.JSON(http.StatusOK, gin.H{"quarantine": entries})
+}
+
+func (h *FileHandler) findHeldBlob(c *gin.Context) (models.Blob, bool) {
+	var blob models.Blob
+	blobID, err := strconv.ParseUint(c.Param("blobID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid blob ID"})
+		return blob, false
+	}
+	err = h.db(c).Where("scan_status IN ?", []string{scanInfected, scanFailed}).First(&blob, blobID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not in quarantine"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve quarantine"})
+		}
+		return blob, false
+	}
+	return blob, true
+}
+
+// ReleaseQuarantine makes held content available again, e.g. after a false
+// positive. Infected content is moved back out of quarantine/.
+func (h *FileHandler) ReleaseQuarantine(c *gin.Context) {
+	blob, ok := h.findHeldBlob(c)
+	if !ok {
+		return
+	}
+
+	key := blob.StorageKey
+	if blob.ScanStatus == scanInfected {
+		key = blobKey(blob.OrganizationID, blob.Checksum)
+		if err := h.Storage.Rename(c.Request.Context(), blob.StorageKey, key); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release file"})
+			return
+		}
+	}
+	err := h.db(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&blob).UpdateColumns(map[string]interface{}{
+			"storage_key": key,
+			"scan_status": scanReleased,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Model(&models.File{}).Where("blob_id = ?", blob.ID).UpdateColumn("url", key).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release file"})
+		return
+	}
+	fmt.Printf("Blob %d (%s) was released from quarantine by user %d\n", blob.ID, blob.ScanResult, c.GetUint("userID"))
+
+	blob.StorageKey, blob.ScanStatus = key, scanReleased
+	entry, err := h.quarantineEntry(c, blob)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve quarantine"})
+		return
+	}
+	h.queueThumbnails(blob)
+	h.queueText(blob)
+	for _, file := range entry.Files {
+		h.Redis.Del(context.Background(), fileWorkspace(models.File{UserID: file.UserID, GroupID: file.GroupID}).cacheKey())
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+// RescanQuarantine scans held content again, e.g. after the scanner's
+// limits were raised or its signatures updated
+func (h *FileHandler) RescanQuarantine(c *gin.Context) {
+	if h.Scanner == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Malware scanning is not configured"})
+		return
+	}
+	blob, ok := h.findHeldBlob(c)
+	if !ok {
+		return
+	}
+
+	key := blob.StorageKey
+	if blob.ScanStatus == scanInfected {
+		// Pending content lives with the other blobs
+		key = blobKey(blob.OrganizationID, blob.Checksum)
+		if err := h.Storage.Rename(c.Request.Context(), blob.StorageKey, key); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rescan file"})
+			return
+		}
+	}
+	err := h.db(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&blob).UpdateColumns(map[string]interface{}{
+			"storage_key": key,
+			"scan_status": scanPending,
+			"scan_result": "",
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Model(&models.File{}).Where("blob_id = ?", blob.ID).UpdateColumn("url", key).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rescan file"})
+		return
+	}
+	h.queueScan(blob.ID)
+	c.JSON(http.StatusAccepted, gin.H{"message": "The file will be scanned again"})
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"context"
+	"file_manage/models"
+	"file_manage/scanner"
+	"io"
+	"testing"
+)
+
+// panickingScanner crashes on everything it scans
+type panickingScanner struct{}
+
+func (panickingScanner) Scan(ctx context.Context, r io.Reader) (scanner.Result, error) {
+	panic("scanner bug")
+}
+
+func TestScanJobSurvivesPanics(t *testing.T) {
+	h := newTestHandler(t)
+	h.Scanner = panickingScanner{}
+	user := createUser(t, h, "acme", "alice@example.com")
+	file := uploadFile(t, h, user, "invoice.pdf", "%PDF-1.7 suspicious")
+
+	h.scanBusy.Store(file.BlobID, true)
+	h.scanJob(file.BlobID)
+
+	var blob models.Blob
+	h.DB.First(&blob, file.BlobID)
+	if blob.ScanStatus != scanFailed || blob.ScanResult != "scan crashed" {
+		t.Errorf("scan status = %q (%q), want %q", blob.ScanStatus, blob.ScanResult, scanFailed)
+	}
+	if blobHeld(blob) == nil {
+		t.Error("content that crashed the scan is not held")
+	}
+	if _, busy := h.scanBusy.Load(file.BlobID); busy {
+		t.Error("blob is still marked busy")
+	}
+}
@@ -0,0 +1,415 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"file_manage/models"
+	"file_manage/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Failed unlock attempts allowed per client and per link before unlocking
+// is blocked for unlockWindow. The per-link limit stops guessing spread over
+// many addresses, which also means anyone can use it up and lock everyone
+// out of a link for the rest of the window. The owner can create a new link.
+const (
+	unlockAttemptsPerClient = 5
+	unlockAttemptsPerLink   = 50
+	unlockWindow            = 15 * time.Minute
+)
+
+type shareLinkInfo struct {
+	Token          string     `json:"token"`
+	Name           string     `json:"name"`
+	Protected      bool       `json:"protected"`
+	MaxDownloads   *int64     `json:"max_downloads"`
+	Remaining      *int64     `json:"remaining_downloads"`
+	URL            string     `json:"url"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	Expired        bool       `json:"expired"`
+	DownloadCount  int64      `json:"download_count"`
+	LastAccessedAt *time.Time `json:"last_accessed_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// ListShareLinks lists the share links of a file. Owners see every link,
+// users the file is shared with only the links they created.
+func (h *FileHandler) ListShareLinks(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	file, ok := h.findFile(c, accessWrite)
+	if !ok {
+		return
+	}
+
+	query := h.sdb(c).Where("file_id = ?", file.ID)
+	if !h.ownsFile(userID, file) {
+		query = query.Where("owner_id = ?", userID)
+	}
+	h.writeShareLinks(c, query)
+}
+
+// ListFolderLinks lists the share links of a folder
+func (h *FileHandler) ListFolderLinks(c *gin.Context) {
+	folder, ok := h.folderParam(c, accessOwner)
+	if !ok {
+		return
+	}
+	h.writeShareLinks(c, h.sdb(c).Where("folder_id = ?", folder.ID))
+}
+
+func (h *FileHandler) writeShareLinks(c *gin.Context, query *gorm.DB) {
+	var links []SharedFile
+	if err := query.Order("created_at DESC").Find(&links).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve share links"})
+		return
+	}
+
+	infos := make([]shareLinkInfo, 0, len(links))
+	for _, link := range links {
+		info := shareLinkInfo{
+			Token:          link.Token,
+			Name:           link.Name,
+			Protected:      link.PasswordHash != "",
+			URL:            fmt.Sprintf("http://%s/download/%s", c.Request.Host, link.Token),
+			ExpiresAt:      link.Expires,
+			Expired:        time.Now().After(link.Expires),
+			DownloadCount:  link.DownloadCount,
+			LastAccessedAt: link.LastAccessedAt,
+			CreatedAt:      link.CreatedAt,
+		}
+		if link.MaxDownloads > 0 {
+			info.MaxDownloads = &link.MaxDownloads
+			info.Remaining = &link.RemainingDownloads
+		}
+		infos = append(infos, info)
+	}
+	c.JSON(http.StatusOK, infos)
+}
+
+// RevokeShareLink invalidates a share link before it expires
+func (h *FileHandler) RevokeShareLink(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	file, ok := h.findFile(c, accessWrite)
+	if !ok {
+		return
+	}
+
+	token := c.Param("token")
+	query := h.sdb(c).Where("token = ? AND file_id = ?", token, file.ID)
+	if !h.ownsFile(userID, file) {
+		query = query.Where("owner_id = ?", userID)
+	}
+	result := query.Delete(&SharedFile{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke share link"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		return
+	}
+	h.Redis.Del(context.Background(), fmt.Sprintf("shared_file:%s", token))
+
+	// PublicUrl still points at the newest link, forget it if that one is gone
+	if strings.HasSuffix(file.PublicUrl, "/"+token) {
+		h.db(c).Model(&file).Updates(map[string]interface{}{"public_url": "", "public_url_expiry": time.Time{}})
+		h.clearFileCache(file)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Share link revoked"})
+}
+
+// RevokeFolderLink invalidates a share link of a folder
+func (h *FileHandler) RevokeFolderLink(c *gin.Context) {
+	folder, ok := h.folderParam(c, accessOwner)
+	if !ok {
+		return
+	}
+
+	token := c.Param("token")
+	result := h.sdb(c).Where("token = ? AND folder_id = ?", token, folder.ID).Delete(&SharedFile{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke share link"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		return
+	}
+	h.Redis.Del(context.Background(), fmt.Sprintf("shared_file:%s", token))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Share link revoked"})
+}
+
+// revokeShareLinks removes all links of a file that is deleted for good
+func (h *FileHandler) revokeShareLinks(ctx context.Context, fileID uint) error {
+	var tokens []string
+	if err := h.SDB.Model(&SharedFile{}).Where("file_id = ?", fileID).Pluck("token", &tokens).Error; err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	// Rows go first, see cacheShareLink
+	if err := h.SDB.Where("file_id = ?", fileID).Delete(&SharedFile{}).Error; err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		keys = append(keys, fmt.Sprintf("shared_file:%s", token))
+	}
+	return h.Redis.Del(ctx, keys...).Err()
+}
+
+// recordLinkUsage counts a download through a share link
+func (h *FileHandler) recordLinkUsage(token string) {
+	err := h.SDB.Model(&SharedFile{}).Where("token = ?", token).UpdateColumns(map[string]interface{}{
+		"download_count":   gorm.Expr("download_count + 1"),
+		"last_accessed_at": time.Now(),
+	}).Error
+	if err != nil {
+		fmt.Println("Error recording share link usage:", err)
+	}
+}
+
+// decrementRemaining lowers the cached count of a link, but never recreates
+// a hash that has already expired or been revoked
+var decrementRemaining = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("HINCRBY", KEYS[1], "remaining", -1)
+end
+return -1
+`)
+
+// fillShareLink caches the fields of a link unless they are already cached
+var fillShareLink = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+redis.call("HSET", KEYS[1], unpack(ARGV, 2))
+redis.call("PEXPIRE", KEYS[1], ARGV[1])
+return 1
+`)
+
+// cacheShareLink puts a link read from the database back into Redis. The link
+// may be revoked meanwhile, and revoking deletes the row before the cached
+// hash, so checking the row after writing the hash never leaves it behind.
+func (h *FileHandler) cacheShareLink(token string, link SharedFile) {
+	ttl := time.Until(link.Expires)
+	if ttl <= 0 {
+		return
+	}
+	ctx := context.Background()
+	key := fmt.Sprintf("shared_file:%s", token)
+	filled, err := fillShareLink.Run(ctx, h.Redis, []string{key}, ttl.Milliseconds(),
+		"file_path", link.FilePath,
+		"original_file_name", link.FileName,
+		"expires", link.Expires.Unix(),
+		"file_id", link.FileID,
+		"folder_id", link.FolderID,
+		"password_hash", link.PasswordHash,
+		"owner_id", link.OwnerID,
+		"max_downloads", link.MaxDownloads,
+		"remaining", link.RemainingDownloads,
+	).Int()
+	if err != nil {
+		fmt.Println("Error caching share link:", err)
+		return
+	}
+	if filled == 0 {
+		return
+	}
+
+	var count int64
+	if err := h.SDB.Model(&SharedFile{}).Where("token = ?", token).Count(&count).Error; err != nil || count == 0 {
+		h.Redis.Del(ctx, key)
+	}
+}
+
+// consumeDownload takes one download off a limited link. The conditional
+// update is the source of truth, so concurrent downloads can't overdraw it.
+func (h *FileHandler) consumeDownload(token string) bool {
+	result := h.SDB.Model(&SharedFile{}).Where("token = ? AND remaining_downloads > 0", token).UpdateColumns(map[string]interface{}{
+		"remaining_downloads": gorm.Expr("remaining_downloads - 1"),
+		"download_count":      gorm.Expr("download_count + 1"),
+		"last_accessed_at":    time.Now(),
+	})
+	if result.Error != nil {
+		fmt.Println("Error consuming share link download:", result.Error)
+		return false
+	}
+	if result.RowsAffected == 0 {
+		return false
+	}
+
+	key := fmt.Sprintf("shared_file:%s", token)
+	if err := decrementRemaining.Run(context.Background(), h.Redis, []string{key}).Err(); err != nil {
+		fmt.Println("Error updating cached share link downloads:", err)
+	}
+	return true
+}
+
+// MigrateLegacyShareLinks records the owner of links created before links
+// had one
+func (h *FileHandler) MigrateLegacyShareLinks() error {
+	var links []SharedFile
+	if err := h.SDB.Where("owner_id = 0 AND file_id <> 0").Find(&links).Error; err != nil {
+		return err
+	}
+	for _, link := range links {
+		var file models.File
+		if err := h.DB.Unscoped().Select("id", "user_id").First(&file, link.FileID).Error; err != nil {
+			continue
+		}
+		if err := h.SDB.Model(&SharedFile{}).Where("token = ?", link.Token).Update("owner_id", file.UserID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func shareCookieName(token string) string {
+	return "share_" + token
+}
+
+// passwordFingerprint changes whenever the link's password does, so that
+// unlock cookies issued for an older password stop working
+func passwordFingerprint(hash string) string {
+	sum := sha256.Sum256([]byte(hash))
+	return hex.EncodeToString(sum[:8])
+}
+
+// shareUnlocked reports whether the request carries a valid unlock cookie
+func (h *FileHandler) shareUnlocked(c *gin.Context, token, hash string) bool {
+	cookie, err := c.Cookie(shareCookieName(token))
+	if err != nil {
+		return false
+	}
+	return utils.ValidateShareToken(cookie, token, passwordFingerprint(hash)) == nil
+}
+
+// countUnlockAttempt counts an attempt against each key, starting the window
+// on the first one, and returns the position of the first key over its limit
+// or 0. ARGV holds the limit of each key followed by the window.
+var countUnlockAttempt = redis.NewScript(`
+local over = 0
+for i, key in ipairs(KEYS) do
+	local attempts = redis.call("INCR", key)
+	if attempts == 1 then
+		redis.call("PEXPIRE", key, ARGV[#KEYS + 1])
+	end
+	if over == 0 and attempts > tonumber(ARGV[i]) then
+		over = i
+	end
+end
+return over
+`)
+
+// refundUnlockAttempt takes back a counted attempt, unless the window has
+// already ended and the counter is gone
+var refundUnlockAttempt = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("DECR", KEYS[1])
+end
+return 0
+`)
+
+// UnlockShareLink checks the password of a protected share link and sets a
+// short-lived cookie that lets the client download through the link
+func (h *FileHandler) UnlockShareLink(c *gin.Context) {
+	token := c.Param("token")
+	ctx := context.Background()
+	fromPage := strings.HasPrefix(c.FullPath(), "/view/")
+
+	var link SharedFile
+	if err := h.sdb(c).Where("token = ?", token).First(&link).Error; err != nil {
+		h.unlockFailed(c, token, fromPage, http.StatusNotFound, "Link not found")
+		return
+	}
+	if time.Now().After(link.Expires) {
+		h.unlockFailed(c, token, fromPage, http.StatusGone, "Link has expired")
+		return
+	}
+	if link.PasswordHash == "" {
+		h.unlockFailed(c, token, fromPage, http.StatusBadRequest, "This link is not password protected")
+		return
+	}
+
+	var req struct {
+		Password string `json:"password" form:"password"`
+	}
+	if err := c.ShouldBind(&req); err != nil || req.Password == "" {
+		h.unlockFailed(c, token, fromPage, http.StatusBadRequest, "Password is required")
+		return
+	}
+
+	// Every attempt is counted before the password is checked, so parallel
+	// guesses can't all slip in under the limits while bcrypt runs
+	clientKey := fmt.Sprintf("share_unlock:%s:%s", token, c.ClientIP())
+	linkKey := fmt.Sprintf("share_unlock:%s", token)
+	keys := []string{clientKey, linkKey}
+	over, err := countUnlockAttempt.Run(ctx, h.Redis, keys,
+		unlockAttemptsPerClient, unlockAttemptsPerLink, unlockWindow.Milliseconds()).Int()
+	if err != nil {
+		fmt.Println("Error counting unlock attempt:", err)
+		h.unlockFailed(c, token, fromPage, http.StatusInternalServerError, "Failed to unlock link")
+		return
+	}
+	if over > 0 {
+		retryAfter := h.Redis.TTL(ctx, keys[over-1]).Val()
+		c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		h.unlockFailed(c, token, fromPage, http.StatusTooManyRequests, "Too many failed attempts. Try again later.")
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(req.Password)); err != nil {
+		h.unlockFailed(c, token, fromPage, http.StatusUnauthorized, "Invalid password")
+		return
+	}
+	// Only failed attempts count against the limits
+	h.Redis.Del(ctx, clientKey)
+	refundUnlockAttempt.Run(ctx, h.Redis, []string{linkKey})
+
+	// Never outlive the link itself
+	ttl := h.ShareUnlockTTL
+	if remaining := time.Until(link.Expires); remaining < ttl {
+		ttl = remaining
+	}
+	value, err := utils.GenerateShareToken(token, passwordFingerprint(link.PasswordHash), ttl)
+	if err != nil {
+		h.unlockFailed(c, token, fromPage, http.StatusInternalServerError, "Failed to unlock link")
+		return
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	for _, path := range []string{"/download/" + token, "/view/" + token} {
+		c.SetCookie(shareCookieName(token), value, int(ttl.Seconds()), path, "", c.Request.TLS != nil, true)
+	}
+	if fromPage {
+		c.Redirect(http.StatusSeeOther, "/view/"+token)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Link unlocked", "expires_in": int(ttl.Seconds())})
+}
+
+// unlockFailed answers a failed unlock. The form on the landing page is sent
+// back to the page, which says the attempt failed without echoing anything.
+func (h *FileHandler) unlockFailed(c *gin.Context, token string, fromPage bool, status int, message string) {
+	if fromPage {
+		c.Redirect(http.StatusSeeOther, "/view/"+token+"?unlock=failed")
+		return
+	}
+	c.JSON(status, gin.H{"error": message})
+}
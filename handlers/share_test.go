@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"file_manage/models"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// createShareLink shares file the way ShareFile does, with a cheap password
+// hash so tests can afford many attempts
+func createShareLink(t *testing.T, h *FileHandler, owner models.User, file models.File, password string, maxDownloads int64) string {
+	t.Helper()
+	link := SharedFile{
+		Token:              uuid.New().String(),
+		FilePath:           file.URL,
+		FileID:             file.ID,
+		FileName:           file.Name,
+		Expires:            time.Now().Add(time.Hour),
+		OwnerID:            owner.ID,
+		MaxDownloads:       maxDownloads,
+		RemainingDownloads: maxDownloads,
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("hash password: %v", err)
+		}
+		link.PasswordHash = string(hash)
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/share/1", nil).WithContext(userContext(owner))
+	if err := h.saveShareLink(c, link); err != nil {
+		t.Fatalf("save share link: %v", err)
+	}
+	return link.Token
+}
+
+// unlock tries a password from the given client address
+func unlock(h *FileHandler, token, client, password string) *httptest.ResponseRecorder {
+	return do(testRouter(h), models.User{}, http.MethodPost, "/download/"+token+"/unlock",
+		strings.NewReader("password="+password), map[string]string{
+			"Content-Type":    "application/x-www-form-urlencoded",
+			"X-Forwarded-For": client,
+		})
+}
+
+func TestUnlockShareLink(t *testing.T) {
+	h := newTestHandler(t)
+	user := createUser(t, h, "acme", "alice@example.com")
+	token := createShareLink(t, h, user, uploadFile(t, h, user, "secret.txt", "secret"), "opensesame", 0)
+
+	if w := do(testRouter(h), models.User{}, http.MethodGet, "/download/"+token, nil, nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("download while locked: status %d, want 401", w.Code)
+	}
+
+	w := unlock(h, token, "203.0.113.1", "opensesame")
+	if w.Code != http.StatusOK {
+		t.Fatalf("unlock: status %d, body %s", w.Code, w.Body)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/download/"+token, nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	download := httptest.NewRecorder()
+	testRouter(h).ServeHTTP(download, req)
+	if download.Code != http.StatusOK || download.Body.String() != "secret" {
+		t.Errorf("download after unlock: status %d, body %q", download.Code, download.Body)
+	}
+}
+
+func TestUnlockAttemptsPerClient(t *testing.T) {
+	h := newTestHandler(t)
+	user := createUser(t, h, "acme", "alice@example.com")
+	token := createShareLink(t, h, user, uploadFile(t, h, user, "secret.txt", "secret"), "opensesame", 0)
+
+	for i := 0; i < unlockAttemptsPerClient-1; i++ {
+		if w := unlock(h, token, "203.0.113.1", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status %d, want 401", i+1, w.Code)
+		}
+	}
+	// The right password clears the client's failures
+	if w := unlock(h, token, "203.0.113.1", "opensesame"); w.Code != http.StatusOK {
+		t.Fatalf("unlock: status %d, want 200", w.Code)
+	}
+
+	for i := 0; i < unlockAttemptsPerClient; i++ {
+		if w := unlock(h, token, "203.0.113.1", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d after unlocking: status %d, want 401", i+1, w.Code)
+		}
+	}
+	// Blocked even with the right password now
+	w := unlock(h, token, "203.0.113.1", "opensesame")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("attempt over the limit: status %d, Retry-After %q, want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Other clients are not affected
+	if w := unlock(h, token, "203.0.113.2", "opensesame"); w.Code != http.StatusOK {
+		t.Errorf("unlock from another client: status %d, want 200", w.Code)
+	}
+}
+
+func TestUnlockAttemptsPerLink(t *testing.T) {
+	h := newTestHandler(t)
+	user := createUser(t, h, "acme", "alice@example.com")
+	token := createShareLink(t, h, user, uploadFile(t, h, user, "secret.txt", "secret"), "opensesame", 0)
+
+	// Guesses spread over many addresses, each below its own limit
+	for i := 0; i < unlockAttemptsPerLink; i++ {
+		client := fmt.Sprintf("198.51.100.%d", i/unlockAttemptsPerClient)
+		if w := unlock(h, token, client, "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status %d, want 401", i+1, w.Code)
+		}
+	}
+	if w := unlock(h, token, "203.0.113.1", "opensesame"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("unlock once the link is over its limit: status %d, want 429", w.Code)
+	}
+}
@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"file_manage/models"
+	"file_manage/storage"
+	"file_manage/utils"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	_ "golang.org/x/image/webp"
+	"gorm.io/gorm"
+)
+
+// Thumbnails are generated in the background for JPEG, PNG, GIF and WebP
+// images. They belong to the blob, so identical images share them, and are
+// stored next to the originals under thumbnails/<organization>/<hash>-<size>.
+
+// thumbnailSizes are the standard sizes, by the longest side in pixels
+var thumbnailSizes = map[string]int{
+	"small":  128,
+	"medium": 512,
+	"large":  1024,
+}
+
+const (
+	thumbnailReady  = "ready"
+	thumbnailFailed = "failed"
+
+	// EXIF data and the image dimensions are read from the start of the file
+	thumbnailHeaderSize = 1 << 20
+)
+
+var errNotImage = errors.New("not a supported image")
+
+// thumbnailTypes are the MIME types of the images thumbnails are made of
+var thumbnailTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// thumbnailSource tells whether content of a MIME type, as sniffed from the
+// content, is an image thumbnails are made of
+func thumbnailSource(mimeType string) bool {
+	for _, t := range thumbnailTypes {
+		if mimeType == t {
+			return true
+		}
+	}
+	return false
+}
+
+func thumbnailKey(blob models.Blob, size int) string {
+	return fmt.Sprintf("thumbnails/%d/%s/%s-%d", blob.OrganizationID, blob.Checksum[:2], blob.Checksum, size)
+}
+
+// queueThumbnails asks the workers for thumbnails of a blob. The queue is
+// only a hint, what doesn't fit is picked up by QueueMissingThumbnails.
+func (h *FileHandler) queueThumbnails(blob models.Blob) {
+	if blob.ID == 0 || blob.ThumbnailStatus != "" || blobHeld(blob) != nil || !thumbnailSource(blob.MimeType) {
+		return
+	}
+	select {
+	case h.thumbnailJobs <- blob.ID:
+	default:
+	}
+}
+
+// StartThumbnailWorkers starts THUMBNAIL_WORKERS goroutines that generate
+// the thumbnails queued by uploads
+func (h *FileHandler) StartThumbnailWorkers() {
+	workers := utils.EnvInt64("THUMBNAIL_WORKERS", 2)
+	for i := int64(0); i < workers; i++ {
+		go func() {
+			for blobID := range h.thumbnailJobs {
+				// The same blob may be queued again while it is being worked on
+				if _, busy := h.thumbnailBusy.LoadOrStore(blobID, true); busy {
+					continue
+				}
+				h.thumbnailJob(blobID)
+			}
+		}()
+	}
+}
+
+// thumbnailJob generates the thumbnails of a blob for a worker. Images that
+// crash the decoder are marked failed.
+func (h *FileHandler) thumbnailJob(blobID uint) {
+	defer h.thumbnailBusy.Delete(blobID)
+	defer recoverJob("generating thumbnails for", blobID, func() error {
+		return h.DB.Model(&models.Blob{}).Where("id = ?", blobID).UpdateColumn("thumbnail_status", thumbnailFailed).Error
+	})
+	if err := h.generateThumbnails(context.Background(), blobID); err != nil {
+		fmt.Printf("Error generating thumbnails for blob %d: %v\n", blobID, err)
+	}
+}
+
+// QueueMissingThumbnails queues images uploaded while the queue was full or
+// the server was down, including those from before thumbnails existed
+func (h *FileHandler) QueueMissingThumbnails() {
+	var blobs []models.Blob
+	err := h.DB.Select("id", "mime_type").
+		Where("thumbnail_status = '' AND ref_count > 0 AND scan_status NOT IN ?", []string{scanPending, scanInfected, scanFailed}).
+		Where("mime_type IN ?", thumbnailTypes).
+		Limit(cap(h.thumbnailJobs)).Find(&blobs).Error
+	if err != nil {
+		fmt.Println("Error fetching images without thumbnails:", err)
+		return
+	}
+	for _, blob := range blobs {
+		h.queueThumbnails(blob)
+	}
+}
+
+// generateThumbnails stores every standard size of an image blob and marks
+// the blob ready, or failed when it isn't an image that can be decoded.
+// Storage errors leave the blob to be tried again.
+func (h *FileHandler) generateThumbnails(ctx context.Context, blobID uint) error {
+	var blob models.Blob
+	if err := h.DB.First(&blob, blobID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if blob.ThumbnailStatus != "" || blobHeld(blob) != nil {
+		// Held content gets its thumbnails once it was found clean or released
+		return nil
+	}
+
+	img, format, err := h.decodeImage(ctx, blob)
+	if err != nil {
+		if errors.Is(err, errNotImage) {
+			fmt.Printf("No thumbnails for blob %d: %v\n", blob.ID, err)
+			return h.DB.Model(&blob).UpdateColumn("thumbnail_status", thumbnailFailed).Error
+		}
+		return err
+	}
+
+	// Largest first, every size is scaled from the one before
+	sizes := make([]int, 0, len(thumbnailSizes))
+	for _, size := range thumbnailSizes {
+		sizes = append(sizes, size)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+	for _, size := range sizes {
+		img = utils.Fit(img, size)
+		if err := h.storeThumbnail(ctx, blob, size, img, format); err != nil {
+			return err
+		}
+	}
+	result := h.DB.Model(&blob).UpdateColumn("thumbnail_status", thumbnailReady)
+	if result.Error == nil && result.RowsAffected == 0 {
+		// The blob was deleted meanwhile, take its thumbnails with it
+		return h.deleteThumbnails(ctx, blob.ID)
+	}
+	return result.Error
+}
+
+// decodeImage decodes a blob in the right orientation and returns its format,
+// refusing images with more than THUMBNAIL_MAX_PIXELS pixels before they are decoded
+func (h *FileHandler) decodeImage(ctx context.Context, blob models.Blob) (image.Image, string, error) {
+	reader, err := h.openBlob(ctx, blob)
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+
+	header := make([]byte, thumbnailHeaderSize)
+	n, err := io.ReadFull(reader, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, "", err
+	}
+	header = header[:n]
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(header))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errNotImage, err)
+	}
+	if int64(config.Width)*int64(config.Height) > h.MaxThumbnailPixels {
+		return nil, "", fmt.Errorf("%w: %dx%d pixels is too large", errNotImage, config.Width, config.Height)
+	}
+
+	img, format, err := image.Decode(io.MultiReader(bytes.NewReader(header), reader))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errNotImage, err)
+	}
+	return utils.Orient(img, utils.ExifOrientation(header)), format, nil
+}
+
+// storeThumbnail encodes one size, as JPEG for photos and PNG for the formats
+// that may be transparent, encrypts it like uploads when a master key is set
+// and records it
+func (h *FileHandler) storeThumbnail(ctx context.Context, blob models.Blob, size int, img image.Image, format string) error {
+	var buf bytes.Buffer
+	contentType := "image/png"
+	if format == "jpeg" {
+		contentType = "image/jpeg"
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+			return err
+		}
+	} else if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	thumbnail := models.Thumbnail{
+		OrganizationID: blob.OrganizationID,
+		BlobID:         blob.ID,
+		Size:           size,
+		StorageKey:     thumbnailKey(blob, size),
+		ContentType:    contentType,
+		Bytes:          int64(buf.Len()),
+		Checksum:       hex.EncodeToString(sum[:]),
+	}
+
+	var body io.Reader = &buf
+	if h.MasterKey != nil {
+		dataKey, err := utils.GenerateKey()
+		if err != nil {
+			return err
+		}
+		if body, err = utils.NewEncryptReader(&buf, dataKey); err != nil {
+			return err
+		}
+		if thumbnail.WrappedKey, err = utils.WrapKey(dataKey, h.MasterKey); err != nil {
+			return err
+		}
+		thumbnail.EncryptionScheme = utils.StreamScheme
+		thumbnail.KeyID = utils.MasterKeyID(h.MasterKey)
+	}
+	if _, err := h.Storage.Put(ctx, thumbnail.StorageKey, body); err != nil {
+		return fmt.Errorf("failed to save thumbnail: %w", err)
+	}
+
+	// A thumbnail left over from an earlier attempt is replaced
+	return h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("blob_id = ? AND size = ?", blob.ID, size).Delete(&models.Thumbnail{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&thumbnail).Error
+	})
+}
+
+// deleteThumbnails removes the thumbnails of a blob that is deleted
+func (h *FileHandler) deleteThumbnails(ctx context.Context, blobID uint) error {
+	var thumbnails []models.Thumbnail
+	if err := h.DB.Where("blob_id = ?", blobID).Find(&thumbnails).Error; err != nil {
+		return err
+	}
+	for _, thumbnail := range thumbnails {
+		if err := h.Storage.Delete(ctx, thumbnail.StorageKey); err != nil && !errors.Is(err, storage.ErrNotExist) {
+			return err
+		}
+	}
+	return h.DB.Where("blob_id = ?", blobID).Delete(&models.Thumbnail{}).Error
+}
+
+// GetThumbnail serves a thumbnail of an image file. size is small, medium
+// (the default) or large, or the number of pixels of one of them.
+func (h *FileHandler) GetThumbnail(c *gin.Context) {
+	file, ok := h.findFile(c, accessRead)
+	if !ok {
+		return
+	}
+
+	size, ok := thumbnailSizes[c.DefaultQuery("size", "medium")]
+	if !ok {
+		pixels, _ := strconv.Atoi(c.Query("size"))
+		for _, standard := range thumbnailSizes {
+			if pixels == standard {
+				size, ok = standard, true
+			}
+		}
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "size must be small, medium or large"})
+			return
+		}
+	}
+
+	var blob models.Blob
+	if h.db(c).First(&blob, file.BlobID).Error != nil || !thumbnailSource(blob.MimeType) || blob.ThumbnailStatus == thumbnailFailed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "This file has no thumbnail"})
+		return
+	}
+	if respondHeld(c, blobHeld(blob)) {
+		return
+	}
+	if blob.ThumbnailStatus == "" {
+		h.queueThumbnails(blob)
+		c.Header("Retry-After", "5")
+		c.JSON(http.StatusAccepted, gin.H{"message": "The thumbnail is being generated"})
+		return
+	}
+
+	var thumbnail models.Thumbnail
+	if err := h.db(c).Where("blob_id = ? AND size = ?", blob.ID, size).First(&thumbnail).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "This file has no thumbnail"})
+		return
+	}
+
+	// Thumbnails are served like blobs, the checksum of the thumbnail is its ETag
+	content := models.Blob{
+		StorageKey:       thumbnail.StorageKey,
+		Size:             thumbnail.Bytes,
+		Checksum:         thumbnail.Checksum,
+		EncryptionScheme: thumbnail.EncryptionScheme,
+		WrappedKey:       thumbnail.WrappedKey,
+	}
+	name := strings.TrimSuffix(file.Name, filepath.Ext(file.Name)) + "." + strings.TrimPrefix(thumbnail.ContentType, "image/")
+	c.Header("Cache-Control", "private, max-age=300")
+	c.Header("X-Content-Type-Options", "nosniff")
+	h.sendBlob(c, content, name, thumbnail.CreatedAt, thumbnail.ContentType, contentDisposition("inline", name))
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"context"
+	"file_manage/models"
+	"file_manage/storage"
+	"io"
+	"testing"
+)
+
+// panickingStorage crashes whoever reads from it
+type panickingStorage struct {
+	storage.Storage
+}
+
+func (panickingStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	panic("corrupt content")
+}
+
+func TestThumbnailJobSurvivesPanics(t *testing.T) {
+	h := newTestHandler(t)
+	user := createUser(t, h, "acme", "alice@example.com")
+	file := uploadFile(t, h, user, "photo.png", "\x89PNG\r\n\x1a\nnot really")
+	h.Storage = panickingStorage{h.Storage}
+
+	h.thumbnailBusy.Store(file.BlobID, true)
+	h.thumbnailJob(file.BlobID)
+
+	var blob models.Blob
+	h.DB.First(&blob, file.BlobID)
+	if blob.ThumbnailStatus != thumbnailFailed {
+		t.Errorf("thumbnail status = %q, want %q", blob.ThumbnailStatus, thumbnailFailed)
+	}
+	if _, busy := h.thumbnailBusy.Load(file.BlobID); busy {
+		t.Error("blob is still marked busy")
+	}
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"file_manage/models"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Deleted files are soft deleted through gorm.Model and stay in the trash,
+// blobs included, until they are restored, deleted permanently or purged.
+
+type trashedFile struct {
+	models.File
+	PurgeAt time.Time `json:"purge_at"`
+}
+
+// GetTrash lists the trash of the caller's workspace, or of a group's with group_id
+func (h *FileHandler) GetTrash(c *gin.Context) {
+	ws, ok := h.parseWorkspace(c, accessOwner)
+	if !ok {
+		return
+	}
+
+	var files []models.File
+	if err := h.db(c).Unscoped().Scopes(ws.scope).Where("deleted_at IS NOT NULL").
+		Order("deleted_at DESC").Find(&files).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve trash"})
+		return
+	}
+
+	trash := make([]trashedFile, 0, len(files))
+	for _, file := range files {
+		trash = append(trash, trashedFile{File: file, PurgeAt: file.DeletedAt.Time.Add(h.TrashRetention)})
+	}
+	c.JSON(http.StatusOK, trash)
+}
+
+// findTrashedFile loads a file from the trash the caller has full access to
+func (h *FileHandler) findTrashedFile(c *gin.Context) (models.File, bool) {
+	userID, _ := c.Get("userID")
+
+	var file models.File
+	fileID, err := strconv.Atoi(c.Param("fileID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return file, false
+	}
+
+	err = h.db(c).Unscoped().Where("id = ? AND deleted_at IS NOT NULL", fileID).First(&file).Error
+	if err == nil && !h.ownsFile(userID, file) {
+		err = gorm.ErrRecordNotFound
+	}
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found in trash"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch file information"})
+		}
+		return file, false
+	}
+	return file, true
+}
+
+func (h *FileHandler) RestoreFile(c *gin.Context) {
+	file, ok := h.findTrashedFile(c)
+	if !ok {
+		return
+	}
+	if file.BlobID == 0 {
+		// Deleted before the trash existed, the content is already gone
+		c.JSON(http.StatusGone, gin.H{"error": "File content no longer exists"})
+		return
+	}
+
+	updates := map[string]interface{}{"deleted_at": nil}
+	if file.FolderID != nil {
+		// The folder may have been deleted along with the file
+		if err := h.db(c).First(&models.Folder{}, *file.FolderID).Error; err != nil {
+			updates["folder_id"] = nil
+		}
+	}
+	if err := h.db(c).Unscoped().Model(&file).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore file"})
+		return
+	}
+
+	h.clearFileCache(file)
+
+	c.JSON(http.StatusOK, gin.H{"message": "File restored successfully"})
+}
+
+func (h *FileHandler) DeleteFilePermanently(c *gin.Context) {
+	file, ok := h.findTrashedFile(c)
+	if !ok {
+		return
+	}
+
+	if err := h.purgeFile(context.Background(), file); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file", "details": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "File deleted permanently"})
+}
+
+// purgeFile removes a file for good, releasing the blobs and the space of all
+// its versions.
+// PurgeTrash and DeleteFilePermanently may purge the same file at once, so
+// every step only takes effect for the caller that removed the row.
+func (h *FileHandler) purgeFile(ctx context.Context, file models.File) error {
+	if err := h.purgeVersions(ctx, file.ID); err != nil {
+		return err
+	}
+	if err := h.revokeShareLinks(ctx, file.ID); err != nil {
+		return err
+	}
+	if err := h.revokePermissions(ctx, file.ID); err != nil {
+		return err
+	}
+	return h.DB.Unscoped().Delete(&file).Error
+}
+
+// PurgeTrash permanently deletes files that have been in the trash longer than TRASH_RETENTION
+func (h *FileHandler) PurgeTrash() {
+	var files []models.File
+	cutoff := time.Now().Add(-h.TrashRetention)
+	if err := h.DB.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at <= ?", cutoff).Find(&files).Error; err != nil {
+		fmt.Println("Error fetching trash to purge:", err)
+		return
+	}
+
+	for _, file := range files {
+		if err := h.purgeFile(context.Background(), file); err != nil {
+			fmt.Println("Error purging file from trash:", file.ID, err)
+		}
+	}
+	if len(files) > 0 {
+		fmt.Printf("Purged %d files from trash\n", len(files))
+	}
+}
@@ -0,0 +1,369 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"file_manage/models"
+	"file_manage/utils"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Resumable uploads following the tus 1.0 protocol (https://tus.io/protocols/resumable-upload).
+// Chunks are staged on local disk and handed to saveUpload once complete.
+
+const tusVersion = "1.0.0"
+
+func (h *FileHandler) tusDir() string {
+	dir := os.Getenv("TUS_DIR")
+	if dir == "" {
+		dir = "tus_uploads"
+	}
+	return dir
+}
+
+func (h *FileHandler) tusPath(id string) string {
+	return filepath.Join(h.tusDir(), id)
+}
+
+// TusMiddleware sets the protocol headers and rejects unsupported client versions
+func (h *FileHandler) TusMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Resumable", tusVersion)
+		if c.Request.Method != http.MethodOptions && c.GetHeader("Tus-Resumable") != tusVersion {
+			c.Header("Tus-Version", tusVersion)
+			c.AbortWithStatus(http.StatusPreconditionFailed)
+			return
+		}
+		c.Next()
+	}
+}
+
+func (h *FileHandler) TusOptions(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", "creation,expiration,termination")
+	c.Header("Tus-Max-Size", strconv.FormatInt(h.MaxFileSize, 10))
+	c.Status(http.StatusNoContent)
+}
+
+func (h *FileHandler) TusCreate(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Length"})
+		return
+	}
+	if h.MaxFileSize > 0 && length > h.MaxFileSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File exceeds the maximum size"})
+		return
+	}
+
+	metadata := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	fileName := metadata["filename"]
+	if fileName == "" {
+		fileName = metadata["name"]
+	}
+	if fileName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Metadata must include a filename"})
+		return
+	}
+
+	// Refuse early rather than after the client sent every byte
+	if err := h.checkFileType(c.GetUint("orgID"), userID.(uint), fileName, nil); err != nil {
+		rejectFile(c, err)
+		return
+	}
+	if err := h.checkFileSize(c.GetUint("orgID"), userID.(uint), fileName, length); err != nil {
+		rejectFile(c, err)
+		return
+	}
+
+	if err := os.MkdirAll(h.tusDir(), 0755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+
+	target, ok := h.parseUploadTarget(c)
+	if !ok {
+		return
+	}
+
+	// The space stays reserved until the upload completes, is terminated or expires
+	res, err := h.reserve(userID.(uint), target.OrganizationID, length)
+	if err != nil {
+		c.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	upload := models.TusUpload{
+		ID:        uuid.New().String(),
+		FolderID:  target.FolderID,
+		GroupID:   target.GroupID,
+		UserID:    userID.(uint),
+		Length:    length,
+		FileName:  filepath.Base(fileName),
+		Metadata:  c.GetHeader("Upload-Metadata"),
+		ExpiresAt: time.Now().Add(utils.EnvDuration("TUS_EXPIRY", 24*time.Hour)),
+	}
+	f, err := os.Create(h.tusPath(upload.ID))
+	if err != nil {
+		h.release(res)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+	f.Close()
+
+	if err := h.db(c).Create(&upload).Error; err != nil {
+		h.release(res)
+		os.Remove(h.tusPath(upload.ID))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+
+	// Nothing will ever be PATCHed to an empty upload
+	if upload.Length == 0 {
+		if err := h.finishTusUpload(c.Request.Context(), &upload); err != nil {
+			c.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.Header("Location", "/uploads/"+upload.ID)
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusCreated)
+}
+
+func (h *FileHandler) TusHead(c *gin.Context) {
+	upload, ok := h.findTusUpload(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.Metadata != "" {
+		c.Header("Upload-Metadata", upload.Metadata)
+	}
+	c.Status(http.StatusOK)
+}
+
+func (h *FileHandler) TusPatch(c *gin.Context) {
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+
+	upload, ok := h.findTusUpload(c)
+	if !ok {
+		return
+	}
+	if upload.FileID != 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Upload is already complete"})
+		return
+	}
+
+	// Only one PATCH may append to an upload at a time
+	ctx := context.Background()
+	lockKey := fmt.Sprintf("tus_lock:%s", upload.ID)
+	locked, err := h.Redis.SetNX(ctx, lockKey, 1, time.Hour).Result()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lock upload"})
+		return
+	}
+	if !locked {
+		c.JSON(http.StatusLocked, gin.H{"error": "Upload is being written by another request"})
+		return
+	}
+	defer h.Redis.Del(ctx, lockKey)
+
+	// Another PATCH may have appended between loading the upload and locking it
+	if err := h.db(c).Where("id = ?", upload.ID).First(&upload).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch upload"})
+		return
+	}
+	if upload.FileID != 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Upload is already complete"})
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Offset {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload-Offset does not match the current offset"})
+		return
+	}
+
+	f, err := os.OpenFile(h.tusPath(upload.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open upload"})
+		return
+	}
+
+	// Keep whatever arrived before a disconnect so the client can resume from there
+	written, copyErr := io.Copy(f, io.LimitReader(c.Request.Body, upload.Length-upload.Offset))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	// The offset only moves from where this request started, should the lock
+	// ever have lapsed while it was writing
+	upload.Offset += written
+	upload.ExpiresAt = time.Now().Add(utils.EnvDuration("TUS_EXPIRY", 24*time.Hour))
+	result := h.db(c).Model(&models.TusUpload{}).Where("id = ?", upload.ID).
+		Where(map[string]interface{}{"offset": offset}).Updates(map[string]interface{}{
+		"offset":     upload.Offset,
+		"expires_at": upload.ExpiresAt,
+	})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record upload progress"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload was written by another request"})
+		return
+	}
+
+	if copyErr != nil {
+		log.Printf("tus upload %s interrupted at offset %d: %v", upload.ID, upload.Offset, copyErr)
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+
+	if upload.Offset == upload.Length {
+		if err := h.finishTusUpload(c.Request.Context(), &upload); err != nil {
+			c.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusNoContent)
+}
+
+func (h *FileHandler) TusDelete(c *gin.Context) {
+	upload, ok := h.findTusUpload(c)
+	if !ok {
+		return
+	}
+
+	if err := h.db(c).Delete(&upload).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to terminate upload"})
+		return
+	}
+	os.Remove(h.tusPath(upload.ID))
+	h.releaseUpload(upload)
+	c.Status(http.StatusNoContent)
+}
+
+// finishTusUpload moves the staged bytes into storage through the same path as Upload
+func (h *FileHandler) finishTusUpload(ctx context.Context, upload *models.TusUpload) error {
+	f, err := os.Open(h.tusPath(upload.ID))
+	if err != nil {
+		return fmt.Errorf("failed to open staged upload: %w", err)
+	}
+	defer f.Close()
+
+	res := &reservation{UserID: upload.UserID, OrganizationID: upload.OrganizationID, Bytes: upload.Length}
+	fileRecord, _, err := h.saveUpload(ctx, uploadTarget{OrganizationID: upload.OrganizationID, UserID: upload.UserID, GroupID: upload.GroupID, FolderID: upload.FolderID}, upload.FileName, f, res)
+	if err != nil {
+		return err
+	}
+	h.release(res)
+
+	upload.FileID = fileRecord.ID
+	if err := h.DB.WithContext(ctx).Model(upload).Update("file_id", fileRecord.ID).Error; err != nil {
+		return fmt.Errorf("failed to record completed upload: %w", err)
+	}
+	os.Remove(h.tusPath(upload.ID))
+
+	h.clearFileCache(*fileRecord)
+	return nil
+}
+
+// findTusUpload loads the caller's upload and writes the error response if there is none
+func (h *FileHandler) findTusUpload(c *gin.Context) (models.TusUpload, bool) {
+	userID, _ := c.Get("userID")
+
+	var upload models.TusUpload
+	err := h.db(c).Where("id = ? AND user_id = ?", c.Param("uploadID"), userID).First(&upload).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch upload"})
+		}
+		return upload, false
+	}
+	if upload.FileID == 0 && time.Now().After(upload.ExpiresAt) {
+		c.JSON(http.StatusGone, gin.H{"error": "Upload has expired"})
+		return upload, false
+	}
+	return upload, true
+}
+
+// PurgeExpiredUploads removes incomplete uploads past their Upload-Expires and
+// forgets completed ones once they expire as well
+func (h *FileHandler) PurgeExpiredUploads() {
+	var expired []models.TusUpload
+	if err := h.DB.Where("expires_at <= ?", time.Now()).Find(&expired).Error; err != nil {
+		fmt.Println("Error fetching expired uploads:", err)
+		return
+	}
+
+	for _, upload := range expired {
+		os.Remove(h.tusPath(upload.ID))
+		if err := h.DB.Delete(&upload).Error; err != nil {
+			fmt.Println("Error deleting expired upload:", upload.ID, err)
+			continue
+		}
+		h.releaseUpload(upload)
+	}
+	if len(expired) > 0 {
+		fmt.Printf("Purged %d expired uploads\n", len(expired))
+	}
+}
+
+// releaseUpload gives back the space reserved for an upload that won't complete
+func (h *FileHandler) releaseUpload(upload models.TusUpload) {
+	if upload.FileID == 0 {
+		h.release(&reservation{UserID: upload.UserID, OrganizationID: upload.OrganizationID, Bytes: upload.Length})
+	}
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2"
+func parseTusMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata
+}
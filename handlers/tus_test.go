@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"file_manage/models"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tusCreate(t *testing.T, h *FileHandler, user models.User, name string, length string) string {
+	t.Helper()
+	w := do(testRouter(h), user, http.MethodPost, "/uploads", nil, map[string]string{
+		"Tus-Resumable":   tusVersion,
+		"Upload-Length":   length,
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(name)),
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d, body %s", w.Code, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+func tusPatch(h *FileHandler, user models.User, location, offset, chunk string) (int, string) {
+	w := do(testRouter(h), user, http.MethodPatch, location, strings.NewReader(chunk), map[string]string{
+		"Tus-Resumable": tusVersion,
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": offset,
+	})
+	return w.Code, w.Header().Get("Upload-Offset")
+}
+
+// completedFile returns the file a finished upload created
+func completedFile(t *testing.T, h *FileHandler, location string) models.File {
+	t.Helper()
+	var upload models.TusUpload
+	if err := h.DB.Where("id = ?", strings.TrimPrefix(location, "/uploads/")).First(&upload).Error; err != nil {
+		t.Fatalf("load upload: %v", err)
+	}
+	if upload.FileID == 0 {
+		t.Fatalf("upload %s is not complete", upload.ID)
+	}
+	var file models.File
+	if err := h.DB.First(&file, upload.FileID).Error; err != nil {
+		t.Fatalf("load file: %v", err)
+	}
+	return file
+}
+
+func readContent(t *testing.T, h *FileHandler, file models.File) string {
+	t.Helper()
+	r, err := h.Storage.Get(context.Background(), file.URL)
+	if err != nil {
+		t.Fatalf("open %s: %v", file.URL, err)
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %s: %v", file.URL, err)
+	}
+	return string(content)
+}
+
+func TestTusUploadInChunks(t *testing.T) {
+	h := newTestHandler(t)
+	user := createUser(t, h, "acme", "alice@example.com")
+	location := tusCreate(t, h, user, "hello.txt", "11")
+
+	if status, offset := tusPatch(h, user, location, "0", "hello "); status != http.StatusNoContent || offset != "6" {
+		t.Fatalf("first chunk: status %d, offset %s, want 204 and 6", status, offset)
+	}
+	// A retry of the same chunk is told where the upload really is
+	if status, offset := tusPatch(h, user, location, "0", "hello "); status != http.StatusConflict || offset != "6" {
+		t.Fatalf("repeated chunk: status %d, offset %s, want 409 and 6", status, offset)
+	}
+	if status, offset := tusPatch(h, user, location, "6", "world"); status != http.StatusNoContent || offset != "11" {
+		t.Fatalf("last chunk: status %d, offset %s, want 204 and 11", status, offset)
+	}
+
+	file := completedFile(t, h, location)
+	if got := readContent(t, h, file); got != "hello world" {
+		t.Errorf("content = %q, want %q", got, "hello world")
+	}
+	if status, _ := tusPatch(h, user, location, "11", "!"); status != http.StatusForbidden {
+		t.Errorf("patch after completion: status %d, want 403", status)
+	}
+
+	h.DB.First(&user, user.ID)
+	if user.UsedBytes != 11 {
+		t.Errorf("used bytes = %d, want 11", user.UsedBytes)
+	}
+}
+
+func TestTusPatchWhileLocked(t *testing.T) {
+	h := newTestHandler(t)
+	user := createUser(t, h, "acme", "alice@example.com")
+	location := tusCreate(t, h, user, "hello.txt", "5")
+
+	// Another request is appending to the upload
+	id := strings.TrimPrefix(location, "/uploads/")
+	h.Redis.Set(context.Background(), "tus_lock:"+id, 1, time.Hour)
+	if status, _ := tusPatch(h, user, location, "0", "hello"); status != http.StatusLocked {
+		t.Fatalf("patch while locked: status %d, want 423", status)
+	}
+
+	h.Redis.Del(context.Background(), "tus_lock:"+id)
+	if status, offset := tusPatch(h, user, location, "0", "hello"); status != http.StatusNoContent || offset != "5" {
+		t.Fatalf("patch after unlock: status %d, offset %s, want 204 and 5", status, offset)
+	}
+}
+
+func TestTusPatchOtherUser(t *testing.T) {
+	h := newTestHandler(t)
+	alice := createUser(t, h, "acme", "alice@example.com")
+	bob := createUser(t, h, "acme", "bob@example.com")
+	location := tusCreate(t, h, alice, "hello.txt", "5")
+
+	if status, _ := tusPatch(h, bob, location, "0", "hello"); status != http.StatusNotFound {
+		t.Errorf("patch by another user: status %d, want 404", status)
+	}
+}
+
+func TestTusEmptyUpload(t *testing.T) {
+	h := newTestHandler(t)
+	user := createUser(t, h, "acme", "alice@example.com")
+
+	// Nothing is ever patched to an empty upload, so creating it completes it
+	location := tusCreate(t, h, user, "empty.txt", "0")
+	file := completedFile(t, h, location)
+	if file.Name != "empty.txt" || file.Size != 0 {
+		t.Errorf("file = %s of %d bytes, want empty.txt of 0 bytes", file.Name, file.Size)
+	}
+}
@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"file_manage/models"
+	"file_manage/utils"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var errFileTooLarge = errors.New("file exceeds the maximum allowed size")
+
+// meteredReader counts and hashes everything read through it and fails once
+// more than limit bytes have been seen. The first bytes are kept for SniffType.
+type meteredReader struct {
+	r     io.Reader
+	hash  hash.Hash
+	n     int64
+	limit int64
+	head  []byte
+}
+
+func newMeteredReader(r io.Reader, limit int64) *meteredReader {
+	return &meteredReader{r: r, hash: sha256.New(), limit: limit}
+}
+
+func (m *meteredReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.hash.Write(p[:n])
+	if len(m.head) < utils.SniffLen {
+		m.head = append(m.head, p[:min(n, utils.SniffLen-len(m.head))]...)
+	}
+	m.n += int64(n)
+	if m.limit > 0 && m.n > m.limit {
+		return n, errFileTooLarge
+	}
+	return n, err
+}
+
+func (m *meteredReader) Checksum() string {
+	return hex.EncodeToString(m.hash.Sum(nil))
+}
+
+// storeUpload streams r into the blob store and returns the blob holding it,
+// reporting whether the content was deduplicated against an existing blob.
+// At most UPLOAD_CONCURRENCY uploads are streamed at the same time.
+func (h *FileHandler) storeUpload(ctx context.Context, name string, r io.Reader) (models.Blob, bool, error) {
+	select {
+	case h.uploadSlots <- struct{}{}:
+		defer func() { <-h.uploadSlots }()
+	case <-ctx.Done():
+		return models.Blob{}, false, ctx.Err()
+	}
+
+	// The checksum is only known at the end, so stage the content first
+	stagingKey := "staging/" + uuid.New().String()
+	src := newMeteredReader(r, h.MaxFileSize)
+
+	var body io.Reader = src
+	blob := models.Blob{}
+	if h.MasterKey != nil {
+		// Every blob gets its own data key, only the wrapped form is stored
+		dataKey, err := utils.GenerateKey()
+		if err != nil {
+			return models.Blob{}, false, fmt.Errorf("failed to generate data key for file %s: %w", name, err)
+		}
+		if body, err = utils.NewEncryptReader(src, dataKey); err != nil {
+			return models.Blob{}, false, fmt.Errorf("failed to encrypt file %s: %w", name, err)
+		}
+		if blob.WrappedKey, err = utils.WrapKey(dataKey, h.MasterKey); err != nil {
+			return models.Blob{}, false, fmt.Errorf("failed to wrap data key for file %s: %w", name, err)
+		}
+		blob.EncryptionScheme = utils.StreamScheme
+		blob.KeyID = utils.MasterKeyID(h.MasterKey)
+	}
+
+	if _, err := h.Storage.Put(ctx, stagingKey, body); err != nil {
+		h.Storage.Delete(context.Background(), stagingKey)
+		if errors.Is(err, errFileTooLarge) {
+			return models.Blob{}, false, err
+		}
+		return models.Blob{}, false, fmt.Errorf("failed to save file %s: %w", name, err)
+	}
+
+	blob.Checksum = src.Checksum()
+	blob.Size = src.n
+	blob.MimeType = utils.SniffType(src.head)
+	sniffed := blob.MimeType
+	if h.Scanner != nil {
+		blob.ScanStatus = scanPending
+	}
+	blob, deduplicated, err := h.storeBlob(ctx, stagingKey, blob)
+	if err != nil {
+		h.Storage.Delete(context.Background(), stagingKey)
+		return models.Blob{}, false, fmt.Errorf("failed to save file %s: %w", name, err)
+	}
+	if blob.MimeType == "" {
+		// Stored before types were detected and not backfilled yet
+		blob.MimeType = sniffed
+		h.DB.WithContext(ctx).Model(&blob).UpdateColumn("mime_type", sniffed)
+	}
+	if !deduplicated && blob.ScanStatus == scanPending {
+		h.queueScan(blob.ID)
+	} else {
+		h.scanNewBlob(ctx, &blob)
+	}
+	// Text is extracted once the content passed its scan
+	h.queueText(blob)
+	return blob, deduplicated, nil
+}
+
+// uploadGate lets a caller put its own limits on the files of a request
+type uploadGate struct {
+	MaxFileSize int64                   // per file, on top of MAX_UPLOAD_FILE_SIZE
+	Admit       func(name string) error // called before a file is stored
+	Failed      func()                  // an admitted file could not be stored
+}
+
+func (g uploadGate) admit(name string) error {
+	if g.Admit == nil {
+		return nil
+	}
+	return g.Admit(name)
+}
+
+// receiveFiles stores every "file" part of a multipart request at target
+// and writes the response, returning the files it created
+func (h *FileHandler) receiveFiles(c *gin.Context, target uploadTarget, gate uploadGate) []models.File {
+	// The whole request is reserved against the quota before any of it is
+	// stored, the part not used by files is given back at the end
+	if c.Request.ContentLength < 0 {
+		c.JSON(http.StatusLengthRequired, gin.H{"error": "Content-Length is required"})
+		return nil
+	}
+	if c.Request.ContentLength > h.MaxRequestSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Request exceeds the maximum size of %d bytes", h.MaxRequestSize)})
+		return nil
+	}
+	res, err := h.reserve(target.UserID, target.OrganizationID, c.Request.ContentLength)
+	if err != nil {
+		c.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
+		return nil
+	}
+	defer h.release(res)
+
+	// Stream the parts one by one instead of buffering the whole form
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.MaxRequestSize)
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse multipart form"})
+		return nil
+	}
+
+	var saved []models.File
+	var uploaded []gin.H
+	var uploadErrors []string
+	var rejected []*policyViolation // files the upload policy refused, with the reason
+	status := http.StatusInternalServerError
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				status = http.StatusRequestEntityTooLarge
+				uploadErrors = append(uploadErrors, fmt.Sprintf("Request exceeds the maximum size of %d bytes", h.MaxRequestSize))
+			} else {
+				uploadErrors = append(uploadErrors, fmt.Sprintf("Failed to read multipart form: %v", err))
+			}
+			break
+		}
+
+		if part.FormName() != "file" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		var fileRecord *models.File
+		var deduplicated bool
+		err = gate.admit(part.FileName())
+		if err == nil {
+			var r io.Reader = part
+			if gate.MaxFileSize > 0 {
+				r = newMeteredReader(part, gate.MaxFileSize)
+			}
+			fileRecord, deduplicated, err = h.saveUpload(c.Request.Context(), target, part.FileName(), r, res)
+			if err != nil && gate.Failed != nil {
+				gate.Failed()
+			}
+		}
+		part.Close()
+		if err != nil {
+			status = uploadErrorStatus(err)
+			var violation *policyViolation
+			if errors.As(err, &violation) {
+				rejected = append(rejected, violation)
+				uploadErrors = append(uploadErrors, violation.Error())
+				continue
+			}
+			var maxErr *http.MaxBytesError
+			if errors.Is(err, errFileTooLarge) || errors.As(err, &maxErr) {
+				uploadErrors = append(uploadErrors, fmt.Sprintf("File %s exceeds the maximum size", part.FileName()))
+				if maxErr != nil {
+					break
+				}
+				continue
+			}
+			uploadErrors = append(uploadErrors, err.Error())
+			continue
+		}
+
+		saved = append(saved, *fileRecord)
+		uploaded = append(uploaded, gin.H{
+			"id":           fileRecord.ID,
+			"name":         fileRecord.Name,
+			"size":         fileRecord.Size,
+			"checksum":     fileRecord.Checksum,
+			"deduplicated": deduplicated,
+		})
+	}
+
+	if len(uploaded) > 0 {
+		cacheKey := target.workspace().cacheKey()
+		h.Redis.Del(context.Background(), cacheKey)
+	}
+
+	// Check if there were any errors and return them
+	if len(uploadErrors) > 0 {
+		c.JSON(status, gin.H{"errors": uploadErrors, "files": uploaded, "rejected": rejected})
+		return saved
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Files uploaded successfully", "files": uploaded})
+	return saved
+}
+
+// uploadTarget says who uploads a new file and where it goes
+type uploadTarget struct {
+	OrganizationID uint
+	UserID         uint
+	GroupID        *uint
+	FolderID       *uint
+}
+
+func (t uploadTarget) workspace() workspace {
+	return workspace{OrganizationID: t.OrganizationID, UserID: t.UserID, GroupID: t.GroupID}
+}
+
+// saveUpload streams r into storage and records it as a new file at target,
+// with the content as its first version. The file's size is taken from res,
+// space set aside for the upload before it started.
+func (h *FileHandler) saveUpload(ctx context.Context, target uploadTarget, name string, r io.Reader, res *reservation) (*models.File, bool, error) {
+	r, err := h.admitUpload(target.OrganizationID, target.UserID, name, r)
+	if err != nil {
+		return nil, false, err
+	}
+	blob, deduplicated, err := h.storeUpload(ctx, name, r)
+	if err != nil {
+		return nil, false, err
+	}
+
+	fileRecord := models.File{
+		Name:     name,
+		Size:     blob.Size,
+		URL:      blob.StorageKey,
+		UserID:   target.UserID,
+		GroupID:  target.GroupID,
+		FolderID: target.FolderID,
+		Checksum: blob.Checksum,
+		BlobID:   blob.ID,
+		Version:  1,
+	}
+	setFileType(&fileRecord, blob)
+	var covered int64
+	err = h.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if covered, err = chargeUsage(tx, target.UserID, target.OrganizationID, blob.Size, res); err != nil {
+			return err
+		}
+		if err := tx.Create(&fileRecord).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.FileVersion{
+			FileID:     fileRecord.ID,
+			Version:    1,
+			BlobID:     blob.ID,
+			Size:       blob.Size,
+			Checksum:   blob.Checksum,
+			UploaderID: target.UserID,
+		}).Error
+	})
+	if err != nil {
+		h.releaseBlob(context.Background(), blob.ID)
+		if errors.Is(err, errQuotaExceeded) {
+			return nil, false, err
+		}
+		return nil, false, fmt.Errorf("failed to save metadata for file %s: %w", name, err)
+	}
+	if res != nil {
+		res.Bytes -= covered
+	}
+	h.queueThumbnails(blob)
+	return &fileRecord, deduplicated, nil
+}
@@ -0,0 +1,465 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"file_manage/models"
+	"file_manage/utils"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// findVersion loads the version named by the version route parameter
+func (h *FileHandler) findVersion(c *gin.Context, file models.File, param string) (models.FileVersion, bool) {
+	var version models.FileVersion
+	number, err := strconv.Atoi(param)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return version, false
+	}
+
+	if err := h.db(c).Where("file_id = ? AND version = ?", file.ID, number).First(&version).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch version"})
+		}
+		return version, false
+	}
+	return version, true
+}
+
+// addVersion makes blob the current content of file. The new version takes
+// over the caller's reference to the blob. Its full size is charged to the
+// file's owner, taken from res first when given.
+func (h *FileHandler) addVersion(file *models.File, blob models.Blob, uploaderID uint, res *reservation) (models.FileVersion, error) {
+	var version models.FileVersion
+	var covered int64
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		// Bump the counter first so concurrent uploads get distinct numbers
+		if err := tx.Model(&models.File{}).Where("id = ?", file.ID).
+			UpdateColumn("version", gorm.Expr("version + 1")).Error; err != nil {
+			return err
+		}
+		if err := tx.First(file, file.ID).Error; err != nil {
+			return err
+		}
+
+		var err error
+		if covered, err = chargeUsage(tx, file.UserID, file.OrganizationID, blob.Size, res); err != nil {
+			return err
+		}
+
+		version = models.FileVersion{
+			FileID:     file.ID,
+			Version:    file.Version,
+			BlobID:     blob.ID,
+			Size:       blob.Size,
+			Checksum:   blob.Checksum,
+			UploaderID: uploaderID,
+		}
+		if err := tx.Create(&version).Error; err != nil {
+			return err
+		}
+
+		file.BlobID = blob.ID
+		file.URL = blob.StorageKey
+		file.Size = blob.Size
+		file.Checksum = blob.Checksum
+		setFileType(file, blob)
+		return tx.Save(file).Error
+	})
+	if err != nil {
+		return version, err
+	}
+	if res != nil {
+		res.Bytes -= covered
+	}
+
+	h.applyRetention(*file)
+	h.queueThumbnails(blob)
+	return version, nil
+}
+
+// applyRetention removes versions outside VERSION_RETENTION_COUNT or older than
+// VERSION_RETENTION_AGE. The current version is always kept.
+func (h *FileHandler) applyRetention(file models.File) {
+	if h.VersionRetentionCount <= 0 && h.VersionRetentionAge <= 0 {
+		return
+	}
+
+	var versions []models.FileVersion
+	if err := h.DB.Where("file_id = ?", file.ID).Order("version desc").Find(&versions).Error; err != nil {
+		fmt.Println("Error fetching versions for retention:", err)
+		return
+	}
+
+	for i, version := range versions {
+		if version.Version == file.Version {
+			continue
+		}
+		tooMany := h.VersionRetentionCount > 0 && int64(i) >= h.VersionRetentionCount
+		tooOld := h.VersionRetentionAge > 0 && time.Since(version.CreatedAt) > h.VersionRetentionAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := h.deleteVersion(context.Background(), version); err != nil {
+			fmt.Println("Error pruning version:", version.ID, err)
+		}
+	}
+}
+
+// deleteVersion removes one version, releasing its blob and the space it was
+// charged. Retention, trash purges and permanent deletes can race for the
+// same row, so both are only released by whichever of them deleted it.
+func (h *FileHandler) deleteVersion(ctx context.Context, version models.FileVersion) error {
+	deleted := false
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(&models.FileVersion{}, version.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return nil
+		}
+		deleted = true
+		var file models.File
+		if err := tx.Unscoped().Select("id", "user_id", "organization_id").First(&file, version.FileID).Error; err != nil {
+			return err
+		}
+		if err := adjustUsage(tx, file.UserID, file.OrganizationID, -version.Size); err != nil {
+			return err
+		}
+		return dropBlobRef(tx, version.BlobID)
+	})
+	if err != nil || !deleted {
+		return err
+	}
+	return h.collectBlob(ctx, version.BlobID)
+}
+
+// PruneVersions applies the retention policy to every file with history, so
+// age based retention also applies to files that stopped changing
+func (h *FileHandler) PruneVersions() {
+	if h.VersionRetentionCount <= 0 && h.VersionRetentionAge <= 0 {
+		return
+	}
+
+	var files []models.File
+	if err := h.DB.Where("version > 1").Find(&files).Error; err != nil {
+		fmt.Println("Error fetching files for version retention:", err)
+		return
+	}
+	for _, file := range files {
+		h.applyRetention(file)
+	}
+}
+
+// purgeVersions deletes the whole history of a file and releases its blobs.
+// Versions another purge already removed are skipped by deleteVersion.
+func (h *FileHandler) purgeVersions(ctx context.Context, fileID uint) error {
+	var versions []models.FileVersion
+	if err := h.DB.Where("file_id = ?", fileID).Find(&versions).Error; err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if err := h.deleteVersion(ctx, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *FileHandler) UploadVersion(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	file, ok := h.findFile(c, accessWrite)
+	if !ok {
+		return
+	}
+
+	// Reserved against the owner's quota before anything is stored, like Upload
+	if c.Request.ContentLength < 0 {
+		c.JSON(http.StatusLengthRequired, gin.H{"error": "Content-Length is required"})
+		return
+	}
+	res, err := h.reserve(file.UserID, file.OrganizationID, c.Request.ContentLength)
+	if err != nil {
+		c.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	defer h.release(res)
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.MaxRequestSize)
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse multipart form"})
+		return
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to get file from request"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse multipart form"})
+			return
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		// The new content is checked against the uploader's policy
+		content, err := h.admitUpload(file.OrganizationID, userID.(uint), file.Name, part)
+		var blob models.Blob
+		var deduplicated bool
+		if err == nil {
+			blob, deduplicated, err = h.storeUpload(c.Request.Context(), file.Name, content)
+		}
+		part.Close()
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			var violation *policyViolation
+			if errors.As(err, &violation) {
+				rejectFile(c, violation)
+			} else if errors.Is(err, errFileTooLarge) || errors.As(err, &maxErr) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File exceeds the maximum size"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		version, err := h.addVersion(&file, blob, userID.(uint), res)
+		if err != nil {
+			h.releaseBlob(context.Background(), blob.ID)
+			if errors.Is(err, errQuotaExceeded) {
+				c.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save version"})
+			return
+		}
+
+		cacheKey := fileWorkspace(file).cacheKey()
+		h.Redis.Del(context.Background(), cacheKey)
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":      "Version uploaded successfully",
+			"version":      version.Version,
+			"size":         version.Size,
+			"checksum":     version.Checksum,
+			"deduplicated": deduplicated,
+		})
+		return
+	}
+}
+
+type versionInfo struct {
+	Version       int       `json:"version"`
+	Size          int64     `json:"size"`
+	Checksum      string    `json:"checksum"`
+	UploaderID    uint      `json:"uploader_id"`
+	UploaderEmail string    `json:"uploader_email"`
+	CreatedAt     time.Time `json:"created_at"`
+	Current       bool      `json:"current"`
+}
+
+func (h *FileHandler) ListVersions(c *gin.Context) {
+	file, ok := h.findFile(c, accessRead)
+	if !ok {
+		return
+	}
+
+	var versions []versionInfo
+	err := h.db(c).Table("file_versions").
+		Select("file_versions.version, file_versions.size, file_versions.checksum, file_versions.uploader_id, users.email AS uploader_email, file_versions.created_at").
+		Joins("LEFT JOIN users ON users.id = file_versions.uploader_id").
+		Where("file_versions.file_id = ?", file.ID).
+		Order("file_versions.version DESC").
+		Scan(&versions).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve versions"})
+		return
+	}
+	for i := range versions {
+		versions[i].Current = versions[i].Version == file.Version
+	}
+
+	c.JSON(http.StatusOK, versions)
+}
+
+func (h *FileHandler) DownloadVersion(c *gin.Context) {
+	file, ok := h.findFile(c, accessRead)
+	if !ok {
+		return
+	}
+	version, ok := h.findVersion(c, file, c.Param("version"))
+	if !ok {
+		return
+	}
+
+	var blob models.Blob
+	if err := h.db(c).First(&blob, version.BlobID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	h.serveBlob(c, blob, file.Name, version.CreatedAt)
+}
+
+// RestoreVersion makes an old version current again by adding it as a new version
+func (h *FileHandler) RestoreVersion(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	file, ok := h.findFile(c, accessWrite)
+	if !ok {
+		return
+	}
+	version, ok := h.findVersion(c, file, c.Param("version"))
+	if !ok {
+		return
+	}
+
+	var blob models.Blob
+	if err := h.db(c).First(&blob, version.BlobID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if err := h.retainBlob(blob.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore version"})
+		return
+	}
+
+	restored, err := h.addVersion(&file, blob, userID.(uint), nil)
+	if err != nil {
+		h.releaseBlob(context.Background(), blob.ID)
+		if errors.Is(err, errQuotaExceeded) {
+			c.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore version"})
+		return
+	}
+
+	cacheKey := fileWorkspace(file).cacheKey()
+	h.Redis.Del(context.Background(), cacheKey)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Version restored successfully",
+		"version":       restored.Version,
+		"restored_from": version.Version,
+	})
+}
+
+// DiffVersions returns a unified diff between two versions of a text file
+func (h *FileHandler) DiffVersions(c *gin.Context) {
+	file, ok := h.findFile(c, accessRead)
+	if !ok {
+		return
+	}
+
+	from, to := c.Query("from"), c.Query("to")
+	if to == "" {
+		to = strconv.Itoa(file.Version)
+	}
+	if from == "" {
+		if file.Version <= 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "File has no earlier version to compare with"})
+			return
+		}
+		from = strconv.Itoa(file.Version - 1)
+	}
+	fromVersion, ok := h.findVersion(c, file, from)
+	if !ok {
+		return
+	}
+	toVersion, ok := h.findVersion(c, file, to)
+	if !ok {
+		return
+	}
+
+	fromText, err := h.readVersionText(c.Request.Context(), fromVersion)
+	if err == nil {
+		var toText string
+		toText, err = h.readVersionText(c.Request.Context(), toVersion)
+		if err == nil {
+			diff := utils.UnifiedDiff(fromText, toText,
+				fmt.Sprintf("%s (version %d)", file.Name, fromVersion.Version),
+				fmt.Sprintf("%s (version %d)", file.Name, toVersion.Version), 3)
+			c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(diff))
+			return
+		}
+	}
+
+	if respondHeld(c, err) {
+		return
+	} else if errors.Is(err, errNotText) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	} else {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read versions"})
+	}
+}
+
+var errNotText = errors.New("only text files up to DIFF_MAX_SIZE bytes can be diffed")
+
+// readVersionText loads a version's content if it is reasonably sized UTF-8 text
+func (h *FileHandler) readVersionText(ctx context.Context, version models.FileVersion) (string, error) {
+	if version.Size > h.DiffMaxSize {
+		return "", errNotText
+	}
+
+	var blob models.Blob
+	if err := h.DB.First(&blob, version.BlobID).Error; err != nil {
+		return "", err
+	}
+	reader, err := h.openBlob(ctx, blob)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(io.LimitReader(reader, h.DiffMaxSize+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(content)) > h.DiffMaxSize || !utf8.Valid(content) || bytes.IndexByte(content, 0) >= 0 {
+		return "", errNotText
+	}
+	return string(content), nil
+}
+
+// MigrateLegacyVersions gives files created before versioning their first version
+func (h *FileHandler) MigrateLegacyVersions() error {
+	var files []models.File
+	if err := h.DB.Unscoped().Where("version = 0 OR version IS NULL").Find(&files).Error; err != nil {
+		return err
+	}
+	for _, file := range files {
+		err := h.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&models.FileVersion{
+				FileID:     file.ID,
+				Version:    1,
+				BlobID:     file.BlobID,
+				Size:       file.Size,
+				Checksum:   file.Checksum,
+				UploaderID: file.UserID,
+				CreatedAt:  file.CreatedAt,
+			}).Error; err != nil {
+				return err
+			}
+			return tx.Model(&models.File{}).Unscoped().Where("id = ?", file.ID).UpdateColumn("version", 1).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"file_manage/models"
+	"file_manage/utils"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// previewTypes are the MIME types /view/:token/content serves inline, as
+// detected from the content rather than the name. Anything a browser could
+// run script from, like HTML or SVG, is left out and only offered as a
+// download. Text of any kind is served as plain text.
+var previewTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/bmp":       true,
+	"application/pdf": true,
+	"audio/mpeg":      true,
+	"audio/wav":       true,
+	"audio/ogg":       true,
+	"audio/mp4":       true,
+	"audio/flac":      true,
+	"video/mp4":       true,
+	"video/webm":      true,
+	"video/ogg":       true,
+	"video/quicktime": true,
+}
+
+// previewType returns the Content-Type the content of a file is previewed as
+func previewType(name string, blob models.Blob) (string, bool) {
+	t := utils.DetectType(name, blob.MimeType)
+	switch {
+	case t.Category == utils.CategoryText:
+		return "text/plain; charset=utf-8", true
+	case previewTypes[t.MimeType]:
+		return t.MimeType, true
+	}
+	return "", false
+}
+
+// previewKind says how the landing page embeds a preview
+func previewKind(contentType string) string {
+	switch {
+	case contentType == "application/pdf":
+		return "pdf"
+	case strings.HasPrefix(contentType, "text/"):
+		return "text"
+	default:
+		return strings.SplitN(contentType, "/", 2)[0]
+	}
+}
+
+// formatSize renders a size in bytes for people
+func formatSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	size := float64(n)
+	for _, unit := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		size /= 1024
+		if size < 1024 || unit == "TiB" {
+			return fmt.Sprintf("%.1f %s", size, unit)
+		}
+	}
+	return ""
+}
+
+// plural counts things for people, "1 file" and "2 files"
+func plural(n int, word string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, word)
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+// ViewContent serves the file of a share link inline for previews. Only the
+// types in previewTypes are served, never sniffed by the browser, and the
+// content is sandboxed so it can't run script on this origin.
+func (h *FileHandler) ViewContent(c *gin.Context) {
+	token := c.Param("token")
+	sharedFile := h.lookupShareLink(c, token)
+	if status, message := h.checkShareLink(c, token, sharedFile); status != 0 {
+		c.JSON(status, gin.H{"error": message})
+		return
+	}
+	if folderID, _ := strconv.ParseUint(sharedFile["folder_id"], 10, 64); folderID != 0 {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Folders can't be previewed"})
+		return
+	}
+
+	name := sharedFile["original_file_name"]
+	blob, modified, ok := h.shareBlob(c, sharedFile)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	contentType, ok := previewType(name, blob)
+	if !ok {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "This file type can't be previewed"})
+		return
+	}
+	if respondHeld(c, blobHeld(blob)) {
+		return
+	}
+
+	reader, ok := h.openBlobContent(c, blob)
+	if !ok {
+		return
+	}
+	defer reader.Close()
+
+	// Previews count as downloads, the same way DownloadFile counts them
+	limited := sharedFile["max_downloads"] != "" && sharedFile["max_downloads"] != "0"
+	if c.Request.Method != http.MethodHead && !notModified(c.Request, blobETag(blob), modified) {
+		if !h.countDownload(token, limited) {
+			c.JSON(http.StatusGone, gin.H{"error": "Link has reached its download limit"})
+			return
+		}
+	}
+
+	// Chrome refuses to render PDFs in a sandbox, they can't run script anyway
+	policy := "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'; frame-ancestors 'self'"
+	if contentType != "application/pdf" {
+		policy += "; sandbox"
+	}
+	c.Header("Content-Security-Policy", policy)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("X-Frame-Options", "SAMEORIGIN")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header("Cross-Origin-Resource-Policy", "same-origin")
+	writeBlob(c, reader, blob, name, modified, contentType, contentDisposition("inline", name))
+}
+
+// viewPage is what the landing page of a share link shows
+type viewPage struct {
+	Status      int
+	Message     string
+	Locked      bool
+	Failed      bool // the last unlock attempt failed
+	Token       string
+	Name        string
+	Size        string
+	Expires     string
+	Remaining   string
+	Folder      bool
+	Preview     string // how the preview is embedded, empty for none
+	Limited     bool   // previews use up downloads, so they are not embedded
+	ContentURL  string
+	DownloadURL string
+}
+
+// ViewShareLink renders the landing page of a share link with the file's
+// name, size and expiry, a preview where the browser can show the file and
+// a download button. Viewing the page doesn't count as a download.
+func (h *FileHandler) ViewShareLink(c *gin.Context) {
+	token := c.Param("token")
+	page := viewPage{Status: http.StatusOK, Token: token}
+
+	sharedFile := h.lookupShareLink(c, token)
+	status, message := h.checkShareLink(c, token, sharedFile)
+	switch status {
+	case 0:
+	case http.StatusUnauthorized:
+		page.Status, page.Locked = status, true
+		page.Failed = c.Query("unlock") == "failed"
+		h.renderViewPage(c, page)
+		return
+	default:
+		page.Status, page.Message = status, message
+		h.renderViewPage(c, page)
+		return
+	}
+
+	expiresUnix, _ := strconv.ParseInt(sharedFile["expires"], 10, 64)
+	page.Expires = time.Unix(expiresUnix, 0).UTC().Format("2 January 2006, 15:04 MST")
+	page.DownloadURL = "/download/" + token
+	page.Limited = sharedFile["max_downloads"] != "" && sharedFile["max_downloads"] != "0"
+	if page.Limited {
+		remaining, _ := strconv.Atoi(sharedFile["remaining"])
+		page.Remaining = plural(remaining, "download") + " left"
+	}
+
+	if folderID, _ := strconv.ParseUint(sharedFile["folder_id"], 10, 64); folderID != 0 {
+		owner, _ := strconv.ParseUint(sharedFile["owner_id"], 10, 64)
+		folder, err := h.findFolder(uint(owner), uint(folderID), accessRead)
+		if err != nil {
+			page.Status, page.Message = http.StatusNotFound, "Folder not found"
+			h.renderViewPage(c, page)
+			return
+		}
+		entries, err := h.folderEntries(c.Request.Context(), folder)
+		if err != nil {
+			page.Status, page.Message = http.StatusInternalServerError, "Failed to list folder"
+			h.renderViewPage(c, page)
+			return
+		}
+		var size int64
+		for _, entry := range entries {
+			size += entry.File.Size
+		}
+		page.Folder = true
+		page.Name = folder.Name
+		page.Size = formatSize(size) + " in " + plural(len(entries), "file")
+		h.renderViewPage(c, page)
+		return
+	}
+
+	blob, _, ok := h.shareBlob(c, sharedFile)
+	if !ok {
+		page.Status, page.Message = http.StatusNotFound, "File not found"
+		h.renderViewPage(c, page)
+		return
+	}
+	switch blobHeld(blob) {
+	case errScanPending:
+		page.Status, page.Message = http.StatusLocked, "The file is being scanned for malware, try again shortly"
+		h.renderViewPage(c, page)
+		return
+	case errQuarantined:
+		page.Status, page.Message = http.StatusForbidden, "The file is quarantined"
+		h.renderViewPage(c, page)
+		return
+	}
+	page.Name = sharedFile["original_file_name"]
+	page.Size = formatSize(blob.Size)
+	if contentType, ok := previewType(page.Name, blob); ok {
+		page.Preview = previewKind(contentType)
+		page.ContentURL = "/view/" + token + "/content"
+	}
+	h.renderViewPage(c, page)
+}
+
+func (h *FileHandler) renderViewPage(c *gin.Context, page viewPage) {
+	// The page itself has no script, previews may only come from this origin
+	c.Header("Content-Security-Policy", "default-src 'none'; img-src 'self'; media-src 'self'; frame-src 'self'; style-src 'unsafe-inline'; form-action 'self'; base-uri 'none'; frame-ancestors 'none'")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(page.Status)
+	if err := viewTemplate.Execute(c.Writer, page); err != nil {
+		fmt.Println("Error rendering share page:", err)
+	}
+}
+
+var viewTemplate = template.Must(template.New("view").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{if .Name}}{{.Name}}{{else}}Shared file{{end}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 48rem; margin: 2rem auto; padding: 0 1rem; color: #222; }
+h1 { font-size: 1.4rem; word-break: break-all; }
+.meta { color: #666; }
+.preview { margin: 1.5rem 0; }
+.preview img, .preview video { max-width: 100%; max-height: 70vh; }
+.preview audio { width: 100%; }
+.preview iframe { width: 100%; height: 70vh; border: 1px solid #ddd; }
+.button { display: inline-block; padding: .6rem 1.2rem; background: #2563eb; color: #fff; border: 0; border-radius: .3rem; text-decoration: none; font-size: 1rem; }
+.error { color: #b91c1c; }
+</style>
+</head>
+<body>
+{{- if .Locked}}
+<h1>This link is password protected</h1>
+{{- if .Failed}}
+<p class="error">The password is wrong or there were too many attempts, try again later.</p>
+{{- end}}
+<form method="post" action="/view/{{.Token}}/unlock">
+<input type="password" name="password" placeholder="Password" required autofocus>
+<button class="button" type="submit">Unlock</button>
+</form>
+{{- else if .Message}}
+<h1>{{.Message}}</h1>
+{{- else}}
+<h1>{{.Name}}</h1>
+<p class="meta">{{.Size}} &middot; Expires {{.Expires}}{{if .Remaining}} &middot; {{.Remaining}}{{end}}</p>
+{{- if .Preview}}
+<div class="preview">
+{{- if .Limited}}
+<a href="{{.ContentURL}}">Open preview</a> (uses one of the downloads)
+{{- else if eq .Preview "image"}}
+<img src="{{.ContentURL}}" alt="{{.Name}}">
+{{- else if eq .Preview "video"}}
+<video src="{{.ContentURL}}" controls preload="metadata"></video>
+{{- else if eq .Preview "audio"}}
+<audio src="{{.ContentURL}}" controls preload="metadata"></audio>
+{{- else if eq .Preview "pdf"}}
+<iframe src="{{.ContentURL}}" title="{{.Name}}"></iframe>
+{{- else}}
+<iframe src="{{.ContentURL}}" title="{{.Name}}" sandbox></iframe>
+{{- end}}
+</div>
+{{- end}}
+<p><a class="button" href="{{.DownloadURL}}">Download{{if .Folder}} as zip{{end}}</a></p>
+{{- end}}
+</body>
+</html>
+`))
@@ -4,9 +4,13 @@ import (
 	"context"
 	"file_manage/handlers"
 	"file_manage/models"
+	"file_manage/storage"
+	"file_manage/tenant"
 	"file_manage/utils"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 
 	"github.com/go-redis/redis/v8"
 
@@ -15,6 +19,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	// "gorm.io/gorm/logger"
 
@@ -22,9 +27,14 @@ import (
 )
 
 // Background worker to delete expired share URLs
-func backgroundWorker(db *gorm.DB, rdc *redis.Client) {
+func backgroundWorker(db *gorm.DB, rdc *redis.Client, fileHandler *handlers.FileHandler) {
 	for {
-		
+		fileHandler.PurgeExpiredUploads()
+		fileHandler.PruneVersions()
+		fileHandler.PurgeTrash()
+		fileHandler.QueueMissingThumbnails()
+		fileHandler.QueuePendingScans()
+		fileHandler.QueueMissingTexts()
 
 		var expiredFiles []models.File
 		if err := db.Where("public_url_expiry <= ? AND public_url != ?", time.Now(), "").Find(&expiredFiles).Error; err != nil {
@@ -51,7 +61,7 @@ func backgroundWorker(db *gorm.DB, rdc *redis.Client) {
 						fmt.Println("Error updating file URL and expiry:", err)
 					}
 
-					cacheKey := fmt.Sprintf("files_user_%v", file.UserID)
+					cacheKey := handlers.FileCacheKey(file.OrganizationID, file.UserID, file.GroupID)
 					if err := rdc.Del(context.Background(), cacheKey).Err(); err != nil {
 						fmt.Println("Error invalidating cache for file:", file.ID, err)
 					} else {
@@ -67,6 +77,160 @@ func backgroundWorker(db *gorm.DB, rdc *redis.Client) {
 	}
 }
 
+// rotateMasterKey rewraps every data key wrapped by MASTER_KEY_OLD with
+// MASTER_KEY, those of blobs as well as those of their thumbnails
+func rotateMasterKey(db *gorm.DB) error {
+	oldKey, err := utils.LoadMasterKey("MASTER_KEY_OLD")
+	if err != nil {
+		return err
+	}
+	newKey, err := utils.LoadMasterKey("MASTER_KEY")
+	if err != nil {
+		return err
+	}
+	if oldKey == nil || newKey == nil {
+		return fmt.Errorf("both MASTER_KEY_OLD and MASTER_KEY must be set")
+	}
+
+	oldID, newID := utils.MasterKeyID(oldKey), utils.MasterKeyID(newKey)
+	rotated := 0
+	for _, table := range []string{"blobs", "thumbnails"} {
+		var rows []struct {
+			ID         uint
+			WrappedKey string
+		}
+		result := db.Table(table).Select("id, wrapped_key").Where("key_id = ?", oldID).FindInBatches(&rows, 100, func(tx *gorm.DB, batch int) error {
+			for _, row := range rows {
+				dataKey, err := utils.UnwrapKey(row.WrappedKey, oldKey)
+				if err != nil {
+					return fmt.Errorf("failed to unwrap key of %s %d: %w", table, row.ID, err)
+				}
+				wrapped, err := utils.WrapKey(dataKey, newKey)
+				if err != nil {
+					return fmt.Errorf("failed to wrap key of %s %d: %w", table, row.ID, err)
+				}
+				if err := db.Table(table).Where("id = ?", row.ID).UpdateColumns(map[string]interface{}{"wrapped_key": wrapped, "key_id": newID}).Error; err != nil {
+					return err
+				}
+				rotated++
+			}
+			return nil
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+
+	fmt.Printf("Rewrapped %d data keys from master key %s to %s\n", rotated, oldID, newID)
+	return nil
+}
+
+// createOrganization adds a tenant users can register into, args are the
+// slug and an optional display name
+func createOrganization(db *gorm.DB, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("usage: create-organization <slug> [name]")
+	}
+	org := models.Organization{Slug: args[0], Name: args[0]}
+	if len(args) > 1 {
+		org.Name = strings.Join(args[1:], " ")
+	}
+	if err := db.Create(&org).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Created organization %s (%d)\n", org.Slug, org.ID)
+	return nil
+}
+
+// inviteUser lets an email address register into an organization, which is
+// how the first user of a new organization gets in
+func inviteUser(db *gorm.DB, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: invite-user <slug> <email>")
+	}
+	var org models.Organization
+	if err := db.Where("slug = ?", args[0]).First(&org).Error; err != nil {
+		return fmt.Errorf("no organization with slug %s", args[0])
+	}
+	invite := models.OrganizationInvite{
+		Email:          args[1],
+		OrganizationID: org.ID,
+		ExpiresAt:      time.Now().Add(utils.EnvDuration("ORGANIZATION_INVITE_EXPIRY", 7*24*time.Hour)),
+	}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "email"}, {Name: "organization_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"invited_by", "expires_at"}),
+	}).Create(&invite).Error
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s can now register into %s until %s\n", invite.Email, org.Slug, invite.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// grantAdmin makes a user an administrator of their organization
+func grantAdmin(db *gorm.DB, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: grant-admin <email>")
+	}
+	result := db.Model(&models.User{}).Where("email = ?", args[0]).Update("role", models.UserRoleAdmin)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("no user with email %s", args[0])
+	}
+
+	fmt.Printf("%s is now an admin of their organization\n", args[0])
+	return nil
+}
+
+// setOrganizationLimits changes the limits of an organization its admins
+// can't change themselves, given as quota_bytes=<bytes> and
+// max_share_expiry=<duration>. 0 or an empty duration removes a limit.
+func setOrganizationLimits(db *gorm.DB, args []string) error {
+	usage := fmt.Errorf("usage: set-organization-limits <slug> [quota_bytes=<bytes>] [max_share_expiry=<duration>]")
+	if len(args) < 2 {
+		return usage
+	}
+	var org models.Organization
+	if err := db.Where("slug = ?", args[0]).First(&org).Error; err != nil {
+		return fmt.Errorf("no organization with slug %s", args[0])
+	}
+
+	updates := map[string]interface{}{}
+	for _, arg := range args[1:] {
+		name, value, _ := strings.Cut(arg, "=")
+		switch name {
+		case "quota_bytes":
+			quota, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || quota < 0 {
+				return fmt.Errorf("invalid quota_bytes %q", value)
+			}
+			updates["quota_bytes"] = quota
+		case "max_share_expiry":
+			var expiry time.Duration
+			if value != "" {
+				var err error
+				if expiry, err = time.ParseDuration(value); err != nil || expiry <= 0 {
+					return fmt.Errorf("invalid max_share_expiry %q", value)
+				}
+			}
+			updates["max_share_expiry"] = expiry
+		default:
+			return usage
+		}
+	}
+	if err := db.Model(&org).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Updated the limits of %s\n", org.Slug)
+	return nil
+}
+
 func main() {
 
 	
@@ -79,8 +243,87 @@ func main() {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
+	// Scope every query of a request to the caller's organization
+	if err := tenant.Register(db); err != nil {
+		log.Fatal("Failed to register tenant scoping:", err)
+	}
+
+	db.AutoMigrate(&models.User{}, &models.File{}, &models.TusUpload{}, &models.Blob{}, &models.FileVersion{}, &models.Folder{}, &models.FilePermission{}, &models.Group{}, &models.GroupMember{}, &models.GroupInvite{}, &models.Organization{}, &models.OrganizationInvite{}, &models.DropLink{}, &models.Notification{}, &models.Thumbnail{}, &models.UploadRule{})
+
+	// Checksums used to be unique across the whole instance, now per organization
+	if db.Migrator().HasIndex(&models.Blob{}, "idx_blobs_checksum") {
+		db.Migrator().DropIndex(&models.Blob{}, "idx_blobs_checksum")
+	}
+
+	// Blobs stored before the status columns existed got NULL rather than the
+	// empty status the background queues look for
+	db.Model(&models.Blob{}).Where("thumbnail_status IS NULL").UpdateColumn("thumbnail_status", "")
+	db.Model(&models.Blob{}).Where("text_status IS NULL").UpdateColumn("text_status", "")
+	db.Model(&models.Blob{}).Where("scan_status IS NULL").UpdateColumn("scan_status", "")
+
+	store, err := storage.NewFromEnv()
+	if err != nil {
+		log.Fatal("Failed to initialize storage:", err)
+	}
 
-	db.AutoMigrate(&models.User{}, &models.File{})
+	// Files uploaded before the storage backend kept "uploads/" in their URL,
+	// the local backend is already rooted there so strip it to get the key
+	db.Unscoped().Model(&models.File{}).Where("url LIKE ?", "uploads/%").
+		Update("url", gorm.Expr("substr(url, 9)"))
+
+	fileHandler := handlers.NewFileHandler(db, store)
+	if err := fileHandler.MigrateLegacyBlobs(); err != nil {
+		log.Fatal("Failed to migrate files to blobs:", err)
+	}
+	if err := fileHandler.MigrateLegacyVersions(); err != nil {
+		log.Fatal("Failed to migrate file versions:", err)
+	}
+	if err := fileHandler.MigrateLegacyShareLinks(); err != nil {
+		log.Fatal("Failed to migrate share links:", err)
+	}
+	if err := fileHandler.MigrateOrganizations(); err != nil {
+		log.Fatal("Failed to migrate data into the default organization:", err)
+	}
+	if err := fileHandler.CollectUnreferencedBlobs(context.Background()); err != nil {
+		log.Fatal("Failed to collect unreferenced blobs:", err)
+	}
+	// Correct usage counters left behind by requests that never finished
+	if err := fileHandler.RecalculateUsage(); err != nil {
+		log.Fatal("Failed to recalculate storage usage:", err)
+	}
+
+	// Maintenance commands, e.g. "go run main.go rotate-master-key"
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rotate-master-key":
+			if err := rotateMasterKey(db); err != nil {
+				log.Fatal("Failed to rotate master key: ", err)
+			}
+		case "create-organization":
+			if err := createOrganization(db, os.Args[2:]); err != nil {
+				log.Fatal("Failed to create organization: ", err)
+			}
+		case "invite-user":
+			if err := inviteUser(db, os.Args[2:]); err != nil {
+				log.Fatal("Failed to invite user: ", err)
+			}
+		case "grant-admin":
+			if err := grantAdmin(db, os.Args[2:]); err != nil {
+				log.Fatal("Failed to grant admin: ", err)
+			}
+		case "set-organization-limits":
+			if err := setOrganizationLimits(db, os.Args[2:]); err != nil {
+				log.Fatal("Failed to set organization limits: ", err)
+			}
+		case "detect-types":
+			if err := fileHandler.DetectFileTypes(context.Background()); err != nil {
+				log.Fatal("Failed to detect file types: ", err)
+			}
+		default:
+			log.Fatalf("Unknown command %q", os.Args[1])
+		}
+		return
+	}
 
 	// Use this if not using Docker
 	// os.Setenv("REDIS_URL", "localhost:6379")
@@ -101,14 +344,25 @@ func main() {
 	
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandler(db)
-	fileHandler := handlers.NewFileHandler(db)
-	go backgroundWorker(db,rdc)
+	fileHandler.StartThumbnailWorkers()
+	fileHandler.StartScanWorkers()
+	fileHandler.StartTextWorkers()
+	go backgroundWorker(db,rdc,fileHandler)
 
 	
 	// Routes
 	r.POST("/register", authHandler.Register)
 	r.POST("/login", authHandler.Login)
 	r.GET("/download/:token", fileHandler.DownloadFile)
+	r.HEAD("/download/:token", fileHandler.DownloadFile)
+	r.POST("/download/:token/unlock", fileHandler.UnlockShareLink)
+	r.GET("/view/:token", fileHandler.ViewShareLink)
+	r.POST("/view/:token/unlock", fileHandler.UnlockShareLink)
+	r.GET("/view/:token/content", fileHandler.ViewContent)
+	r.HEAD("/view/:token/content", fileHandler.ViewContent)
+	r.GET("/drop/:token", fileHandler.GetDropLink)
+	r.POST("/drop/:token", fileHandler.DropFiles)
+	r.OPTIONS("/uploads", fileHandler.TusMiddleware(), fileHandler.TusOptions)
 
 	authorized := r.Group("/")
 	authorized.Use(authHandler.AuthMiddleware())
@@ -117,9 +371,109 @@ func main() {
 	{
 		authorized.POST("/upload", fileHandler.Upload)
 		authorized.GET("/files", fileHandler.GetFiles)
+		authorized.GET("/files/shared", fileHandler.GetSharedFiles)
 		authorized.GET("/share/:fileID", fileHandler.ShareFile)
+		authorized.POST("/share/:fileID", fileHandler.ShareFile)
+		authorized.GET("/files/:fileID/links", fileHandler.ListShareLinks)
+		authorized.DELETE("/files/:fileID/links/:token", fileHandler.RevokeShareLink)
 		authorized.GET("/delete/:fileID", fileHandler.DeleteFile)
 		authorized.GET("/search", fileHandler.SearchFiles)
+		authorized.GET("/archive", fileHandler.DownloadArchive)
+
+		// Looking into uploaded archives
+		authorized.GET("/files/:fileID/thumbnail", fileHandler.GetThumbnail)
+		authorized.HEAD("/files/:fileID/thumbnail", fileHandler.GetThumbnail)
+		authorized.GET("/files/:fileID/entries", fileHandler.ListArchiveEntries)
+		authorized.GET("/files/:fileID/entries/*path", fileHandler.DownloadArchiveEntry)
+		authorized.POST("/files/:fileID/extract", fileHandler.ExtractArchive)
+
+		// Trash
+		authorized.GET("/trash", fileHandler.GetTrash)
+		authorized.POST("/trash/:fileID/restore", fileHandler.RestoreFile)
+		authorized.DELETE("/trash/:fileID", fileHandler.DeleteFilePermanently)
+
+		// Version history
+		authorized.POST("/files/:fileID/versions", fileHandler.UploadVersion)
+		authorized.GET("/files/:fileID/versions", fileHandler.ListVersions)
+		authorized.GET("/files/:fileID/versions/:version", fileHandler.DownloadVersion)
+		authorized.HEAD("/files/:fileID/versions/:version", fileHandler.DownloadVersion)
+		authorized.POST("/files/:fileID/versions/:version/restore", fileHandler.RestoreVersion)
+		authorized.GET("/files/:fileID/diff", fileHandler.DiffVersions)
+
+		// Sharing with other users
+		authorized.GET("/files/:fileID/download", fileHandler.DownloadSharedFile)
+		authorized.HEAD("/files/:fileID/download", fileHandler.DownloadSharedFile)
+		authorized.POST("/files/:fileID/permissions", fileHandler.GrantPermission)
+		authorized.GET("/files/:fileID/permissions", fileHandler.ListPermissions)
+		authorized.DELETE("/files/:fileID/permissions/:userID", fileHandler.RevokePermission)
+
+		// Groups
+		authorized.POST("/groups", fileHandler.CreateGroup)
+		authorized.GET("/groups", fileHandler.ListGroups)
+		authorized.GET("/groups/:groupID/members", fileHandler.ListMembers)
+		authorized.PATCH("/groups/:groupID/members/:userID", fileHandler.UpdateMember)
+		authorized.DELETE("/groups/:groupID/members/:userID", fileHandler.RemoveMember)
+		authorized.POST("/groups/:groupID/invites", fileHandler.InviteMember)
+		authorized.GET("/groups/:groupID/invites", fileHandler.ListGroupInvites)
+		authorized.GET("/invites", fileHandler.ListInvites)
+		authorized.POST("/invites/:inviteID/accept", fileHandler.AcceptInvite)
+		authorized.DELETE("/invites/:inviteID", fileHandler.DeleteInvite)
+
+		// File drop links
+		authorized.POST("/drops", fileHandler.CreateDropLink)
+		authorized.GET("/drops", fileHandler.ListDropLinks)
+		authorized.DELETE("/drops/:dropID", fileHandler.DeleteDropLink)
+
+		// Notifications
+		authorized.GET("/notifications", fileHandler.ListNotifications)
+		authorized.POST("/notifications/:notificationID/read", fileHandler.MarkNotificationRead)
+
+		// Organization
+		authorized.GET("/org", fileHandler.GetOrganization)
+		authorized.PATCH("/org/settings", authHandler.AdminOnly(), fileHandler.UpdateOrganization)
+
+		// Storage quotas
+		authorized.GET("/usage", fileHandler.GetUsage)
+		admin := authorized.Group("/admin", authHandler.AdminOnly())
+		admin.GET("/usage", fileHandler.ListUsage)
+		admin.GET("/users/:userID/usage", fileHandler.GetUserUsage)
+		admin.PUT("/users/:userID/quota", fileHandler.SetUserQuota)
+
+		// Organization invites
+		admin.GET("/invites", fileHandler.ListOrganizationInvites)
+		admin.POST("/invites", fileHandler.InviteToOrganization)
+		admin.DELETE("/invites/:inviteID", fileHandler.DeleteOrganizationInvite)
+
+		// Upload policy
+		authorized.GET("/upload-policy", fileHandler.GetUploadPolicy)
+		admin.GET("/upload-rules", fileHandler.ListUploadRules)
+		admin.POST("/upload-rules", fileHandler.CreateUploadRule)
+		admin.PUT("/upload-rules/:ruleID", fileHandler.UpdateUploadRule)
+		admin.DELETE("/upload-rules/:ruleID", fileHandler.DeleteUploadRule)
+
+		// Malware quarantine
+		admin.GET("/quarantine", fileHandler.ListQuarantine)
+		admin.POST("/quarantine/:blobID/release", fileHandler.ReleaseQuarantine)
+		admin.POST("/quarantine/:blobID/rescan", fileHandler.RescanQuarantine)
+
+		// Folders
+		authorized.POST("/folders", fileHandler.CreateFolder)
+		authorized.GET("/folders/:folderID/children", fileHandler.ListFolder)
+		authorized.PATCH("/folders/:folderID", fileHandler.UpdateFolder)
+		authorized.DELETE("/folders/:folderID", fileHandler.DeleteFolder)
+		authorized.POST("/folders/:folderID/share", fileHandler.ShareFolder)
+		authorized.GET("/folders/:folderID/links", fileHandler.ListFolderLinks)
+		authorized.DELETE("/folders/:folderID/links/:token", fileHandler.RevokeFolderLink)
+		authorized.PATCH("/files/:fileID", fileHandler.UpdateFile)
+		authorized.POST("/files/:fileID/copy", fileHandler.CopyFile)
+		authorized.GET("/files/by-path/*path", fileHandler.GetFileByPath)
+
+		// Resumable uploads (tus 1.0)
+		tus := authorized.Group("/uploads", fileHandler.TusMiddleware())
+		tus.POST("", fileHandler.TusCreate)
+		tus.HEAD("/:uploadID", fileHandler.TusHead)
+		tus.PATCH("/:uploadID", fileHandler.TusPatch)
+		tus.DELETE("/:uploadID", fileHandler.TusDelete)
 	}
 	
 
@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// Blob is a unique piece of stored content. Files of an organization with
+// the same checksum share one Blob, which is removed from storage when
+// RefCount drops to zero. Blobs are never shared across organizations, so
+// deduplication can't reveal what another tenant stores.
+type Blob struct {
+	ID             uint   `gorm:"primaryKey"`
+	OrganizationID uint   `gorm:"uniqueIndex:idx_blob_org_checksum"`
+	Checksum       string `gorm:"uniqueIndex:idx_blob_org_checksum"` // hex encoded SHA-256 of the plaintext
+	StorageKey     string `gorm:"index"`
+	Size           int64
+	RefCount       int64
+	MimeType       string // sniffed from the first bytes of the content, empty until detected
+
+	// Encryption at rest, EncryptionScheme is empty for plaintext blobs
+	EncryptionScheme string
+	WrappedKey       string // data key wrapped by the master key
+	KeyID            string // identifies the master key that wrapped the data key
+
+	// ThumbnailStatus is empty until thumbnails were generated, "ready" once
+	// they were and "failed" for images that can't be decoded
+	ThumbnailStatus string `gorm:"default:''"`
+
+	// TextStatus is empty until the text of the content was extracted for
+	// search, "indexed" once it was and "none" for content without text
+	TextStatus string `gorm:"default:''"`
+
+	// ScanStatus is empty for content stored while malware scanning was off,
+	// otherwise "pending", "clean", "infected", "failed" or "released", see
+	// handlers/scan.go. Infected content is moved to quarantine/.
+	ScanStatus string `gorm:"index;default:''"`
+	ScanResult string // signature of the malware found, or why the scan failed
+	ScannedAt  *time.Time
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
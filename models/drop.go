@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DropLink lets people without an account upload files into the account of
+// the user who created it, e.g. vendors sending documents
+type DropLink struct {
+	gorm.Model
+	Token          string `gorm:"uniqueIndex"`
+	OrganizationID uint   `gorm:"index"`
+	UserID         uint   `gorm:"index"`
+	Name           string
+
+	// Where dropped files go, like the group_id and folder_id of an upload
+	GroupID  *uint
+	FolderID *uint
+
+	ExpiresAt    time.Time
+	MaxFileSize  int64  // 0 for the instance's MAX_UPLOAD_FILE_SIZE
+	AllowedTypes string // comma separated file extensions, empty for any
+	MaxFiles     int64  // 0 for no limit
+	FileCount    int64
+}
@@ -11,7 +11,15 @@ type File struct {
 	Size   int64
 	URL    string
 	UserID uint
-	Type   string
+	OrganizationID uint `gorm:"index"`
+	GroupID *uint `gorm:"index"` // set for files in a group's workspace, UserID is then the uploader
+	FolderID *uint `gorm:"index"` // nil for files at the top level
+	Type   string // canonical extension of the content, e.g. "jpg" for a photo named x.jpeg
+	MimeType string `gorm:"index"` // detected from the content, see utils.DetectType
+	Category string `gorm:"index"` // image, video, audio, document, archive, text, font, executable or other
+	Checksum string // hex encoded SHA-256 of the content
+	BlobID uint `gorm:"index"`
+	Version int // number of the current FileVersion
 	PublicUrl string 
 	// `gorm:"column:public_url"`
 	PublicUrlExpiry time.Time 
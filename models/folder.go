@@ -0,0 +1,15 @@
+package models
+
+import "gorm.io/gorm"
+
+// Folder groups files into a tree. ParentID is nil for top level folders.
+// Folders of a group's workspace have GroupID set and UserID is their creator.
+type Folder struct {
+	gorm.Model
+	Name     string
+	ParentID *uint `gorm:"index"`
+	UserID   uint  `gorm:"index"`
+	GroupID  *uint `gorm:"index"`
+
+	OrganizationID uint `gorm:"index"`
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Group roles, from most to least privileged
+const (
+	RoleOwner  = "owner"  // manages members, plus everything editors can do
+	RoleEditor = "editor" // uploads, edits and deletes the group's files
+	RoleViewer = "viewer" // reads the group's files
+)
+
+// Group is a team with a shared workspace of files and folders
+type Group struct {
+	gorm.Model
+	Name           string
+	CreatedBy      uint
+	OrganizationID uint `gorm:"index"`
+}
+
+type GroupMember struct {
+	ID        uint `gorm:"primaryKey"`
+	GroupID   uint `gorm:"uniqueIndex:idx_group_member"`
+	UserID    uint `gorm:"uniqueIndex:idx_group_member;index"`
+	Role      string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// GroupInvite is a pending invitation for an email address, which need not
+// be registered yet
+type GroupInvite struct {
+	ID        uint   `gorm:"primaryKey"`
+	GroupID   uint   `gorm:"uniqueIndex:idx_group_invite"`
+	Email     string `gorm:"uniqueIndex:idx_group_invite;index"`
+	Role      string
+	InvitedBy uint
+	ExpiresAt time.Time
+	CreatedAt time.Time
+
+	OrganizationID uint `gorm:"index"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// Notification kinds
+const (
+	NotificationFilesDropped = "files_dropped"
+)
+
+// Notification tells a user about something that happened to their files
+// while they weren't looking
+type Notification struct {
+	ID             uint `gorm:"primaryKey"`
+	OrganizationID uint `gorm:"index"`
+	UserID         uint `gorm:"index"`
+	Kind           string
+	Message        string
+	FileIDs        string // comma separated IDs of the files it is about
+	ReadAt         *time.Time
+	CreatedAt      time.Time
+}
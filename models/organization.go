@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DefaultOrganization is the slug of the organization users join when they
+// register without naming one, and that data from before organizations
+// existed is moved into
+const DefaultOrganization = "default"
+
+// Organization is a tenant. It owns its users and everything they create,
+// and nothing is visible across organizations.
+type Organization struct {
+	gorm.Model
+	Name string
+	Slug string `gorm:"uniqueIndex"`
+
+	// Settings, zero values mean no limit
+	MaxShareExpiry time.Duration
+	AllowedTypes   string // comma separated file extensions, e.g. "pdf,docx"
+	QuotaBytes     int64
+
+	UsedBytes int64 // what its users store, see handlers/quota.go
+}
+
+// OrganizationInvite lets an email address register into an organization
+// other than the default one. It is used up by the registration.
+type OrganizationInvite struct {
+	ID        uint   `gorm:"primaryKey"`
+	Email     string `gorm:"uniqueIndex:idx_organization_invite"`
+	InvitedBy uint   // 0 when created with the invite-user command
+	ExpiresAt time.Time
+	CreatedAt time.Time
+
+	OrganizationID uint `gorm:"uniqueIndex:idx_organization_invite"`
+}
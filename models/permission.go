@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+const (
+	PermissionRead  = "read"
+	PermissionWrite = "write" // read plus uploading new versions
+)
+
+// FilePermission grants another user access to a file
+type FilePermission struct {
+	ID         uint `gorm:"primaryKey"`
+	FileID     uint `gorm:"uniqueIndex:idx_file_permission"`
+	UserID     uint `gorm:"uniqueIndex:idx_file_permission;index"`
+	Permission string
+	GrantedBy  uint
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Thumbnail is a scaled down copy of an image blob in one of the standard
+// sizes. Like blobs they are encrypted at rest when a master key is set.
+type Thumbnail struct {
+	ID             uint `gorm:"primaryKey"`
+	OrganizationID uint `gorm:"index"`
+	BlobID         uint `gorm:"uniqueIndex:idx_thumbnail_blob_size"`
+	Size           int  `gorm:"uniqueIndex:idx_thumbnail_blob_size"` // longest side in pixels
+	StorageKey     string
+	ContentType    string
+	Bytes          int64
+	Checksum       string // hex encoded SHA-256 of the thumbnail
+
+	EncryptionScheme string
+	WrappedKey       string
+	KeyID            string
+
+	CreatedAt time.Time
+}
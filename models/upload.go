@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// TusUpload tracks a resumable upload while its chunks are being received
+type TusUpload struct {
+	ID             string `gorm:"primaryKey"`
+	UserID         uint   `gorm:"index"`
+	OrganizationID uint   `gorm:"index"`
+	Length         int64
+	Offset         int64
+	FileName       string
+	FolderID       *uint
+	GroupID        *uint
+	Metadata       string
+	ExpiresAt      time.Time
+	FileID         uint // set once the upload is complete
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// Actions of an UploadRule
+const (
+	UploadRuleAllow = "allow" // when a scope has allow rules, its files must match one
+	UploadRuleDeny  = "deny"  // matching files are rejected
+	UploadRuleLimit = "limit" // matching files may be at most MaxBytes
+)
+
+// UploadRule is one rule of an organization's upload policy. Rules without
+// a UserID apply to everyone in the organization, the others to one user on
+// top of those. A rule matches a file when all of its conditions that are
+// set match, a rule without conditions matches every file.
+type UploadRule struct {
+	ID             uint  `gorm:"primaryKey"`
+	OrganizationID uint  `gorm:"index"`
+	UserID         *uint `gorm:"index"`
+	Action         string
+
+	// Conditions, comma separated lists match any of their entries
+	MimeTypes   string // e.g. "image/png,video/*"
+	Extensions  string // extensions of the file name, e.g. "exe,msi"
+	Categories  string // see utils.Category, e.g. "executable"
+	NamePattern string // glob matched against the file name, e.g. "*.tmp"
+
+	MaxBytes int64  // for limit rules
+	Reason   string // shown to whoever uploads a rejected file
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
@@ -2,8 +2,20 @@ package models
 
 import "gorm.io/gorm"
 
+// User roles within their organization
+const (
+	UserRoleAdmin  = "admin"
+	UserRoleMember = "member"
+)
+
 type User struct {
 	gorm.Model
-	Email    string `gorm:"uniqueIndex"`
-	Password string
-}
\ No newline at end of file
+	Email          string `gorm:"uniqueIndex"`
+	Password       string
+	OrganizationID uint `gorm:"index"`
+	Role           string
+
+	// Storage, see handlers/quota.go. A QuotaBytes of 0 means no quota.
+	QuotaBytes int64
+	UsedBytes  int64
+}
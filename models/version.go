@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// FileVersion is one revision of a File's content. The File row mirrors
+// the blob, size and checksum of its current version.
+type FileVersion struct {
+	ID         uint `gorm:"primaryKey"`
+	FileID     uint `gorm:"uniqueIndex:idx_file_version"`
+	Version    int  `gorm:"uniqueIndex:idx_file_version"`
+	BlobID     uint
+	Size       int64
+	Checksum   string
+	UploaderID uint
+	CreatedAt  time.Time
+}
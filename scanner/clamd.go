@@ -0,0 +1,147 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is how much content goes into one INSTREAM chunk. clamd
+// refuses chunks above its StreamMaxLength, which is far larger.
+const clamdChunkSize = 64 << 10
+
+// Clamd scans content with a ClamAV daemon using the INSTREAM command. Every
+// scan uses its own connection.
+type Clamd struct {
+	network string // "tcp" or "unix"
+	address string
+	timeout time.Duration // for a whole scan
+}
+
+func NewClamd(network, address string, timeout time.Duration) *Clamd {
+	return &Clamd{network: network, address: address, timeout: timeout}
+}
+
+// Scan streams r to clamd as length prefixed chunks, ended by an empty
+// chunk, and parses the reply:
+//
+//	stream: OK
+//	stream: Eicar-Signature FOUND
+//	INSTREAM size limit exceeded. ERROR
+func (s *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return Result{}, fmt.Errorf("clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// clamd stops reading once it found something or the stream is too
+	// long, its reply is read concurrently so the writes can't block on that
+	type reply struct {
+		line string
+		err  error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		line, err := bufio.NewReader(conn).ReadString(0)
+		replies <- reply{strings.TrimRight(line, "\x00\n"), err}
+	}()
+
+	writeErr := s.send(conn, r)
+	var got reply
+	select {
+	case got = <-replies:
+	case <-ctx.Done():
+		return Result{}, fmt.Errorf("clamd: %w", ctx.Err())
+	}
+	if got.line == "" {
+		if writeErr != nil {
+			return Result{}, fmt.Errorf("clamd: %w", writeErr)
+		}
+		return Result{}, fmt.Errorf("clamd: no reply: %v", got.err)
+	}
+	return parseClamdReply(got.line)
+}
+
+func (s *Clamd) send(w io.Writer, r io.Reader) error {
+	if _, err := io.WriteString(w, "zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := w.Write(buf[:4+n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseClamdReply turns a reply into a verdict. Only a stream over clamd's
+// size limit is rejected for good, other errors such as failed memory
+// allocations may go away when the content is scanned again.
+func parseClamdReply(line string) (Result, error) {
+	line = strings.TrimPrefix(line, "stream: ")
+	switch {
+	case line == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(line, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(line, " FOUND")}, nil
+	case strings.HasSuffix(line, " ERROR"):
+		message := strings.TrimSuffix(line, " ERROR")
+		if strings.Contains(message, "size limit exceeded") {
+			return Result{}, fmt.Errorf("%w: %s", ErrRejected, message)
+		}
+		return Result{}, fmt.Errorf("clamd: %s", message)
+	}
+	return Result{}, fmt.Errorf("clamd: unexpected reply %q", line)
+}
+
+// Ping checks that clamd is reachable
+func (s *Clamd) Ping(ctx context.Context) error {
+	var dialer net.Dialer
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return fmt.Errorf("clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := io.WriteString(conn, "zPING\x00"); err != nil {
+		return fmt.Errorf("clamd: %w", err)
+	}
+	line, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil {
+		return fmt.Errorf("clamd: %w", err)
+	}
+	if !bytes.Equal(bytes.TrimRight(line, "\x00\n"), []byte("PONG")) {
+		return fmt.Errorf("clamd: unexpected reply %q", line)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd accepts a single connection and hands it to serve, standing in
+// for a ClamAV daemon
+func fakeClamd(t *testing.T, serve func(conn net.Conn)) *Clamd {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+	return NewClamd("tcp", ln.Addr().String(), 5*time.Second)
+}
+
+// readInstream reads an INSTREAM command and returns the streamed content.
+// With limit > 0 it stops once more than limit bytes arrived, like clamd
+// does at StreamMaxLength.
+func readInstream(r *bufio.Reader, limit int) ([]byte, bool, error) {
+	command, err := r.ReadString(0)
+	if err != nil {
+		return nil, false, err
+	}
+	if command != "zINSTREAM\x00" {
+		return nil, false, errors.New("unexpected command " + command)
+	}
+	var content []byte
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return content, false, err
+		}
+		if size == 0 {
+			return content, true, nil
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return content, false, err
+		}
+		content = append(content, chunk...)
+		if limit > 0 && len(content) > limit {
+			return content, false, nil
+		}
+	}
+}
+
+func TestClamdClean(t *testing.T) {
+	content := bytes.Repeat([]byte("clean content "), 20000) // several chunks
+	received := make(chan []byte, 1)
+	clamd := fakeClamd(t, func(conn net.Conn) {
+		got, complete, err := readInstream(bufio.NewReader(conn), 0)
+		if err != nil || !complete {
+			received <- nil
+			return
+		}
+		received <- got
+		io.WriteString(conn, "stream: OK\x00")
+	})
+
+	result, err := clamd.Scan(context.Background(), bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if result.Infected {
+		t.Errorf("Scan = %+v, want clean", result)
+	}
+	if got := <-received; !bytes.Equal(got, content) {
+		t.Errorf("clamd received %d bytes, want the %d bytes of content", len(got), len(content))
+	}
+}
+
+func TestClamdFound(t *testing.T) {
+	clamd := fakeClamd(t, func(conn net.Conn) {
+		if _, _, err := readInstream(bufio.NewReader(conn), 0); err != nil {
+			return
+		}
+		io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+	})
+
+	result, err := clamd.Scan(context.Background(), strings.NewReader("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR"))
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if !result.Infected || result.Signature != "Eicar-Test-Signature" {
+		t.Errorf("Scan = %+v, want infected with Eicar-Test-Signature", result)
+	}
+}
+
+func TestClamdSizeLimit(t *testing.T) {
+	clamd := fakeClamd(t, func(conn net.Conn) {
+		// Answers and hangs up before the client has sent everything
+		readInstream(bufio.NewReader(conn), 100<<10)
+		io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+	})
+
+	_, err := clamd.Scan(context.Background(), bytes.NewReader(make([]byte, 4<<20)))
+	if !errors.Is(err, ErrRejected) {
+		t.Fatalf("Scan: err = %v, want ErrRejected", err)
+	}
+	if !strings.Contains(err.Error(), "size limit exceeded") {
+		t.Errorf("Scan: err = %v, want it to name the size limit", err)
+	}
+}
+
+func TestClamdTransientError(t *testing.T) {
+	clamd := fakeClamd(t, func(conn net.Conn) {
+		if _, _, err := readInstream(bufio.NewReader(conn), 0); err != nil {
+			return
+		}
+		io.WriteString(conn, "stream: Can't allocate memory ERROR\x00")
+	})
+
+	_, err := clamd.Scan(context.Background(), strings.NewReader("content"))
+	if err == nil {
+		t.Fatal("Scan succeeded, want an error")
+	}
+	if errors.Is(err, ErrRejected) {
+		t.Errorf("Scan: err = %v, want an error worth retrying, not ErrRejected", err)
+	}
+}
+
+func TestClamdDroppedConnection(t *testing.T) {
+	clamd := fakeClamd(t, func(conn net.Conn) {
+		// Goes away in the middle of the stream without a reply
+		r := bufio.NewReader(conn)
+		r.ReadString(0)
+		io.CopyN(io.Discard, r, 10<<10)
+	})
+
+	_, err := clamd.Scan(context.Background(), bytes.NewReader(make([]byte, 1<<20)))
+	if err == nil {
+		t.Fatal("Scan succeeded, want an error")
+	}
+	if errors.Is(err, ErrRejected) {
+		t.Errorf("Scan: err = %v, want an error worth retrying, not ErrRejected", err)
+	}
+}
@@ -0,0 +1,59 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrRejected is returned when the scanner refused to scan the content,
+// e.g. because it exceeds the scanner's size limit. Scanning it again won't
+// help, unlike connection errors.
+var ErrRejected = errors.New("scanner: content rejected")
+
+// Result is the verdict on scanned content
+type Result struct {
+	Infected  bool
+	Signature string // name of the malware found, empty when clean
+}
+
+// Scanner checks content for malware. Implementations must be safe for
+// concurrent use.
+type Scanner interface {
+	// Scan reads r to the end, or until the verdict is known, and returns it
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// NewFromEnv builds the scanner configured by CLAMD_ADDRESS, or returns nil
+// when scanning is off. The address is "tcp://host:port", "unix:///path" or
+// a plain "host:port".
+func NewFromEnv() (Scanner, error) {
+	address := strings.TrimSpace(os.Getenv("CLAMD_ADDRESS"))
+	if address == "" {
+		return nil, nil
+	}
+
+	network, addr := "tcp", address
+	switch {
+	case strings.HasPrefix(address, "tcp://"):
+		addr = strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "unix://"):
+		network, addr = "unix", strings.TrimPrefix(address, "unix://")
+	case strings.Contains(address, "://"):
+		return nil, fmt.Errorf("unsupported CLAMD_ADDRESS %q", address)
+	}
+
+	timeout := 5 * time.Minute
+	if value := os.Getenv("CLAMD_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid CLAMD_TIMEOUT %q", value)
+		}
+		timeout = parsed
+	}
+	return NewClamd(network, addr, timeout), nil
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3PartSize bounds the memory used per streaming upload of unknown length.
+const s3PartSize = 16 << 20
+
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	UseSSL    bool
+}
+
+// S3Storage stores blobs in any S3 compatible service (AWS, MinIO, ...).
+type S3Storage struct {
+	Client *minio.Client
+	Bucket string
+}
+
+func NewS3Storage(cfg S3Config) (*S3Storage, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("S3_ENDPOINT and S3_BUCKET must be set")
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, err
+		}
+	}
+	return &S3Storage{Client: client, Bucket: cfg.Bucket}, nil
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return 0, err
+	}
+	info, err := s.Client.PutObject(ctx, s.Bucket, key, r, -1, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		PartSize:    s3PartSize,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy, so stat first to surface missing keys here
+	if _, err := s.Stat(ctx, key); err != nil {
+		return nil, err
+	}
+	return s.Client.GetObject(ctx, s.Bucket, key, minio.GetObjectOptions{})
+}
+
+func (s *S3Storage) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	// S3 refuses ranges that start past the end instead of cutting them short
+	if length == 0 || offset >= info.Size {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	// Only the requested bytes leave the bucket. An end of 0 leaves the
+	// range open, so bytes=0-0 needs the explicit form.
+	opts := minio.GetObjectOptions{}
+	switch {
+	case length > 0:
+		err = opts.SetRange(offset, offset+length-1)
+	case offset > 0:
+		err = opts.SetRange(offset, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.Client.GetObject(ctx, s.Bucket, key, opts)
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+	return s.Client.RemoveObject(ctx, s.Bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *S3Storage) Rename(ctx context.Context, src, dst string) error {
+	src, err := cleanKey(src)
+	if err != nil {
+		return err
+	}
+	dst, err = cleanKey(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := s.Stat(ctx, src); err != nil {
+		return err
+	}
+
+	// S3 has no rename, ComposeObject does a server side copy of any size
+	_, err = s.Client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: s.Bucket, Object: dst},
+		minio.CopySrcOptions{Bucket: s.Bucket, Object: src},
+	)
+	if err != nil {
+		return err
+	}
+	return s.Client.RemoveObject(ctx, s.Bucket, src, minio.RemoveObjectOptions{})
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := s.Client.StatObject(ctx, s.Bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return ObjectInfo{}, ErrNotExist
+		}
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: info.Key, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for obj := range s.Client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		objects = append(objects, ObjectInfo{Key: obj.Key, Size: obj.Size, ModTime: obj.LastModified})
+	}
+	return objects, nil
+}
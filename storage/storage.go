@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrNotExist is returned when a key is not present in the backend.
+var ErrNotExist = errors.New("storage: object does not exist")
+
+// ObjectInfo describes a single stored blob.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is the blob store behind FileHandler. Keys are slash separated
+// relative paths; readers and writers are streamed, never buffered whole.
+type Storage interface {
+	// Put stores everything read from r under key and returns the number of bytes written.
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// Get opens the blob stored under key. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// GetRange opens length bytes of the blob starting at offset, or the rest of
+	// it when length is negative. Ranges past the end are cut short. The caller must close it.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Delete removes the blob. Deleting a missing key returns ErrNotExist.
+	Delete(ctx context.Context, key string) error
+	// Rename moves the blob stored under src to dst, replacing anything at dst.
+	Rename(ctx context.Context, src, dst string) error
+	// Stat returns the size and modification time of the blob.
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// List returns every blob whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// NewFromEnv builds the backend selected by STORAGE_BACKEND ("local" or "s3").
+func NewFromEnv() (Storage, error) {
+	switch backend := strings.ToLower(os.Getenv("STORAGE_BACKEND")); backend {
+	case "", "local":
+		dir := os.Getenv("UPLOAD_DIR")
+		if dir == "" {
+			dir = "uploads"
+		}
+		return NewLocalStorage(dir)
+	case "s3":
+		return NewS3Storage(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Region:    os.Getenv("S3_REGION"),
+			UseSSL:    strings.EqualFold(os.Getenv("S3_USE_SSL"), "true"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+}
+
+// cleanKey rejects keys that are empty or try to escape the store root.
+func cleanKey(key string) (string, error) {
+	cleaned := path.Clean("/" + strings.ReplaceAll(key, "\\", "/"))[1:]
+	if cleaned == "" || cleaned != strings.TrimPrefix(key, "/") {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	return cleaned, nil
+}
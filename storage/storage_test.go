@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// backends returns every Storage implementation, S3 against a fake server
+func backends(t *testing.T) map[string]Storage {
+	local, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStorage: %v", err)
+	}
+	return map[string]Storage{
+		"local": local,
+		"s3":    newTestS3Storage(t),
+	}
+}
+
+func put(t *testing.T, store Storage, key, content string) {
+	t.Helper()
+	n, err := store.Put(context.Background(), key, strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Put(%q): %v", key, err)
+	}
+	if n != int64(len(content)) {
+		t.Fatalf("Put(%q) wrote %d bytes, want %d", key, n, len(content))
+	}
+}
+
+func readAll(t *testing.T, rc io.ReadCloser, err error) string {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(b)
+}
+
+func TestPutGet(t *testing.T) {
+	for name, store := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			put(t, store, "blobs/1/abc", "hello world")
+
+			rc, err := store.Get(ctx, "blobs/1/abc")
+			if got := readAll(t, rc, err); got != "hello world" {
+				t.Errorf("Get = %q, want %q", got, "hello world")
+			}
+
+			// Putting again replaces the content
+			put(t, store, "blobs/1/abc", "bye")
+			rc, err = store.Get(ctx, "blobs/1/abc")
+			if got := readAll(t, rc, err); got != "bye" {
+				t.Errorf("Get after replace = %q, want %q", got, "bye")
+			}
+
+			if _, err := store.Get(ctx, "blobs/1/missing"); !errors.Is(err, ErrNotExist) {
+				t.Errorf("Get of a missing key: err = %v, want ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	tests := []struct {
+		name           string
+		offset, length int64
+		want           string
+	}{
+		{"first byte", 0, 1, "0"}, // Range: bytes=0-0
+		{"prefix", 0, 4, "0123"},
+		{"middle", 3, 4, "3456"},
+		{"last byte", 9, 1, "9"},
+		{"rest", 6, -1, "6789"},
+		{"whole", 0, -1, "0123456789"},
+		{"empty", 4, 0, ""},
+		{"past the end", 8, 10, "89"},
+		{"starting past the end", 20, 5, ""},
+	}
+	for name, store := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			put(t, store, "range", "0123456789")
+			for _, tt := range tests {
+				rc, err := store.GetRange(context.Background(), "range", tt.offset, tt.length)
+				if got := readAll(t, rc, err); got != tt.want {
+					t.Errorf("%s: GetRange(%d, %d) = %q, want %q", tt.name, tt.offset, tt.length, got, tt.want)
+				}
+			}
+
+			if _, err := store.GetRange(context.Background(), "missing", 0, 1); !errors.Is(err, ErrNotExist) {
+				t.Errorf("GetRange of a missing key: err = %v, want ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestStat(t *testing.T) {
+	for name, store := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			put(t, store, "a/b/c", "12345")
+
+			info, err := store.Stat(ctx, "a/b/c")
+			if err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			if info.Key != "a/b/c" || info.Size != 5 || info.ModTime.IsZero() {
+				t.Errorf("Stat = %+v, want key a/b/c, size 5 and a modification time", info)
+			}
+
+			if _, err := store.Stat(ctx, "a/b/d"); !errors.Is(err, ErrNotExist) {
+				t.Errorf("Stat of a missing key: err = %v, want ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	for name, store := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			put(t, store, "gone", "x")
+
+			if err := store.Delete(ctx, "gone"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, err := store.Stat(ctx, "gone"); !errors.Is(err, ErrNotExist) {
+				t.Errorf("Stat after Delete: err = %v, want ErrNotExist", err)
+			}
+			if err := store.Delete(ctx, "gone"); !errors.Is(err, ErrNotExist) {
+				t.Errorf("Delete of a missing key: err = %v, want ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestRename(t *testing.T) {
+	for name, store := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			put(t, store, "staging/upload", "content")
+			put(t, store, "blobs/target", "old")
+
+			// Replaces whatever is at the destination
+			if err := store.Rename(ctx, "staging/upload", "blobs/target"); err != nil {
+				t.Fatalf("Rename: %v", err)
+			}
+			rc, err := store.Get(ctx, "blobs/target")
+			if got := readAll(t, rc, err); got != "content" {
+				t.Errorf("Get after Rename = %q, want %q", got, "content")
+			}
+			if _, err := store.Stat(ctx, "staging/upload"); !errors.Is(err, ErrNotExist) {
+				t.Errorf("Stat of the source after Rename: err = %v, want ErrNotExist", err)
+			}
+
+			if err := store.Rename(ctx, "staging/upload", "blobs/other"); !errors.Is(err, ErrNotExist) {
+				t.Errorf("Rename of a missing key: err = %v, want ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	for name, store := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			put(t, store, "blobs/1/a", "a")
+			put(t, store, "blobs/1/b", "bb")
+			put(t, store, "blobs/2/c", "ccc")
+			put(t, store, "staging/d", "dddd")
+
+			objects, err := store.List(context.Background(), "blobs/1/")
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+			if len(objects) != 2 || objects[0].Key != "blobs/1/a" || objects[0].Size != 1 ||
+				objects[1].Key != "blobs/1/b" || objects[1].Size != 2 {
+				t.Errorf("List(blobs/1/) = %+v, want blobs/1/a and blobs/1/b", objects)
+			}
+
+			all, err := store.List(context.Background(), "")
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			if len(all) != 4 {
+				t.Errorf("List(\"\") returned %d objects, want 4", len(all))
+			}
+		})
+	}
+}
+
+func TestInvalidKeys(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			put(t, store, "valid", "x")
+			for _, key := range []string{"", "../escape", "a/../../b", "a//b", "a/./b"} {
+				if _, err := store.Put(ctx, key, strings.NewReader("x")); err == nil {
+					t.Errorf("Put(%q) succeeded", key)
+				}
+				if _, err := store.Get(ctx, key); err == nil || errors.Is(err, ErrNotExist) {
+					t.Errorf("Get(%q): err = %v, want an invalid key error", key, err)
+				}
+				if _, err := store.GetRange(ctx, key, 0, 1); err == nil || errors.Is(err, ErrNotExist) {
+					t.Errorf("GetRange(%q): err = %v, want an invalid key error", key, err)
+				}
+				if _, err := store.Stat(ctx, key); err == nil || errors.Is(err, ErrNotExist) {
+					t.Errorf("Stat(%q): err = %v, want an invalid key error", key, err)
+				}
+				if err := store.Delete(ctx, key); err == nil || errors.Is(err, ErrNotExist) {
+					t.Errorf("Delete(%q): err = %v, want an invalid key error", key, err)
+				}
+				if err := store.Rename(ctx, key, "dst"); err == nil || errors.Is(err, ErrNotExist) {
+					t.Errorf("Rename(%q, dst): err = %v, want an invalid key error", key, err)
+				}
+				if err := store.Rename(ctx, "valid", key); err == nil {
+					t.Errorf("Rename(valid, %q) succeeded", key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+// Package tenant keeps organizations apart. The organization of a request
+// travels in its context, and gorm callbacks scope every query and create
+// on models with an OrganizationID field to it, so handlers don't filter by
+// tenant themselves. Work without a tenant in its context, such as the
+// background worker and maintenance commands, is not scoped.
+package tenant
+
+import (
+	"context"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const field = "OrganizationID"
+
+type contextKey struct{}
+
+// WithOrganization returns a context scoped to an organization
+func WithOrganization(ctx context.Context, organizationID uint) context.Context {
+	return context.WithValue(ctx, contextKey{}, organizationID)
+}
+
+// FromContext returns the organization a context is scoped to
+func FromContext(ctx context.Context) (uint, bool) {
+	if ctx == nil {
+		return 0, false
+	}
+	id, ok := ctx.Value(contextKey{}).(uint)
+	return id, ok && id != 0
+}
+
+// Register installs the callbacks that scope db to the tenant of each
+// statement's context
+func Register(db *gorm.DB) error {
+	callbacks := db.Callback()
+	if err := callbacks.Query().Before("gorm:query").Register("tenant:query", scope); err != nil {
+		return err
+	}
+	if err := callbacks.Row().Before("gorm:row").Register("tenant:row", scope); err != nil {
+		return err
+	}
+	if err := callbacks.Update().Before("gorm:update").Register("tenant:update", scope); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().Before("gorm:delete").Register("tenant:delete", scope); err != nil {
+		return err
+	}
+	return callbacks.Create().Before("gorm:create").Register("tenant:create", assign)
+}
+
+func scope(db *gorm.DB) {
+	id, ok := FromContext(db.Statement.Context)
+	if !ok || db.Statement.Schema == nil {
+		return
+	}
+	f := db.Statement.Schema.LookUpField(field)
+	if f == nil {
+		return
+	}
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: f.DBName}, Value: id},
+	}})
+}
+
+// assign stamps new records with the tenant, rejecting records that name
+// another organization
+func assign(db *gorm.DB) {
+	id, ok := FromContext(db.Statement.Context)
+	if !ok || db.Statement.Schema == nil {
+		return
+	}
+	f := db.Statement.Schema.LookUpField(field)
+	if f == nil {
+		return
+	}
+
+	ctx := db.Statement.Context
+	set := func(rv reflect.Value) {
+		current, zero := f.ValueOf(ctx, rv)
+		if !zero && current != id {
+			db.AddError(gorm.ErrInvalidData)
+			return
+		}
+		if err := f.Set(ctx, rv, id); err != nil {
+			db.AddError(err)
+		}
+	}
+
+	rv := db.Statement.ReflectValue
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			set(reflect.Indirect(rv.Index(i)))
+		}
+	case reflect.Struct:
+		set(rv)
+	}
+}
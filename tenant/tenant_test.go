@@ -0,0 +1,161 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type document struct {
+	ID             uint
+	OrganizationID uint
+	Title          string
+}
+
+// setting has no OrganizationID and is never scoped
+type setting struct {
+	ID    uint
+	Value string
+}
+
+func openDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "tenant.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := Register(db); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := db.AutoMigrate(&document{}, &setting{}); err != nil {
+		t.Fatalf("AutoMigrate: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	// Seeded without a tenant, so nothing is stamped or scoped
+	db.Create(&[]document{
+		{OrganizationID: 1, Title: "a1"},
+		{OrganizationID: 1, Title: "a2"},
+		{OrganizationID: 2, Title: "b1"},
+	})
+	db.Create(&setting{Value: "shared"})
+	return db
+}
+
+func TestFromContext(t *testing.T) {
+	if _, ok := FromContext(context.Background()); ok {
+		t.Error("FromContext of a plain context reported a tenant")
+	}
+	if _, ok := FromContext(WithOrganization(context.Background(), 0)); ok {
+		t.Error("FromContext reported organization 0 as a tenant")
+	}
+	if id, ok := FromContext(WithOrganization(context.Background(), 7)); !ok || id != 7 {
+		t.Errorf("FromContext = %d, %v, want 7, true", id, ok)
+	}
+}
+
+func TestQueriesAreScoped(t *testing.T) {
+	db := openDB(t)
+	org1 := db.WithContext(WithOrganization(context.Background(), 1))
+
+	var docs []document
+	if err := org1.Find(&docs).Error; err != nil {
+		t.Fatalf("Find: %v", err)
+	}
+	if len(docs) != 2 {
+		t.Errorf("Find returned %d documents, want the 2 of organization 1", len(docs))
+	}
+
+	var doc document
+	if err := org1.Where("title = ?", "b1").First(&doc).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("First of another organization's document: err = %v, want ErrRecordNotFound", err)
+	}
+
+	var count int64
+	org1.Model(&document{}).Count(&count)
+	if count != 2 {
+		t.Errorf("Count = %d, want 2", count)
+	}
+	var titles []string
+	org1.Model(&document{}).Pluck("title", &titles)
+	if len(titles) != 2 {
+		t.Errorf("Pluck returned %v, want the 2 titles of organization 1", titles)
+	}
+
+	// Models without an organization and work without a tenant are not scoped
+	var settings []setting
+	org1.Find(&settings)
+	if len(settings) != 1 {
+		t.Errorf("Find of settings returned %d rows, want 1", len(settings))
+	}
+	db.Find(&docs)
+	if len(docs) != 3 {
+		t.Errorf("Find without a tenant returned %d documents, want 3", len(docs))
+	}
+}
+
+func TestUpdatesAndDeletesAreScoped(t *testing.T) {
+	db := openDB(t)
+	org1 := db.WithContext(WithOrganization(context.Background(), 1))
+
+	result := org1.Model(&document{}).Where("title = ?", "b1").Update("title", "taken")
+	if result.Error != nil || result.RowsAffected != 0 {
+		t.Errorf("Update of another organization's document: %d rows, err %v, want 0 rows", result.RowsAffected, result.Error)
+	}
+	result = org1.Where("title = ?", "b1").Delete(&document{})
+	if result.Error != nil || result.RowsAffected != 0 {
+		t.Errorf("Delete of another organization's document: %d rows, err %v, want 0 rows", result.RowsAffected, result.Error)
+	}
+
+	result = org1.Model(&document{}).Where("title LIKE ?", "%1").Update("title", "renamed")
+	if result.Error != nil || result.RowsAffected != 1 {
+		t.Errorf("Update: %d rows, err %v, want only a1 changed", result.RowsAffected, result.Error)
+	}
+	var b1 document
+	db.Where("organization_id = 2").First(&b1)
+	if b1.Title != "b1" {
+		t.Errorf("document of organization 2 is titled %q, want b1", b1.Title)
+	}
+}
+
+func TestCreatesAreStamped(t *testing.T) {
+	db := openDB(t)
+	org1 := db.WithContext(WithOrganization(context.Background(), 1))
+
+	doc := document{Title: "new"}
+	if err := org1.Create(&doc).Error; err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if doc.OrganizationID != 1 {
+		t.Errorf("created document belongs to organization %d, want 1", doc.OrganizationID)
+	}
+
+	batch := []document{{Title: "x"}, {Title: "y", OrganizationID: 1}}
+	if err := org1.Create(&batch).Error; err != nil {
+		t.Fatalf("Create of a batch: %v", err)
+	}
+	for _, doc := range batch {
+		if doc.OrganizationID != 1 {
+			t.Errorf("document %s belongs to organization %d, want 1", doc.Title, doc.OrganizationID)
+		}
+	}
+
+	foreign := document{Title: "foreign", OrganizationID: 2}
+	if err := org1.Create(&foreign).Error; !errors.Is(err, gorm.ErrInvalidData) {
+		t.Errorf("Create of another organization's document: err = %v, want ErrInvalidData", err)
+	}
+	var count int64
+	db.Model(&document{}).Where("title = ?", "foreign").Count(&count)
+	if count != 0 {
+		t.Error("document for another organization was created")
+	}
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// EnvInt64 reads an integer setting from the environment, falling back to def
+func EnvInt64(name string, def int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %d", name, value, def)
+		return def
+	}
+	return parsed
+}
+
+// EnvDuration reads a duration setting such as "24h" from the environment
+func EnvDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %s", name, value, def)
+		return def
+	}
+	return parsed
+}
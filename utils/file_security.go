@@ -4,8 +4,14 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"os"
 )
 
 // GenerateKey generates a random AES key (16, 24, or 32 bytes for AES-128, AES-192, and AES-256)
@@ -64,3 +70,302 @@ func DecryptFile(cipherData []byte, key []byte) ([]byte, error) {
 
 	return plaintext, nil
 }
+
+// Streaming encryption used for files at rest. The plaintext is split into
+// fixed size chunks which are sealed independently with AES-256-GCM, so large
+// files never have to fit in memory and any chunk can be decrypted on its own.
+//
+// Layout: magic "FSE1" | chunk size (uint32) | nonce prefix (7 bytes) | sealed chunks...
+// The nonce of chunk i is prefix | i (uint32) | last flag, which stops chunks
+// from being reordered, dropped or the stream from being truncated.
+
+const (
+	StreamScheme     = "aes-256-gcm-stream-v1"
+	StreamChunkSize  = 64 * 1024
+	streamMagic      = "FSE1"
+	streamPrefixSize = 7
+	StreamHeaderSize = len(streamMagic) + 4 + streamPrefixSize
+	streamTagSize    = 16
+)
+
+var errStreamCorrupted = errors.New("encrypted stream is corrupted")
+
+func newStreamAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func streamNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamPrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	plain   []byte
+	have    int
+	out     []byte
+	done    bool
+}
+
+// NewEncryptReader returns a reader producing the encrypted stream of src
+func NewEncryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, streamPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, StreamHeaderSize)
+	header = append(header, streamMagic...)
+	header = binary.BigEndian.AppendUint32(header, StreamChunkSize)
+	header = append(header, prefix...)
+
+	return &encryptReader{
+		src:    src,
+		aead:   aead,
+		prefix: prefix,
+		plain:  make([]byte, StreamChunkSize),
+		out:    header,
+	}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+func (e *encryptReader) sealNext() error {
+	n, err := io.ReadFull(e.src, e.plain[e.have:])
+	size := e.have + n
+	e.have = 0
+
+	last := false
+	var lookahead [1]byte
+	switch err {
+	case nil:
+		// A full chunk is only the last one if nothing follows it
+		m, err := io.ReadFull(e.src, lookahead[:])
+		if err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		} else if m == 1 {
+			defer func() {
+				e.plain[0] = lookahead[0]
+				e.have = 1
+			}()
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+
+	e.out = e.aead.Seal(e.out[:0], streamNonce(e.prefix, e.counter, last), e.plain[:size], nil)
+	e.counter++
+	e.done = last
+	return nil
+}
+
+// StreamHeader is the parsed prefix of an encrypted stream
+type StreamHeader struct {
+	ChunkSize int
+	Prefix    []byte
+}
+
+// ReadStreamHeader consumes and validates the header of an encrypted stream
+func ReadStreamHeader(r io.Reader) (StreamHeader, error) {
+	header := make([]byte, StreamHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return StreamHeader{}, errStreamCorrupted
+	}
+	if string(header[:len(streamMagic)]) != streamMagic {
+		return StreamHeader{}, errStreamCorrupted
+	}
+	chunkSize := binary.BigEndian.Uint32(header[len(streamMagic):])
+	if chunkSize == 0 || chunkSize > 16<<20 {
+		return StreamHeader{}, errStreamCorrupted
+	}
+	return StreamHeader{
+		ChunkSize: int(chunkSize),
+		Prefix:    header[len(streamMagic)+4:],
+	}, nil
+}
+
+// EncryptedRange locates plaintext bytes [offset, offset+length) in an encrypted
+// stream, or everything from offset when length is negative. It returns the
+// span of the stream to read, which includes the byte of lookahead the decrypt
+// reader needs, the number of the first chunk in it and how many plaintext
+// bytes of that chunk come before offset.
+func EncryptedRange(header StreamHeader, offset, length int64) (start, size int64, first uint32, skip int64) {
+	chunkSize := int64(header.ChunkSize)
+	sealedSize := chunkSize + streamTagSize
+	chunk := offset / chunkSize
+	start = int64(StreamHeaderSize) + chunk*sealedSize
+	size = -1
+	if length >= 0 {
+		last := (offset + length - 1) / chunkSize
+		if last < chunk {
+			last = chunk
+		}
+		size = (last-chunk+1)*sealedSize + 1
+	}
+	return start, size, uint32(chunk), offset - chunk*chunkSize
+}
+
+type decryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	header  StreamHeader
+	counter uint32
+	sealed  []byte
+	have    int
+	out     []byte
+	done    bool
+}
+
+// NewDecryptReader returns a reader producing the plaintext of an encrypted stream
+func NewDecryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	header, err := ReadStreamHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	return NewChunkDecryptReader(src, key, header, 0)
+}
+
+// NewChunkDecryptReader decrypts a stream whose reader is positioned at the
+// start of chunk number first, just after the header has been read elsewhere
+func NewChunkDecryptReader(src io.Reader, key []byte, header StreamHeader, first uint32) (io.Reader, error) {
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		src:     src,
+		aead:    aead,
+		header:  header,
+		counter: first,
+		sealed:  make([]byte, header.ChunkSize+streamTagSize+1),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.openNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *decryptReader) openNext() error {
+	// Read one sealed chunk plus a byte of lookahead to know whether it is the last
+	n, err := io.ReadFull(d.src, d.sealed[d.have:])
+	size := d.have + n
+	d.have = 0
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	chunkLen := d.header.ChunkSize + streamTagSize
+	last := size <= chunkLen
+	if !last {
+		size = chunkLen
+	}
+	if size < streamTagSize {
+		return errStreamCorrupted
+	}
+
+	plain, err := d.aead.Open(d.sealed[:0:0], streamNonce(d.header.Prefix, d.counter, last), d.sealed[:size], nil)
+	if err != nil {
+		return errStreamCorrupted
+	}
+	if !last {
+		d.sealed[0] = d.sealed[chunkLen]
+		d.have = 1
+	}
+	d.out = plain
+	d.counter++
+	d.done = last
+	return nil
+}
+
+// EncryptedSize returns the length of the encrypted stream for size bytes of plaintext
+func EncryptedSize(size int64, chunkSize int) int64 {
+	chunks := (size + int64(chunkSize) - 1) / int64(chunkSize)
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(StreamHeaderSize) + size + chunks*streamTagSize
+}
+
+// LoadMasterKey decodes a base64 encoded 32 byte key from the environment.
+// It returns nil when the variable is unset.
+func LoadMasterKey(name string) ([]byte, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not valid base64: %w", name, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s must decode to 32 bytes, got %d", name, len(key))
+	}
+	return key, nil
+}
+
+// MasterKeyID identifies a master key without revealing it
+func MasterKeyID(masterKey []byte) string {
+	sum := sha256.Sum256(masterKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+// WrapKey encrypts a data key with the master key (envelope encryption)
+func WrapKey(dataKey []byte, masterKey []byte) (string, error) {
+	wrapped, err := EncryptFile(dataKey, masterKey)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+// UnwrapKey recovers a data key wrapped by WrapKey
+func UnwrapKey(wrappedKey string, masterKey []byte) ([]byte, error) {
+	wrapped, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return DecryptFile(wrapped, masterKey)
+}
@@ -43,3 +43,42 @@ func ValidateToken(tokenString string) (*Claims, error) {
 
 	return claims, nil
 }
+
+// ShareClaims unlock a password protected share link for a while
+type ShareClaims struct {
+	Token       string
+	Fingerprint string
+	jwt.RegisteredClaims
+}
+
+// GenerateShareToken signs the cookie value handed out after a share link
+// password was entered. The fingerprint ties it to the current password.
+func GenerateShareToken(shareToken, fingerprint string, ttl time.Duration) (string, error) {
+	claims := &ShareClaims{
+		Token:       shareToken,
+		Fingerprint: fingerprint,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtKey)
+}
+
+func ValidateShareToken(tokenString, shareToken, fingerprint string) error {
+	claims := &ShareClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if !token.Valid || claims.Token != shareToken || claims.Fingerprint != fingerprint {
+		return errors.New("invalid token")
+	}
+
+	return nil
+}
@@ -0,0 +1,298 @@
+package utils
+
+import (
+	"bytes"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// SniffLen is how much of the start of a file SniffType looks at
+const SniffLen = 8192
+
+// Categories group MIME types for filtering
+const (
+	CategoryImage      = "image"
+	CategoryVideo      = "video"
+	CategoryAudio      = "audio"
+	CategoryDocument   = "document"
+	CategoryArchive    = "archive"
+	CategoryText       = "text"
+	CategoryFont       = "font"
+	CategoryExecutable = "executable"
+	CategoryOther      = "other"
+)
+
+// FileType is what a file is, detected from its content
+type FileType struct {
+	MimeType  string
+	Category  string
+	Extension string // canonical extension of the type, without the dot
+}
+
+// magic signatures net/http.DetectContentType doesn't know
+var signatures = []struct {
+	offset int
+	magic  string
+	mime   string
+}{
+	{0, "7z\xBC\xAF\x27\x1C", "application/x-7z-compressed"},
+	{0, "BZh", "application/x-bzip2"},
+	{0, "\xFD7zXZ\x00", "application/x-xz"},
+	{0, "\x28\xB5\x2F\xFD", "application/zstd"},
+	{257, "ustar", "application/x-tar"},
+	{0, "II*\x00", "image/tiff"},
+	{0, "MM\x00*", "image/tiff"},
+	{0, "fLaC", "audio/flac"},
+	{0, "{\\rtf", "application/rtf"},
+	{0, "\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1", "application/x-ole-storage"},
+	{0, "SQLite format 3\x00", "application/vnd.sqlite3"},
+	{0, "\x7FELF", "application/x-elf"},
+	{0, "MZ", "application/vnd.microsoft.portable-executable"},
+}
+
+// mimeAliases normalizes the names DetectContentType uses
+var mimeAliases = map[string]string{
+	"application/x-gzip":           "application/gzip",
+	"application/x-rar-compressed": "application/vnd.rar",
+	"text/xml":                     "application/xml",
+	"audio/wave":                   "audio/wav",
+	"audio/x-wav":                  "audio/wav",
+	"audio/mp3":                    "audio/mpeg",
+}
+
+// SniffType detects the MIME type of a file from the first SniffLen bytes
+// of its content, ignoring its name. Content that isn't recognized is
+// text/plain when it looks like text and application/octet-stream otherwise.
+func SniffType(head []byte) string {
+	if len(head) > SniffLen {
+		head = head[:SniffLen]
+	}
+	for _, sig := range signatures {
+		if len(head) >= sig.offset+len(sig.magic) && string(head[sig.offset:sig.offset+len(sig.magic)]) == sig.magic {
+			return sig.mime
+		}
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return sniffZip(head)
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		switch string(head[8:12]) {
+		case "heic", "heix", "heim", "heis", "mif1", "msf1":
+			return "image/heic"
+		case "avif", "avis":
+			return "image/avif"
+		case "qt  ":
+			return "video/quicktime"
+		case "M4A ", "M4B ":
+			return "audio/mp4"
+		}
+		return "video/mp4"
+	case bytes.HasPrefix(head, []byte("\x1A\x45\xDF\xA3")):
+		if bytes.Contains(head, []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case bytes.HasPrefix(head, []byte("OggS")):
+		if bytes.Contains(head, []byte("theora")) {
+			return "video/ogg"
+		}
+		return "audio/ogg"
+	case len(head) >= 2 && head[0] == 0xFF && head[1]&0xE6 == 0xE2:
+		// MPEG audio frame sync without an ID3 tag
+		return "audio/mpeg"
+	}
+
+	mime := http.DetectContentType(head)
+	mime = strings.ToLower(strings.TrimSpace(strings.SplitN(mime, ";", 2)[0]))
+	if alias, ok := mimeAliases[mime]; ok {
+		mime = alias
+	}
+	// SVG is XML or text that runs script when opened, it must not pass as text
+	if (mime == "text/plain" || mime == "application/xml") && bytes.Contains(bytes.ToLower(head), []byte("<svg")) {
+		return "image/svg+xml"
+	}
+	return mime
+}
+
+// sniffZip tells apart the formats that are zip archives underneath.
+// OpenDocument and EPUB start with an uncompressed mimetype entry, Office
+// Open XML files name their parts in the local file headers.
+func sniffZip(head []byte) string {
+	if len(head) > 38 && string(head[30:38]) == "mimetype" {
+		end := 38
+		for end < len(head) && end < 38+80 && head[end] >= 0x20 && head[end] < 0x7F && head[end] != 'P' {
+			end++
+		}
+		switch mime := string(head[38:end]); {
+		case strings.HasPrefix(mime, "application/vnd.oasis.opendocument."), mime == "application/epub+zip":
+			return mime
+		}
+	}
+	if bytes.Contains(head, []byte("[Content_Types].xml")) || bytes.Contains(head, []byte("_rels/.rels")) {
+		switch {
+		case bytes.Contains(head, []byte("word/")):
+			return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+		case bytes.Contains(head, []byte("xl/")):
+			return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		case bytes.Contains(head, []byte("ppt/")):
+			return "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+		}
+	}
+	return "application/zip"
+}
+
+// nameRefinements are the types a file name may narrow a sniffed type down
+// to. Only types of the same family are allowed, so a name never turns
+// content into something it isn't.
+var nameRefinements = map[string]map[string]string{
+	"text/plain": {
+		"md": "text/markdown", "markdown": "text/markdown",
+		"csv": "text/csv", "tsv": "text/tab-separated-values",
+		"json": "application/json", "xml": "application/xml",
+		"yaml": "application/yaml", "yml": "application/yaml",
+		"css": "text/css", "js": "text/javascript", "mjs": "text/javascript",
+		"ts": "text/x-typescript", "go": "text/x-go", "py": "text/x-python",
+		"java": "text/x-java", "c": "text/x-c", "h": "text/x-c",
+		"cpp": "text/x-c++", "cc": "text/x-c++", "hpp": "text/x-c++",
+		"rs": "text/x-rust", "rb": "text/x-ruby", "php": "text/x-php",
+		"sh": "application/x-sh", "sql": "application/sql",
+	},
+	"application/zip": {
+		"docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		"pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		"jar":  "application/java-archive",
+		"apk":  "application/vnd.android.package-archive",
+	},
+	"application/x-ole-storage": {
+		"doc": "application/msword",
+		"xls": "application/vnd.ms-excel",
+		"ppt": "application/vnd.ms-powerpoint",
+		"msg": "application/vnd.ms-outlook",
+	},
+}
+
+// mimeExtensions are the canonical extensions of the types SniffType finds
+var mimeExtensions = map[string]string{
+	"application/pdf":               "pdf",
+	"application/postscript":        "ps",
+	"application/rtf":               "rtf",
+	"application/epub+zip":          "epub",
+	"application/msword":            "doc",
+	"application/vnd.ms-excel":      "xls",
+	"application/vnd.ms-powerpoint": "ppt",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   "docx",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         "xlsx",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": "pptx",
+	"application/vnd.oasis.opendocument.text":                                   "odt",
+	"application/vnd.oasis.opendocument.spreadsheet":                            "ods",
+	"application/vnd.oasis.opendocument.presentation":                           "odp",
+	"application/zip":                               "zip",
+	"application/gzip":                              "gz",
+	"application/x-tar":                             "tar",
+	"application/x-7z-compressed":                   "7z",
+	"application/vnd.rar":                           "rar",
+	"application/x-bzip2":                           "bz2",
+	"application/x-xz":                              "xz",
+	"application/zstd":                              "zst",
+	"application/java-archive":                      "jar",
+	"application/vnd.sqlite3":                       "sqlite",
+	"application/wasm":                              "wasm",
+	"application/x-elf":                             "elf",
+	"application/vnd.microsoft.portable-executable": "exe",
+	"application/json":                              "json",
+	"application/xml":                               "xml",
+	"application/yaml":                              "yaml",
+	"text/plain":                                    "txt",
+	"text/html":                                     "html",
+	"text/markdown":                                 "md",
+	"text/csv":                                      "csv",
+	"image/jpeg":                                    "jpg",
+	"image/png":                                     "png",
+	"image/gif":                                     "gif",
+	"image/webp":                                    "webp",
+	"image/bmp":                                     "bmp",
+	"image/tiff":                                    "tiff",
+	"image/svg+xml":                                 "svg",
+	"image/heic":                                    "heic",
+	"image/avif":                                    "avif",
+	"image/x-icon":                                  "ico",
+	"video/mp4":                                     "mp4",
+	"video/quicktime":                               "mov",
+	"video/webm":                                    "webm",
+	"video/x-matroska":                              "mkv",
+	"video/avi":                                     "avi",
+	"video/ogg":                                     "ogv",
+	"audio/mpeg":                                    "mp3",
+	"audio/wav":                                     "wav",
+	"audio/flac":                                    "flac",
+	"audio/ogg":                                     "ogg",
+	"audio/mp4":                                     "m4a",
+	"audio/aiff":                                    "aiff",
+	"audio/midi":                                    "mid",
+	"font/ttf":                                      "ttf",
+	"font/otf":                                      "otf",
+	"font/woff":                                     "woff",
+	"font/woff2":                                    "woff2",
+}
+
+// DetectType combines the sniffed MIME type of a file's content with its
+// name. The name only narrows generic types down, e.g. text/plain to
+// text/csv for "data.csv", and fills in the extension of unknown binaries.
+func DetectType(name, sniffed string) FileType {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	if sniffed == "" {
+		sniffed = "application/octet-stream"
+	}
+
+	mime := sniffed
+	if refined, ok := nameRefinements[sniffed][ext]; ok {
+		mime = refined
+	}
+
+	t := FileType{MimeType: mime, Category: Category(mime), Extension: mimeExtensions[mime]}
+	// Text files keep their own extension, "py" says more than "txt"
+	if t.Category == CategoryText && ext != "" {
+		t.Extension = ext
+	}
+	if t.Extension == "" {
+		t.Extension = ext
+	}
+	return t
+}
+
+// Category groups a MIME type
+func Category(mime string) string {
+	switch {
+	case strings.HasPrefix(mime, "image/"):
+		return CategoryImage
+	case strings.HasPrefix(mime, "video/"):
+		return CategoryVideo
+	case strings.HasPrefix(mime, "audio/"):
+		return CategoryAudio
+	case strings.HasPrefix(mime, "font/"):
+		return CategoryFont
+	case strings.HasPrefix(mime, "text/"):
+		return CategoryText
+	}
+	switch mime {
+	case "application/pdf", "application/postscript", "application/rtf", "application/epub+zip",
+		"application/msword", "application/vnd.ms-excel", "application/vnd.ms-powerpoint", "application/vnd.ms-outlook":
+		return CategoryDocument
+	case "application/zip", "application/gzip", "application/x-tar", "application/x-7z-compressed",
+		"application/vnd.rar", "application/x-bzip2", "application/x-xz", "application/zstd":
+		return CategoryArchive
+	case "application/json", "application/xml", "application/yaml", "application/x-sh", "application/sql":
+		return CategoryText
+	case "application/x-elf", "application/vnd.microsoft.portable-executable",
+		"application/java-archive", "application/vnd.android.package-archive":
+		return CategoryExecutable
+	}
+	if strings.HasPrefix(mime, "application/vnd.openxmlformats-officedocument.") ||
+		strings.HasPrefix(mime, "application/vnd.oasis.opendocument.") {
+		return CategoryDocument
+	}
+	return CategoryOther
+}
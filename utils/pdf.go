@@ -0,0 +1,708 @@
+package utils
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// PDF text extraction covers what search needs from common PDFs: text shown
+// with Tj, TJ, ' and " in Flate compressed or plain content streams, with
+// fonts mapped to Unicode through ToUnicode CMaps or else read as Latin-1.
+// Objects inside object streams are found as well. Encrypted PDFs, other
+// filters and text drawn as images yield no text.
+
+const (
+	// pdfMaxStream caps how much a single stream may inflate to
+	pdfMaxStream = 64 << 20
+	// pdfMaxInflated caps how much all streams of a document may inflate to
+	pdfMaxInflated = 128 << 20
+)
+
+var (
+	pdfObjectStart = regexp.MustCompile(`(\d+)\s+\d+\s+obj\b`)
+	pdfStreamStart = regexp.MustCompile(`>>\s*stream(\r\n|\n|\r)`)
+	pdfRef         = regexp.MustCompile(`^\s*(\d+)\s+\d+\s+R`)
+	pdfFontEntry   = regexp.MustCompile(`/([^\s/<>\[\]()]+)\s+(\d+)\s+\d+\s+R`)
+	pdfContentRefs = regexp.MustCompile(`(\d+)\s+\d+\s+R`)
+	pdfCodespace   = regexp.MustCompile(`begincodespacerange\s*<([0-9A-Fa-f]+)>`)
+)
+
+type pdfObject struct {
+	dict string // everything up to the stream, usually a dictionary
+	raw  []byte // undecoded stream content, nil without a stream
+}
+
+// pdfDoc holds the objects of a document. Streams are only decoded when
+// they are read, which draws from a budget shared by the whole document.
+type pdfDoc struct {
+	objects map[int]pdfObject
+	budget  int // bytes streams may still inflate to
+}
+
+type pdfFont struct {
+	codeLen int               // bytes per character code
+	cmap    map[uint32]string // character code to text, nil for Latin-1
+}
+
+// PDFText returns up to maxLen bytes of the text of a PDF document
+func PDFText(data []byte, maxLen int) string {
+	doc := &pdfDoc{budget: pdfMaxInflated}
+	doc.index(data)
+	objects := doc.objects
+	fonts := pdfFonts(doc)
+
+	var ids []int
+	for id := range objects {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	// Pages in object order, followed by form XObjects which pages draw
+	var contents []int
+	for _, id := range ids {
+		dict := objects[id].dict
+		if pdfName(dict, "Type") == "Page" {
+			if i := strings.Index(dict, "/Contents"); i >= 0 {
+				rest := dict[i+len("/Contents"):]
+				if j := strings.IndexAny(rest, "/>"); j >= 0 {
+					rest = rest[:j]
+				}
+				for _, m := range pdfContentRefs.FindAllStringSubmatch(rest, -1) {
+					id, _ := strconv.Atoi(m[1])
+					contents = append(contents, id)
+				}
+			}
+		}
+	}
+	for _, id := range ids {
+		if pdfName(objects[id].dict, "Subtype") == "Form" {
+			contents = append(contents, id)
+		}
+	}
+
+	out := &textBuilder{max: maxLen}
+	for _, id := range contents {
+		if out.full() || doc.budget <= 0 {
+			break
+		}
+		if stream := doc.stream(id); stream != nil {
+			pdfShowText(stream, fonts, out)
+			out.WriteString("\n")
+		}
+	}
+	return out.String()
+}
+
+// index finds the numbered objects of a PDF, including those packed into
+// object streams. Later definitions win, as with incremental updates.
+func (d *pdfDoc) index(data []byte) {
+	objects := make(map[int]pdfObject)
+	d.objects = objects
+	matches := pdfObjectStart.FindAllSubmatchIndex(data, -1)
+	for i, m := range matches {
+		id, _ := strconv.Atoi(string(data[m[2]:m[3]]))
+		end := len(data)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		body := data[m[1]:end]
+		if j := bytes.Index(body, []byte("endobj")); j >= 0 {
+			body = body[:j]
+		}
+
+		object := pdfObject{dict: string(body)}
+		if loc := pdfStreamStart.FindIndex(body); loc != nil {
+			object.dict = string(body[:loc[0]+2])
+			raw := body[loc[1]:]
+			if e := bytes.LastIndex(raw, []byte("endstream")); e >= 0 {
+				raw = raw[:e]
+			}
+			object.raw = raw
+		}
+		objects[id] = object
+	}
+
+	var packed []int
+	for id, object := range objects {
+		if pdfName(object.dict, "Type") == "ObjStm" && object.raw != nil {
+			packed = append(packed, id)
+		}
+	}
+	sort.Ints(packed)
+	for _, streamID := range packed {
+		dict := objects[streamID].dict
+		stream := d.stream(streamID)
+		n, first := pdfInt(dict, "N"), pdfInt(dict, "First")
+		if first <= 0 || first > len(stream) {
+			continue
+		}
+		header := strings.Fields(string(stream[:first]))
+		for i := 0; i+1 < len(header) && i/2 < n; i += 2 {
+			id, err1 := strconv.Atoi(header[i])
+			offset, err2 := strconv.Atoi(header[i+1])
+			if err1 != nil || err2 != nil || first+offset > len(stream) {
+				continue
+			}
+			end := len(stream)
+			if i+3 < len(header) {
+				if next, err := strconv.Atoi(header[i+3]); err == nil && first+next >= first+offset && first+next <= end {
+					end = first + next
+				}
+			}
+			if _, ok := objects[id]; !ok {
+				objects[id] = pdfObject{dict: string(stream[first+offset : end])}
+			}
+		}
+	}
+}
+
+// stream decodes the stream of an object, nil without one or once the
+// document has used up its budget
+func (d *pdfDoc) stream(id int) []byte {
+	object, ok := d.objects[id]
+	if !ok || object.raw == nil || d.budget <= 0 {
+		return nil
+	}
+	decoded := pdfDecode(object.dict, object.raw, min(pdfMaxStream, d.budget))
+	d.budget -= len(decoded)
+	return decoded
+}
+
+// pdfDecode undoes the filters of a stream, inflating to at most limit
+// bytes, nil for filters it doesn't know
+func pdfDecode(dict string, raw []byte, limit int) []byte {
+	if length := pdfInt(dict, "Length"); length > 0 && length <= len(raw) {
+		raw = raw[:length]
+	}
+	switch filters := pdfFilters(dict); {
+	case len(filters) == 0:
+		return raw
+	case len(filters) == 1 && filters[0] == "FlateDecode":
+		zr, err := zlib.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil
+		}
+		// Truncated streams still give what was inflated so far
+		decoded, _ := io.ReadAll(io.LimitReader(zr, int64(limit)))
+		return decoded
+	}
+	return nil
+}
+
+// pdfFilters returns the names in the /Filter entry of a stream dictionary
+func pdfFilters(dict string) []string {
+	i := strings.Index(dict, "/Filter")
+	if i < 0 {
+		return nil
+	}
+	rest := strings.TrimSpace(dict[i+len("/Filter"):])
+	if strings.HasPrefix(rest, "[") {
+		if j := strings.IndexByte(rest, ']'); j >= 0 {
+			rest = rest[1:j]
+		}
+	} else if strings.HasPrefix(rest, "/") {
+		if j := strings.IndexAny(rest[1:], " /<>[]\r\n"); j >= 0 {
+			rest = rest[:j+1]
+		}
+	}
+	return strings.Fields(strings.ReplaceAll(rest, "/", " "))
+}
+
+// pdfFonts maps the resource names of fonts to how their strings decode
+func pdfFonts(doc *pdfDoc) map[string]pdfFont {
+	objects := doc.objects
+	fonts := make(map[string]pdfFont)
+	for _, object := range objects {
+		dict := object.dict
+		i := strings.Index(dict, "/Font")
+		for i >= 0 {
+			rest := dict[i+len("/Font"):]
+			entries := ""
+			if m := pdfRef.FindStringSubmatch(rest); m != nil {
+				// The font dictionary is an object of its own
+				id, _ := strconv.Atoi(m[1])
+				entries = objects[id].dict
+			} else if strings.HasPrefix(strings.TrimSpace(rest), "<<") {
+				entries = rest[:pdfDictEnd(rest)]
+			}
+			for _, m := range pdfFontEntry.FindAllStringSubmatch(entries, -1) {
+				id, _ := strconv.Atoi(m[2])
+				if _, seen := fonts[m[1]]; !seen {
+					fonts[m[1]] = pdfLoadFont(doc, objects[id].dict)
+				}
+			}
+			next := strings.Index(rest, "/Font")
+			if next < 0 {
+				break
+			}
+			i += len("/Font") + next
+		}
+	}
+	return fonts
+}
+
+// pdfDictEnd returns where the dictionary that s starts with ends
+func pdfDictEnd(s string) int {
+	depth := 0
+	for i := 0; i+1 < len(s); i++ {
+		switch {
+		case s[i] == '<' && s[i+1] == '<':
+			depth++
+			i++
+		case s[i] == '>' && s[i+1] == '>':
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(s)
+}
+
+func pdfLoadFont(doc *pdfDoc, dict string) pdfFont {
+	font := pdfFont{codeLen: 1}
+	if pdfName(dict, "Subtype") == "Type0" {
+		font.codeLen = 2
+	}
+	i := strings.Index(dict, "/ToUnicode")
+	if i < 0 {
+		return font
+	}
+	m := pdfRef.FindStringSubmatch(dict[i+len("/ToUnicode"):])
+	if m == nil {
+		return font
+	}
+	id, _ := strconv.Atoi(m[1])
+	cmap := string(doc.stream(id))
+	if m := pdfCodespace.FindStringSubmatch(cmap); m != nil {
+		font.codeLen = (len(m[1]) + 1) / 2
+	}
+	font.cmap = pdfParseCMap(cmap)
+	return font
+}
+
+// pdfParseCMap reads the bfchar and bfrange mappings of a ToUnicode CMap
+func pdfParseCMap(cmap string) map[uint32]string {
+	mapping := make(map[uint32]string)
+	for _, section := range pdfSections(cmap, "beginbfchar", "endbfchar") {
+		tokens := pdfHexTokens(section)
+		for i := 0; i+1 < len(tokens); i += 2 {
+			mapping[pdfCode(tokens[i])] = pdfUTF16(tokens[i+1])
+		}
+	}
+	for _, section := range pdfSections(cmap, "beginbfrange", "endbfrange") {
+		for _, line := range strings.Split(section, "\n") {
+			tokens := pdfHexTokens(line)
+			if len(tokens) < 3 {
+				continue
+			}
+			lo, hi := pdfCode(tokens[0]), pdfCode(tokens[1])
+			if hi < lo || hi-lo > 0xFFFF {
+				continue
+			}
+			if strings.Contains(line, "[") {
+				// One destination per code
+				for i, dst := range tokens[2:] {
+					if lo+uint32(i) > hi {
+						break
+					}
+					mapping[lo+uint32(i)] = pdfUTF16(dst)
+				}
+				continue
+			}
+			// Consecutive codes map to consecutive characters
+			dst := []rune(pdfUTF16(tokens[2]))
+			if len(dst) == 0 {
+				continue
+			}
+			for code := lo; code <= hi; code++ {
+				mapping[code] = string(dst[:len(dst)-1]) + string(dst[len(dst)-1]+rune(code-lo))
+			}
+		}
+	}
+	return mapping
+}
+
+func pdfSections(s, begin, end string) []string {
+	var sections []string
+	for {
+		i := strings.Index(s, begin)
+		if i < 0 {
+			return sections
+		}
+		s = s[i+len(begin):]
+		j := strings.Index(s, end)
+		if j < 0 {
+			return append(sections, s)
+		}
+		sections = append(sections, s[:j])
+		s = s[j+len(end):]
+	}
+}
+
+func pdfHexTokens(s string) []string {
+	var tokens []string
+	for {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			return tokens
+		}
+		j := strings.IndexByte(s[i:], '>')
+		if j < 0 {
+			return tokens
+		}
+		tokens = append(tokens, s[i+1:i+j])
+		s = s[i+j+1:]
+	}
+}
+
+func pdfCode(hex string) uint32 {
+	code, _ := strconv.ParseUint(strings.Join(strings.Fields(hex), ""), 16, 32)
+	return uint32(code)
+}
+
+func pdfUTF16(hex string) string {
+	b := pdfHexBytes(hex)
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
+
+func pdfHexBytes(hex string) []byte {
+	var b []byte
+	var high byte
+	half := false
+	for i := 0; i < len(hex); i++ {
+		var v byte
+		switch c := hex[i]; {
+		case c >= '0' && c <= '9':
+			v = c - '0'
+		case c >= 'a' && c <= 'f':
+			v = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			v = c - 'A' + 10
+		default:
+			continue
+		}
+		if half {
+			b = append(b, high<<4|v)
+		} else {
+			high = v
+		}
+		half = !half
+	}
+	if half {
+		b = append(b, high<<4)
+	}
+	return b
+}
+
+// pdfName returns the name value of a key in a dictionary, e.g. "Page" for /Type
+func pdfName(dict, key string) string {
+	i := strings.Index(dict, "/"+key)
+	for i >= 0 {
+		rest := dict[i+len(key)+1:]
+		// Skip keys that only start with key, like /TypeX
+		if rest != "" && (rest[0] == ' ' || rest[0] == '/' || rest[0] == '\n' || rest[0] == '\r') {
+			rest = strings.TrimLeft(rest, " \r\n")
+			if strings.HasPrefix(rest, "/") {
+				end := strings.IndexAny(rest[1:], " /<>[]()\r\n")
+				if end < 0 {
+					end = len(rest) - 1
+				}
+				return rest[1 : end+1]
+			}
+			return ""
+		}
+		next := strings.Index(rest, "/"+key)
+		if next < 0 {
+			return ""
+		}
+		i += len(key) + 1 + next
+	}
+	return ""
+}
+
+// pdfInt returns the direct integer value of a key in a dictionary, 0 when
+// it is missing or a reference
+func pdfInt(dict, key string) int {
+	for i := strings.Index(dict, "/"+key); i >= 0; {
+		rest := dict[i+len(key)+1:]
+		fields := strings.Fields(rest)
+		if rest != "" && strings.IndexByte(" \t\r\n", rest[0]) >= 0 && len(fields) > 0 {
+			n, err := strconv.Atoi(fields[0])
+			if err != nil || len(fields) >= 3 && strings.HasPrefix(fields[2], "R") {
+				return 0
+			}
+			return n
+		}
+		next := strings.Index(rest, "/"+key)
+		if next < 0 {
+			break
+		}
+		i += len(key) + 1 + next
+	}
+	return 0
+}
+
+// pdfShowText runs the text operators of a content stream
+func pdfShowText(content []byte, fonts map[string]pdfFont, out *textBuilder) {
+	lex := pdfLexer{data: content}
+	var operands []pdfToken
+	font := pdfFont{codeLen: 1}
+	fontSize := 0.0
+	shown := 0 // characters shown since the last move
+	lastY := ""
+	show := func(b []byte) {
+		text := font.decode(b)
+		shown += len([]rune(text))
+		out.WriteString(text)
+	}
+	for !out.full() {
+		token, ok := lex.next()
+		if !ok {
+			return
+		}
+		if token.kind != pdfOperator {
+			operands = append(operands, token)
+			continue
+		}
+		switch token.text {
+		case "Tf":
+			if len(operands) >= 2 && operands[len(operands)-2].kind == pdfNameToken {
+				if f, ok := fonts[operands[len(operands)-2].text]; ok {
+					font = f
+				} else {
+					font = pdfFont{codeLen: 1}
+				}
+				fontSize, _ = strconv.ParseFloat(operands[len(operands)-1].text, 64)
+			}
+		case "Tj":
+			if len(operands) > 0 {
+				show(operands[len(operands)-1].bytes)
+			}
+		case "'", "\"":
+			out.WriteString("\n")
+			if len(operands) > 0 {
+				show(operands[len(operands)-1].bytes)
+			}
+		case "TJ":
+			for _, item := range operands {
+				switch item.kind {
+				case pdfString:
+					show(item.bytes)
+				case pdfNumber:
+					// Wide negative adjustments separate words
+					if n, _ := strconv.ParseFloat(item.text, 64); n < -200 {
+						out.WriteString(" ")
+					}
+				}
+			}
+		case "Td", "TD":
+			if len(operands) >= 2 {
+				x, _ := strconv.ParseFloat(operands[len(operands)-2].text, 64)
+				y, _ := strconv.ParseFloat(operands[len(operands)-1].text, 64)
+				switch {
+				case y != 0:
+					out.WriteString("\n")
+				case x > (float64(shown)*0.6+0.3)*fontSize:
+					// Moved further than the text shown is wide, roughly
+					out.WriteString(" ")
+				}
+				shown = 0
+			}
+		case "Tm":
+			if len(operands) >= 6 {
+				if y := operands[len(operands)-1].text; y != lastY {
+					out.WriteString("\n")
+					lastY = y
+				}
+			}
+		case "T*", "ET":
+			out.WriteString("\n")
+		case "ID":
+			lex.skipInlineImage()
+		}
+		operands = operands[:0]
+	}
+}
+
+func (f pdfFont) decode(b []byte) string {
+	if f.cmap == nil {
+		if f.codeLen == 2 {
+			// Glyph IDs without a mapping say nothing about the text
+			return ""
+		}
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes)
+	}
+	var s strings.Builder
+	for i := 0; i+f.codeLen <= len(b); i += f.codeLen {
+		var code uint32
+		for _, c := range b[i : i+f.codeLen] {
+			code = code<<8 | uint32(c)
+		}
+		s.WriteString(f.cmap[code])
+	}
+	return s.String()
+}
+
+const (
+	pdfOperator = iota
+	pdfNumber
+	pdfString
+	pdfNameToken
+	pdfOther
+)
+
+type pdfToken struct {
+	kind  int
+	text  string
+	bytes []byte // content of strings
+}
+
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func pdfDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/% \t\r\n\f\x00", c) >= 0
+}
+
+func (l *pdfLexer) next() (pdfToken, bool) {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0:
+			l.pos++
+		case c == '%':
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		case c == '(':
+			return pdfToken{kind: pdfString, bytes: l.literal()}, true
+		case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+			l.pos += 2
+			return pdfToken{kind: pdfOther, text: "<<"}, true
+		case c == '>' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '>':
+			l.pos += 2
+			return pdfToken{kind: pdfOther, text: ">>"}, true
+		case c == '<':
+			end := bytes.IndexByte(l.data[l.pos:], '>')
+			if end < 0 {
+				end = len(l.data) - l.pos
+			}
+			hex := string(l.data[l.pos+1 : l.pos+end])
+			l.pos += end + 1
+			return pdfToken{kind: pdfString, bytes: pdfHexBytes(hex)}, true
+		case c == '[':
+			// Arrays are flattened, TJ is the only operator taking one
+			l.pos++
+		case c == ']' || c == '{' || c == '}' || c == ')' || c == '>':
+			l.pos++
+		case c == '/':
+			start := l.pos + 1
+			l.pos++
+			for l.pos < len(l.data) && !pdfDelimiter(l.data[l.pos]) {
+				l.pos++
+			}
+			return pdfToken{kind: pdfNameToken, text: string(l.data[start:l.pos])}, true
+		default:
+			start := l.pos
+			for l.pos < len(l.data) && !pdfDelimiter(l.data[l.pos]) {
+				l.pos++
+			}
+			word := string(l.data[start:l.pos])
+			if _, err := strconv.ParseFloat(word, 64); err == nil {
+				return pdfToken{kind: pdfNumber, text: word}, true
+			}
+			return pdfToken{kind: pdfOperator, text: word}, true
+		}
+	}
+	return pdfToken{}, false
+}
+
+// literal reads a (string) with nested parentheses and escapes
+func (l *pdfLexer) literal() []byte {
+	var b []byte
+	depth := 0
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			if depth > 0 {
+				b = append(b, c)
+			}
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return b
+			}
+			b = append(b, c)
+		case '\\':
+			if l.pos >= len(l.data) {
+				return b
+			}
+			e := l.data[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				b = append(b, '\n')
+			case 'r':
+				b = append(b, '\r')
+			case 't':
+				b = append(b, '\t')
+			case 'b':
+				b = append(b, '\b')
+			case 'f':
+				b = append(b, '\f')
+			case '\r', '\n':
+				// Line continuation
+				if e == '\r' && l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for n := 0; n < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; n++ {
+						v = v*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					b = append(b, byte(v))
+				} else {
+					b = append(b, e)
+				}
+			}
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// skipInlineImage moves past the data of an inline image, up to EI
+func (l *pdfLexer) skipInlineImage() {
+	for i := l.pos + 1; i+2 <= len(l.data); i++ {
+		if l.data[i] == 'E' && l.data[i+1] == 'I' && pdfDelimiter(l.data[i-1]) &&
+			(i+2 == len(l.data) || pdfDelimiter(l.data[i+2])) {
+			l.pos = i + 2
+			return
+		}
+	}
+	l.pos = len(l.data)
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// buildPDF numbers objects from 1 in the order given. The parser finds
+// objects by scanning, so no cross-reference table is needed.
+func buildPDF(objects ...string) []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.7\n")
+	for i, object := range objects {
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	b.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return b.Bytes()
+}
+
+func pdfStream(dict, content string) string {
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dict, len(content), content)
+}
+
+func flateStream(dict, content string) string {
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	zw.Write([]byte(content))
+	zw.Close()
+	return pdfStream(dict+" /Filter /FlateDecode", b.String())
+}
+
+// onePage is a document with a single page drawing content with font F1
+func onePage(content, font string, extra ...string) []byte {
+	return buildPDF(append([]string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Resources << /Font << /F1 5 0 R >> >> /Contents 4 0 R >>",
+		content,
+		font,
+	}, extra...)...)
+}
+
+const helvetica = "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>"
+
+func TestPDFTextPlainStream(t *testing.T) {
+	data := onePage(pdfStream("", "BT /F1 12 Tf 72 700 Td (Hello World) Tj 0 -14 Td (Second \\(line\\)) Tj ET"), helvetica)
+	text := PDFText(data, 1<<20)
+	if !strings.Contains(text, "Hello World\nSecond (line)") {
+		t.Errorf("PDFText = %q", text)
+	}
+}
+
+func TestPDFTextFlateAndTJ(t *testing.T) {
+	data := onePage(flateStream("", "BT /F1 12 Tf [(Hel) -20 (lo) -500 (there)] TJ ET"), helvetica)
+	text := PDFText(data, 1<<20)
+	if !strings.Contains(text, "Hello there") {
+		t.Errorf("PDFText = %q", text)
+	}
+}
+
+func TestPDFTextToUnicode(t *testing.T) {
+	cmap := `/CIDInit /ProcSet findresource begin
+begincmap
+1 begincodespacerange
+<0000> <FFFF>
+endcodespacerange
+2 beginbfchar
+<0001> <0048>
+<0002> <00E9>
+endbfchar
+1 beginbfrange
+<0010> <0012> <0061>
+endbfrange
+endcmap`
+	data := onePage(
+		pdfStream("", "BT /F1 12 Tf <0001000200100011001000120012> Tj ET"),
+		"<< /Type /Font /Subtype /Type0 /BaseFont /Custom /ToUnicode 6 0 R >>",
+		flateStream("", cmap),
+	)
+	if text := PDFText(data, 1<<20); !strings.Contains(text, "Héabacc") {
+		t.Errorf("PDFText = %q, want Héabacc", text)
+	}
+}
+
+func TestPDFTextGlyphsWithoutMapping(t *testing.T) {
+	data := onePage(pdfStream("", "BT /F1 12 Tf <00010002> Tj ET"), "<< /Type /Font /Subtype /Type0 /BaseFont /Custom >>")
+	if text := strings.TrimSpace(PDFText(data, 1<<20)); text != "" {
+		t.Errorf("PDFText = %q, want no text for unmapped glyph IDs", text)
+	}
+}
+
+func TestPDFTextObjectStream(t *testing.T) {
+	// The page and font live in an object stream, only the content is direct
+	page := "<< /Type /Page /Resources << /Font << /F1 6 0 R >> >> /Contents 4 0 R >>"
+	header := fmt.Sprintf("5 0 6 %d ", len(page)+1)
+	packed := header + page + " " + helvetica
+	data := buildPDF(
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [5 0 R] /Count 1 >>",
+		flateStream(fmt.Sprintf("/Type /ObjStm /N 2 /First %d", len(header)), packed),
+		pdfStream("", "BT /F1 12 Tf (Packed away) Tj ET"),
+	)
+	if text := PDFText(data, 1<<20); !strings.Contains(text, "Packed away") {
+		t.Errorf("PDFText = %q", text)
+	}
+}
+
+func TestPDFTextMaxLen(t *testing.T) {
+	data := onePage(pdfStream("", "BT /F1 12 Tf ("+strings.Repeat("word ", 100)+") Tj ET"), helvetica)
+	if text := PDFText(data, 20); len(text) > 20 {
+		t.Errorf("PDFText returned %d bytes, want at most 20", len(text))
+	}
+}
+
+func TestPDFTextMalformed(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty":           nil,
+		"not a pdf":       []byte("just some text"),
+		"unknown filter":  onePage(pdfStream("/Filter /LZWDecode", "BT (hidden) Tj ET"), helvetica),
+		"broken flate":    onePage(pdfStream("/Filter /FlateDecode", "not zlib at all"), helvetica),
+		"unclosed string": onePage(pdfStream("", "BT /F1 12 Tf (never closed Tj ET"), helvetica),
+		"unclosed stream": []byte("%PDF-1.7\n1 0 obj\n<< /Type /Page /Contents 2 0 R >>\nendobj\n2 0 obj\n<< /Length 999 >>\nstream\nBT (cut"),
+		"bad object stream": buildPDF(
+			pdfStream("/Type /ObjStm /N 5 /First 9999", "1 0 2"),
+		),
+	} {
+		// Whatever comes out, the parser must not panic or hang
+		text := PDFText(data, 1<<20)
+		if strings.Contains(text, "hidden") {
+			t.Errorf("%s: PDFText = %q", name, text)
+		}
+	}
+}
+
+func TestPDFDecodeLimit(t *testing.T) {
+	raw := []byte(flateStream("", strings.Repeat("\x00", 1<<20)))
+	start := bytes.Index(raw, []byte("stream\n")) + len("stream\n")
+	decoded := pdfDecode("/Filter /FlateDecode", raw[start:], 1000)
+	if len(decoded) != 1000 {
+		t.Errorf("pdfDecode inflated to %d bytes, want the limit of 1000", len(decoded))
+	}
+}
@@ -21,7 +21,8 @@ func RateLimiterMiddleware(redisClient *redis.Client) gin.HandlerFunc {
 		}
 
 		ctx := context.Background()
-		limitKey := fmt.Sprintf("rate_limit_%v", userID)
+		// Keys are namespaced per organization like every other tenant key
+		limitKey := fmt.Sprintf("org_%d:rate_limit_%v", c.GetUint("orgID"), userID)
 		limit, err := redisClient.Get(ctx, limitKey).Int()
 
 		if err == redis.Nil {
@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrNoText is returned for content without text that can be indexed
+var ErrNoText = errors.New("no text found")
+
+const mimeDOCX = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+
+// docxMaxXML caps how much of a DOCX's document.xml is inflated
+const docxMaxXML = 256 << 20
+
+// TextDocumentTypes are the MIME types besides text/* that ExtractText
+// reads. Zip files are included because DOCX files aren't always recognized
+// from their first bytes.
+var TextDocumentTypes = []string{"application/pdf", mimeDOCX, "application/zip", "application/json", "application/xml"}
+
+// TextSource tells whether ExtractText can find text in content of a MIME type
+func TextSource(mimeType string) bool {
+	for _, t := range TextDocumentTypes {
+		if mimeType == t {
+			return true
+		}
+	}
+	return strings.HasPrefix(mimeType, "text/")
+}
+
+// ExtractText returns up to maxLen bytes of the text of content of a MIME
+// type, with control characters dropped and runs of white space collapsed
+func ExtractText(mimeType string, r io.Reader, maxLen int) (string, error) {
+	var text string
+	switch {
+	case mimeType == "application/pdf":
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+		text = PDFText(data, maxLen)
+	case mimeType == mimeDOCX || mimeType == "application/zip":
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+		if text, err = DOCXText(data, maxLen); err != nil {
+			return "", err
+		}
+	case TextSource(mimeType):
+		data, err := io.ReadAll(io.LimitReader(r, int64(maxLen)))
+		if err != nil {
+			return "", err
+		}
+		if bytes.IndexByte(data, 0) >= 0 {
+			// UTF-16 or binary content that only looked like text
+			return "", ErrNoText
+		}
+		out := &textBuilder{max: maxLen}
+		out.WriteString(string(data))
+		text = out.String()
+	default:
+		return "", ErrNoText
+	}
+	if text == "" {
+		return "", ErrNoText
+	}
+	return text, nil
+}
+
+// DOCXText returns up to maxLen bytes of the text of the main document of a
+// DOCX file, one paragraph per line. Deleted tracked changes are left out.
+func DOCXText(data []byte, maxLen int) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", ErrNoText
+	}
+	for _, f := range zr.File {
+		if f.Name != "word/document.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+
+		out := &textBuilder{max: maxLen}
+		decoder := xml.NewDecoder(io.LimitReader(rc, docxMaxXML))
+		inText := false
+		for !out.full() {
+			token, err := decoder.Token()
+			if err != nil {
+				// Keep what was read before a truncated or broken part
+				break
+			}
+			switch t := token.(type) {
+			case xml.StartElement:
+				switch t.Name.Local {
+				case "t":
+					inText = true
+				case "tab":
+					out.WriteString("\t")
+				case "br", "cr":
+					out.WriteString("\n")
+				}
+			case xml.EndElement:
+				switch t.Name.Local {
+				case "t":
+					inText = false
+				case "p":
+					out.WriteString("\n")
+				}
+			case xml.CharData:
+				if inText {
+					out.WriteString(string(t))
+				}
+			}
+		}
+		return out.String(), nil
+	}
+	return "", ErrNoText
+}
+
+// textBuilder collects extracted text up to max bytes, dropping control
+// characters and collapsing runs of white space into a space or a newline
+type textBuilder struct {
+	b     strings.Builder
+	max   int
+	space rune // separator to write before the next character
+	done  bool // the next character didn't fit
+}
+
+func (t *textBuilder) WriteString(s string) {
+	for _, r := range s {
+		if t.full() {
+			return
+		}
+		switch {
+		case r == '\n' || r == '\r' || r == '\f' || r == '\v' || r == ' ' || r == ' ':
+			t.space = '\n'
+		case unicode.IsSpace(r):
+			if t.space == 0 {
+				t.space = ' '
+			}
+		case unicode.IsControl(r) || r == utf8.RuneError:
+		default:
+			if t.b.Len() == 0 {
+				t.space = 0
+			}
+			size := utf8.RuneLen(r)
+			if t.space != 0 {
+				size++
+			}
+			if t.max > 0 && t.b.Len()+size > t.max {
+				// Never cut a character or end on a separator
+				t.done = true
+				return
+			}
+			if t.space != 0 {
+				t.b.WriteRune(t.space)
+			}
+			t.space = 0
+			t.b.WriteRune(r)
+		}
+	}
+}
+
+func (t *textBuilder) full() bool {
+	return t.done || t.max > 0 && t.b.Len() >= t.max
+}
+
+func (t *textBuilder) String() string {
+	return t.b.String()
+}